@@ -12,13 +12,13 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/AidyyJ/PortOpener/cli/internal/config"
 	"github.com/AidyyJ/PortOpener/cli/internal/daemon"
 	"github.com/AidyyJ/PortOpener/cli/internal/relayclient"
+	"github.com/google/uuid"
 )
 
 func main() {
@@ -59,8 +59,8 @@ func main() {
 func runRelay(args []string) {
 	fs := flag.NewFlagSet("relay", flag.ExitOnError)
 	url := fs.String("url", getenv("PORTOPENER_RELAY_URL", "ws://localhost/relay"), "relay websocket url")
-	token := fs.String("token", getenv("PORTOPENER_RELAY_TOKEN", getenv("PORTOPENER_ADMIN_TOKEN", "")), "relay token")
-	clientID := fs.String("client-id", "", "client id (uuid if empty)")
+	token := fs.String("token", getenv("PORTOPENER_RELAY_TOKEN", ""), "relay token")
+	clientID := fs.String("client-id", "", "client id (stable per machine if empty)")
 	heartbeat := fs.Duration("heartbeat", 10*time.Second, "heartbeat interval")
 	fs.Parse(args)
 
@@ -75,25 +75,26 @@ func runRelay(args []string) {
 	client := relayclient.New(relayclient.Config{
 		URL:             *url,
 		Token:           resolvedToken,
-		ClientID:        *clientID,
+		ClientID:        resolveClientID(*clientID),
 		HeartbeatPeriod: *heartbeat,
 	})
 
-	if err := client.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
-		log.Fatalf("relay session failed: %v", err)
-	}
+	serve(ctx, client)
 }
 
 func runHTTP(args []string) {
 	fs := flag.NewFlagSet("http", flag.ExitOnError)
 	url := fs.String("url", getenv("PORTOPENER_RELAY_URL", "ws://localhost/relay"), "relay websocket url")
-	token := fs.String("token", getenv("PORTOPENER_RELAY_TOKEN", getenv("PORTOPENER_ADMIN_TOKEN", "")), "relay token")
+	token := fs.String("token", getenv("PORTOPENER_RELAY_TOKEN", ""), "relay token")
 	subdomain := fs.String("subdomain", "", "subdomain to register")
 	allowlist := fs.String("allow", "", "comma-separated allowlist CIDRs")
-	clientID := fs.String("client-id", "", "client id (uuid if empty)")
+	rateLimit := fs.Float64("rate-limit", 0, "max requests per second for the whole tunnel (0 is unlimited)")
+	ipRateLimit := fs.Float64("ip-rate-limit", 0, "max requests per second from each remote IP (0 is unlimited)")
+	clientID := fs.String("client-id", "", "client id (stable per machine if empty)")
 	local := fs.String("local", getenv("PORTOPENER_LOCAL_URL", "http://localhost:8081"), "local base url")
 	localHost := fs.String("local-host", getenv("PORTOPENER_LOCAL_HOST", "localhost"), "local host for tunnel metadata")
 	localPort := fs.Int("local-port", getenvInt("PORTOPENER_LOCAL_PORT", 8081), "local port for tunnel metadata")
+	preserveHost := fs.Bool("preserve-host", false, "forward the original Host header instead of the local host")
 	fs.Parse(args)
 
 	resolvedToken := resolveToken(*token)
@@ -107,34 +108,38 @@ func runHTTP(args []string) {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	resolvedClientID := resolveClientID(*clientID)
 	client := relayclient.New(relayclient.Config{
-		URL:          *url,
-		Token:        resolvedToken,
-		ClientID:     *clientID,
+		URL:      *url,
+		Token:    resolvedToken,
+		ClientID: resolvedClientID,
+	})
+
+	client.AddTunnel(relayclient.Tunnel{
+		ID:           oneShotTunnelID(resolvedClientID, "http", *subdomain),
+		Protocol:     "http",
+		Subdomain:    *subdomain,
+		Allowlist:    splitAllowlist(*allowlist),
+		RateLimit:    *rateLimit,
+		IPRateLimit:  *ipRateLimit,
 		LocalBaseURL: *local,
 		LocalHost:    *localHost,
 		LocalPort:    *localPort,
+		PreserveHost: *preserveHost,
 	})
 
-	var allowlistValues []string
-	for _, value := range strings.Split(*allowlist, ",") {
-		trimmed := strings.TrimSpace(value)
-		if trimmed != "" {
-			allowlistValues = append(allowlistValues, trimmed)
-		}
-	}
-
-	if err := client.RegisterHTTP(ctx, *subdomain, allowlistValues); err != nil && !errors.Is(err, context.Canceled) {
-		log.Fatalf("http tunnel registration failed: %v", err)
-	}
+	serve(ctx, client)
 }
 
 func runTCP(args []string) {
 	fs := flag.NewFlagSet("tcp", flag.ExitOnError)
 	url := fs.String("url", getenv("PORTOPENER_RELAY_URL", "ws://localhost/relay"), "relay websocket url")
-	token := fs.String("token", getenv("PORTOPENER_RELAY_TOKEN", getenv("PORTOPENER_ADMIN_TOKEN", "")), "relay token")
+	token := fs.String("token", getenv("PORTOPENER_RELAY_TOKEN", ""), "relay token")
 	externalPort := fs.Int("external-port", getenvInt("PORTOPENER_EXTERNAL_PORT", 0), "external TCP port to reserve")
-	clientID := fs.String("client-id", "", "client id (uuid if empty)")
+	allowlist := fs.String("allow", "", "comma-separated allowlist CIDRs")
+	rateLimit := fs.Float64("rate-limit", 0, "max new connections per second for the whole tunnel (0 is unlimited)")
+	ipRateLimit := fs.Float64("ip-rate-limit", 0, "max new connections per second from each remote IP (0 is unlimited)")
+	clientID := fs.String("client-id", "", "client id (stable per machine if empty)")
 	localHost := fs.String("local-host", getenv("PORTOPENER_LOCAL_HOST", "localhost"), "local host to dial")
 	localPort := fs.Int("local-port", getenvInt("PORTOPENER_LOCAL_PORT", 8081), "local port to dial")
 	fs.Parse(args)
@@ -150,26 +155,35 @@ func runTCP(args []string) {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	resolvedClientID := resolveClientID(*clientID)
 	client := relayclient.New(relayclient.Config{
-		URL:       *url,
-		Token:     resolvedToken,
-		ClientID:  *clientID,
-		LocalHost: *localHost,
-		LocalPort: *localPort,
+		URL:      *url,
+		Token:    resolvedToken,
+		ClientID: resolvedClientID,
+	})
+	client.AddTunnel(relayclient.Tunnel{
+		ID:           oneShotTunnelID(resolvedClientID, "tcp", strconv.Itoa(*externalPort)),
+		Protocol:     "tcp",
+		ExternalPort: *externalPort,
+		Allowlist:    splitAllowlist(*allowlist),
+		RateLimit:    *rateLimit,
+		IPRateLimit:  *ipRateLimit,
+		LocalHost:    *localHost,
+		LocalPort:    *localPort,
 	})
-	client.AddStreamHandler("tcp", client.HandleTCPStream)
 
-	if err := client.RegisterTCP(ctx, *externalPort); err != nil && !errors.Is(err, context.Canceled) {
-		log.Fatalf("tcp tunnel registration failed: %v", err)
-	}
+	serve(ctx, client)
 }
 
 func runUDP(args []string) {
 	fs := flag.NewFlagSet("udp", flag.ExitOnError)
 	url := fs.String("url", getenv("PORTOPENER_RELAY_URL", "ws://localhost/relay"), "relay websocket url")
-	token := fs.String("token", getenv("PORTOPENER_RELAY_TOKEN", getenv("PORTOPENER_ADMIN_TOKEN", "")), "relay token")
+	token := fs.String("token", getenv("PORTOPENER_RELAY_TOKEN", ""), "relay token")
 	externalPort := fs.Int("external-port", getenvInt("PORTOPENER_EXTERNAL_PORT", 0), "external UDP port to reserve")
-	clientID := fs.String("client-id", "", "client id (uuid if empty)")
+	allowlist := fs.String("allow", "", "comma-separated allowlist CIDRs")
+	rateLimit := fs.Float64("rate-limit", 0, "max datagrams per second for the whole tunnel (0 is unlimited)")
+	ipRateLimit := fs.Float64("ip-rate-limit", 0, "max datagrams per second from each remote IP (0 is unlimited)")
+	clientID := fs.String("client-id", "", "client id (stable per machine if empty)")
 	localHost := fs.String("local-host", getenv("PORTOPENER_LOCAL_HOST", "localhost"), "local host to dial")
 	localPort := fs.Int("local-port", getenvInt("PORTOPENER_LOCAL_PORT", 8081), "local port to dial")
 	fs.Parse(args)
@@ -185,18 +199,24 @@ func runUDP(args []string) {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	resolvedClientID := resolveClientID(*clientID)
 	client := relayclient.New(relayclient.Config{
-		URL:       *url,
-		Token:     resolvedToken,
-		ClientID:  *clientID,
-		LocalHost: *localHost,
-		LocalPort: *localPort,
+		URL:      *url,
+		Token:    resolvedToken,
+		ClientID: resolvedClientID,
+	})
+	client.AddTunnel(relayclient.Tunnel{
+		ID:           oneShotTunnelID(resolvedClientID, "udp", strconv.Itoa(*externalPort)),
+		Protocol:     "udp",
+		ExternalPort: *externalPort,
+		Allowlist:    splitAllowlist(*allowlist),
+		RateLimit:    *rateLimit,
+		IPRateLimit:  *ipRateLimit,
+		LocalHost:    *localHost,
+		LocalPort:    *localPort,
 	})
-	client.AddStreamHandler("udp", client.HandleUDPStream)
 
-	if err := client.RegisterUDP(ctx, *externalPort); err != nil && !errors.Is(err, context.Canceled) {
-		log.Fatalf("udp tunnel registration failed: %v", err)
-	}
+	serve(ctx, client)
 }
 
 func runStart(args []string) {
@@ -212,6 +232,11 @@ func runStart(args []string) {
 	if err != nil {
 		log.Fatalf("config load failed: %v", err)
 	}
+	if loaded.AssignIDs() {
+		if err := config.Save(path, loaded); err != nil {
+			log.Printf("config save failed, tunnel ids will change on restart: %v", err)
+		}
+	}
 	if strings.TrimSpace(loaded.Token) == "" {
 		loaded.Token = resolveToken("")
 	}
@@ -223,18 +248,7 @@ func runStart(args []string) {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	var wg sync.WaitGroup
-	for _, tunnel := range loaded.Tunnels {
-		t := tunnel
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			runTunnelLoop(ctx, loaded, t)
-		}()
-	}
-
-	<-ctx.Done()
-	wg.Wait()
+	runSessionLoop(ctx, loaded)
 }
 
 func runDaemon(args []string) {
@@ -296,6 +310,9 @@ func runDaemonStatus(args []string) {
 	}
 	if running {
 		log.Printf("daemon running (%s)", message)
+		if state, err := daemon.ReadState(); err == nil {
+			log.Printf("relay %s client_id=%s rtt=%.1fms (measured %s ago)", state.RelayURL, state.ClientID, state.RTTMillis, time.Since(state.UpdatedAt).Round(time.Second))
+		}
 	} else {
 		log.Printf("daemon not running")
 	}
@@ -346,62 +363,100 @@ func runInit(args []string) {
 	log.Printf("token saved to %s", path)
 }
 
+// splitAllowlist turns the --allow flag into CIDRs.
+func splitAllowlist(value string) []string {
+	var values []string
+	for _, part := range strings.Split(value, ",") {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			values = append(values, trimmed)
+		}
+	}
+	return values
+}
+
 func printUsage() {
 	fmt.Println("portopener commands:")
 	fmt.Println("  relay --url ws://localhost/relay --token <token>")
-	fmt.Println("  http --subdomain <name> --local http://localhost:8081 [--allow <cidr1,cidr2>]")
-	fmt.Println("  tcp --external-port <port> --local-host localhost --local-port 8081")
-	fmt.Println("  udp --external-port <port> --local-host localhost --local-port 8081")
+	fmt.Println("  http --subdomain <name> --local http://localhost:8081 [--allow <cidr1,cidr2>] [--rate-limit <n>] [--ip-rate-limit <n>] [--preserve-host]")
+	fmt.Println("  tcp --external-port <port> --local-host localhost --local-port 8081 [--allow <cidr1,cidr2>] [--rate-limit <n>] [--ip-rate-limit <n>]")
+	fmt.Println("  udp --external-port <port> --local-host localhost --local-port 8081 [--allow <cidr1,cidr2>] [--rate-limit <n>] [--ip-rate-limit <n>]")
 	fmt.Println("  start --config /path/to/config.json")
 	fmt.Println("  daemon start|stop|status [--config /path/to/config.json]")
 	fmt.Println("  init <token> [--url ws://localhost/relay] [--config /path/to/config.json]")
 }
 
-func runTunnelLoop(ctx context.Context, cfg config.Config, tunnel config.Tunnel) {
-	backoff := 2 * time.Second
-	maxBackoff := 30 * time.Second
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		client := relayclient.New(relayclient.Config{
-			URL:          cfg.RelayURL,
-			Token:        cfg.Token,
+func runSessionLoop(ctx context.Context, cfg config.Config) {
+	var client *relayclient.Client
+	client = relayclient.New(relayclient.Config{
+		URL:      cfg.RelayURL,
+		Token:    cfg.Token,
+		ClientID: cfg.ClientID,
+		OnRTT: func(rtt time.Duration) {
+			_ = daemon.WriteState(daemon.State{
+				ClientID:  client.ClientID(),
+				RelayURL:  cfg.RelayURL,
+				RTTMillis: float64(rtt) / float64(time.Millisecond),
+				UpdatedAt: time.Now().UTC(),
+			})
+		},
+	})
+	for _, tunnel := range cfg.Tunnels {
+		client.AddTunnel(relayclient.Tunnel{
+			ID:           tunnel.ID,
+			Name:         tunnel.Name,
+			Protocol:     tunnel.Protocol,
+			Subdomain:    tunnel.Subdomain,
+			Allowlist:    tunnel.Allowlist,
+			RateLimit:    tunnel.RateLimit,
+			RateBurst:    tunnel.RateBurst,
+			IPRateLimit:  tunnel.IPRateLimit,
+			IPRateBurst:  tunnel.IPRateBurst,
+			ExternalPort: tunnel.ExternalPort,
 			LocalBaseURL: tunnel.LocalURL,
 			LocalHost:    tunnel.LocalHost,
 			LocalPort:    tunnel.LocalPort,
+			PreserveHost: tunnel.PreserveHost,
 		})
-		var err error
-		switch strings.ToLower(strings.TrimSpace(tunnel.Protocol)) {
-		case "http":
-			err = client.RegisterHTTP(ctx, tunnel.Subdomain, tunnel.Allowlist)
-		case "tcp":
-			client.AddStreamHandler("tcp", client.HandleTCPStream)
-			err = client.RegisterTCP(ctx, tunnel.ExternalPort)
-		case "udp":
-			err = client.RegisterUDP(ctx, tunnel.ExternalPort)
-		default:
-			log.Printf("unknown protocol %q", tunnel.Protocol)
-			return
-		}
-		if err == nil || errors.Is(err, context.Canceled) {
-			return
-		}
-		log.Printf("tunnel %s disconnected: %v", tunnel.Name, err)
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(backoff):
-			if backoff < maxBackoff {
-				backoff *= 2
-				if backoff > maxBackoff {
-					backoff = maxBackoff
-				}
-			}
-		}
 	}
+
+	serve(ctx, client)
+}
+
+// serve keeps client connected until ctx is done, exiting with an error when
+// the relay rejects the tunnels for good.
+func serve(ctx context.Context, client *relayclient.Client) {
+	err := client.Serve(ctx)
+	if err == nil {
+		return
+	}
+	if errors.Is(err, relayclient.ErrTunnelsClosed) {
+		log.Printf("relay session ended: %v", err)
+		return
+	}
+	log.Fatalf("relay session stopped: %v", err)
+}
+
+// resolveClientID returns the --client-id flag or, when it is empty, this
+// machine's persisted client ID.
+func resolveClientID(flagValue string) string {
+	if trimmed := strings.TrimSpace(flagValue); trimmed != "" {
+		return trimmed
+	}
+	id, err := config.DefaultClientID()
+	if err != nil {
+		log.Printf("client id unavailable, using a random one: %v", err)
+		return ""
+	}
+	return id
+}
+
+// oneShotTunnelID derives a tunnel ID from the client and what the tunnel
+// exposes, so running the same command again resumes the same tunnel.
+func oneShotTunnelID(clientID, protocol, target string) string {
+	if clientID == "" {
+		return ""
+	}
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("portopener:"+clientID+":"+protocol+":"+strings.ToLower(target))).String()
 }
 
 func resolveToken(token string) string {
@@ -7,24 +7,35 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/google/uuid"
 )
 
 type Config struct {
 	RelayURL   string   `json:"relay_url"`
 	Token      string   `json:"token"`
+	ClientID   string   `json:"client_id,omitempty"`
 	PublicBase string   `json:"public_base,omitempty"`
 	Tunnels    []Tunnel `json:"tunnels"`
 }
 
 type Tunnel struct {
+	// ID identifies the tunnel to the relay across reconnects and restarts.
+	// It is generated on first start and saved back to the config file.
+	ID           string   `json:"id,omitempty"`
 	Name         string   `json:"name"`
 	Protocol     string   `json:"protocol"`
 	Subdomain    string   `json:"subdomain,omitempty"`
 	Allowlist    []string `json:"allowlist,omitempty"`
+	RateLimit    float64  `json:"rate_limit,omitempty"`
+	RateBurst    int      `json:"rate_burst,omitempty"`
+	IPRateLimit  float64  `json:"ip_rate_limit,omitempty"`
+	IPRateBurst  int      `json:"ip_rate_burst,omitempty"`
 	ExternalPort int      `json:"external_port,omitempty"`
 	LocalURL     string   `json:"local_url,omitempty"`
 	LocalHost    string   `json:"local_host,omitempty"`
 	LocalPort    int      `json:"local_port,omitempty"`
+	PreserveHost bool     `json:"preserve_host,omitempty"`
 }
 
 func Load(path string) (Config, error) {
@@ -42,6 +53,41 @@ func Load(path string) (Config, error) {
 	return cfg, nil
 }
 
+// AssignIDs fills in a missing client ID and tunnel IDs, reporting whether
+// anything changed and the config should be saved.
+func (c *Config) AssignIDs() bool {
+	changed := false
+	if strings.TrimSpace(c.ClientID) == "" {
+		c.ClientID = uuid.NewString()
+		changed = true
+	}
+	for idx := range c.Tunnels {
+		if strings.TrimSpace(c.Tunnels[idx].ID) == "" {
+			c.Tunnels[idx].ID = uuid.NewString()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// DefaultClientID returns this machine's client ID, creating it on first use.
+// Commands that run without a config file use it to keep tunnel IDs stable.
+func DefaultClientID() (string, error) {
+	path := filepath.Join(filepath.Dir(DefaultPath()), "client_id")
+	contents, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(contents)) != "" {
+		return strings.TrimSpace(string(contents)), nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	id := uuid.NewString()
+	return id, os.WriteFile(path, []byte(id+"\n"), 0o600)
+}
+
 func DefaultPath() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -1,6 +1,7 @@
 package daemon
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AidyyJ/PortOpener/cli/internal/config"
 )
@@ -21,6 +23,46 @@ func PIDPath() string {
 	return filepath.Join(home, ".portopener", "daemon.pid")
 }
 
+// State is what a running session reports for `daemon status`.
+type State struct {
+	ClientID  string    `json:"client_id"`
+	RelayURL  string    `json:"relay_url"`
+	RTTMillis float64   `json:"rtt_ms"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func StatePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "portopener.state.json"
+	}
+	return filepath.Join(home, ".portopener", "daemon.state.json")
+}
+
+func WriteState(state State) error {
+	path := StatePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+func ReadState() (State, error) {
+	data, err := os.ReadFile(StatePath())
+	if err != nil {
+		return State{}, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return State{}, err
+	}
+	return state, nil
+}
+
 func Start(configPath string) (int, error) {
 	exe, err := os.Executable()
 	if err != nil {
@@ -55,6 +97,7 @@ func Stop() error {
 		return err
 	}
 	_ = os.Remove(PIDPath())
+	_ = os.Remove(StatePath())
 	return nil
 }
 
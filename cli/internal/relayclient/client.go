@@ -1,14 +1,16 @@
 package relayclient
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AidyyJ/PortOpener/internal/httpbridge"
@@ -18,25 +20,52 @@ import (
 	"github.com/hashicorp/yamux"
 )
 
+// ErrTunnelsClosed is returned by Run once the relay has closed every tunnel
+// the client carries. Reconnecting would not bring them back.
+var ErrTunnelsClosed = errors.New("all tunnels closed by relay")
+
 type Config struct {
 	URL             string
 	Token           string
 	ClientID        string
 	HeartbeatPeriod time.Duration
-	LocalBaseURL    string
-	LocalHost       string
-	LocalPort       int
+	// OnRTT, when set, is called with every round-trip time measured
+	// against the relay.
+	OnRTT func(time.Duration)
+}
+
+// Tunnel describes a single tunnel carried over the client's relay session.
+type Tunnel struct {
+	ID           string
+	Name         string
+	Protocol     string
+	Subdomain    string
+	Allowlist    []string
+	RateLimit    float64
+	RateBurst    int
+	IPRateLimit  float64
+	IPRateBurst  int
+	ExternalPort int
+	LocalBaseURL string
+	LocalHost    string
+	LocalPort    int
+	PreserveHost bool
 }
 
 type Client struct {
-	url            string
-	token          string
-	clientID       string
-	heartbeat      time.Duration
-	localBase      string
-	localHost      string
-	localPort      int
-	streamHandlers map[string]func(ctx context.Context, stream *yamux.Stream)
+	url       string
+	token     string
+	clientID  string
+	heartbeat time.Duration
+	onRTT     func(time.Duration)
+	rtt       atomic.Int64
+	// up is set once a Run has registered its tunnels, so Serve can tell a
+	// dropped session from a failed connection attempt.
+	up atomic.Bool
+
+	mu      sync.RWMutex
+	tunnels map[string]Tunnel
+	order   []string
 }
 
 func New(cfg Config) *Client {
@@ -49,27 +78,105 @@ func New(cfg Config) *Client {
 		period = 10 * time.Second
 	}
 	return &Client{
-		url:            cfg.URL,
-		token:          cfg.Token,
-		clientID:       clientID,
-		heartbeat:      period,
-		localBase:      strings.TrimRight(cfg.LocalBaseURL, "/"),
-		localHost:      strings.TrimSpace(cfg.LocalHost),
-		localPort:      cfg.LocalPort,
-		streamHandlers: make(map[string]func(ctx context.Context, stream *yamux.Stream)),
+		url:       cfg.URL,
+		token:     cfg.Token,
+		clientID:  clientID,
+		heartbeat: period,
+		onRTT:     cfg.OnRTT,
+		tunnels:   make(map[string]Tunnel),
 	}
 }
 
-func (c *Client) AddStreamHandler(protocol string, handler func(ctx context.Context, stream *yamux.Stream)) {
-	if strings.TrimSpace(protocol) == "" || handler == nil {
-		return
+// ClientID returns the id the client announces to the relay.
+func (c *Client) ClientID() string {
+	return c.clientID
+}
+
+// RTT returns the last round-trip time measured against the relay, or zero
+// before the first pong.
+func (c *Client) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// controlConn wraps the control stream once registration is done: pings,
+// pongs and the heartbeat ticker write to it concurrently.
+type controlConn struct {
+	stream   io.ReadWriter
+	mu       sync.Mutex
+	lastSeen atomic.Int64
+}
+
+func (c *controlConn) send(msg relay.ControlMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return relay.WriteJSON(c.stream, msg)
+}
+
+func (c *controlConn) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (c *controlConn) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastSeen.Load()))
+}
+
+// AddTunnel queues a tunnel for registration on the next Run. A tunnel ID is
+// generated when none is supplied.
+func (c *Client) AddTunnel(tunnel Tunnel) Tunnel {
+	if tunnel.ID == "" {
+		tunnel.ID = uuid.NewString()
 	}
-	if c.streamHandlers == nil {
-		c.streamHandlers = make(map[string]func(ctx context.Context, stream *yamux.Stream))
+	tunnel.Protocol = strings.ToLower(strings.TrimSpace(tunnel.Protocol))
+	tunnel.LocalBaseURL = strings.TrimRight(tunnel.LocalBaseURL, "/")
+	tunnel.LocalHost = strings.TrimSpace(tunnel.LocalHost)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.tunnels[tunnel.ID]; !exists {
+		c.order = append(c.order, tunnel.ID)
+	}
+	c.tunnels[tunnel.ID] = tunnel
+	return tunnel
+}
+
+func (c *Client) lookupTunnel(tunnelID string) (Tunnel, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tunnel, ok := c.tunnels[tunnelID]
+	return tunnel, ok
+}
+
+// removeTunnel drops a tunnel so later runs no longer register it, and
+// reports how many tunnels remain.
+func (c *Client) removeTunnel(tunnelID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.tunnels[tunnelID]; ok {
+		delete(c.tunnels, tunnelID)
+		for i, id := range c.order {
+			if id == tunnelID {
+				c.order = append(c.order[:i], c.order[i+1:]...)
+				break
+			}
+		}
 	}
-	c.streamHandlers[strings.ToLower(strings.TrimSpace(protocol))] = handler
+	return len(c.order)
 }
 
+func (c *Client) listTunnels() []Tunnel {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tunnels := make([]Tunnel, 0, len(c.order))
+	for _, id := range c.order {
+		tunnels = append(tunnels, c.tunnels[id])
+	}
+	return tunnels
+}
+
+// Run opens one relay session, registers every queued tunnel on its control
+// stream and serves inbound streams until the session ends. Tunnels the relay
+// closes are dropped from the client, so a later Run does not register them
+// again.
 func (c *Client) Run(ctx context.Context) error {
 	conn, _, err := websocket.Dial(ctx, c.url, &websocket.DialOptions{Subprotocols: []string{"binary"}})
 	if err != nil {
@@ -99,7 +206,7 @@ func (c *Client) Run(ctx context.Context) error {
 		return err
 	}
 	if response.Type == "error" {
-		return errors.New(response.Message)
+		return &RelayError{Code: response.ErrorCode, Message: response.Message}
 	}
 	if response.Type != "hello_ok" {
 		return errors.New("unexpected relay response")
@@ -107,6 +214,54 @@ func (c *Client) Run(ctx context.Context) error {
 
 	log.Printf("relay connected client_id=%s", c.clientID)
 
+	// Tunnels rejected for good are dropped so reconnects do not retry them.
+	// A retryable failure ends the session even when other tunnels
+	// registered: Serve then reconnects and registers the full set again,
+	// and the relay's reconnect grace keeps the others' routes meanwhile.
+	tunnels := c.listTunnels()
+	var registered int
+	var retryErr, permanentErr error
+	for _, tunnel := range tunnels {
+		if err := c.register(control, tunnel); err != nil {
+			log.Printf("tunnel %s registration failed: %v", tunnelLabel(tunnel), err)
+			if IsPermanent(err) {
+				c.removeTunnel(tunnel.ID)
+				if permanentErr == nil {
+					permanentErr = err
+				}
+			} else if retryErr == nil {
+				retryErr = err
+			}
+			continue
+		}
+		registered++
+		log.Printf("tunnel %s registered protocol=%s", tunnelLabel(tunnel), tunnel.Protocol)
+	}
+	if retryErr != nil {
+		return retryErr
+	}
+	if len(tunnels) > 0 && registered == 0 {
+		return permanentErr
+	}
+	c.setConnected(registered)
+
+	errCh := make(chan error, 2)
+	go func() {
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go c.handleStream(ctx, stream)
+		}
+	}()
+	out := &controlConn{stream: control}
+	out.touch()
+	go func() {
+		errCh <- c.readControl(out)
+	}()
+
 	ticker := time.NewTicker(c.heartbeat)
 	defer ticker.Stop()
 
@@ -114,132 +269,231 @@ func (c *Client) Run(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case err := <-errCh:
+			return err
 		case t := <-ticker.C:
-			if err := relay.WriteJSON(control, relay.ControlMessage{Type: "heartbeat", Timestamp: t.UTC().Format(time.RFC3339)}); err != nil {
+			// The relay pings every few seconds; silence this long means the
+			// session is dead even if the connection has not noticed.
+			if out.idle() > 3*c.heartbeat {
+				return errors.New("relay heartbeat timeout")
+			}
+			if err := out.send(relay.ControlMessage{Type: "ping", Timestamp: t.UTC().Format(time.RFC3339Nano)}); err != nil {
 				return err
 			}
 		}
 	}
 }
 
-func (c *Client) RegisterHTTP(ctx context.Context, subdomain string, allowlist []string) error {
-	conn, _, err := websocket.Dial(ctx, c.url, &websocket.DialOptions{Subprotocols: []string{"binary"}})
-	if err != nil {
-		return err
-	}
-	defer conn.Close(websocket.StatusNormalClosure, "bye")
-
-	wsConn := websocket.NetConn(ctx, conn, websocket.MessageBinary)
-	session, err := yamux.Client(wsConn, nil)
-	if err != nil {
-		return err
-	}
-	defer session.Close()
-
-	control, err := session.OpenStream()
-	if err != nil {
-		return err
+// readControl handles messages the relay sends on the control stream after
+// registration.
+func (c *Client) readControl(conn *controlConn) error {
+	for {
+		var msg relay.ControlMessage
+		if err := relay.ReadJSON(conn.stream, &msg); err != nil {
+			return err
+		}
+		conn.touch()
+		switch msg.Type {
+		case "ping":
+			if err := conn.send(relay.ControlMessage{Type: "pong", Timestamp: msg.Timestamp}); err != nil {
+				return err
+			}
+		case "pong":
+			sent, err := time.Parse(time.RFC3339Nano, msg.Timestamp)
+			if err != nil {
+				continue
+			}
+			rtt := time.Since(sent)
+			c.rtt.Store(int64(rtt))
+			if c.onRTT != nil {
+				c.onRTT(rtt)
+			}
+		case "tunnel_closed":
+			tunnel, ok := c.lookupTunnel(msg.TunnelID)
+			if !ok {
+				continue
+			}
+			log.Printf("tunnel %s closed by relay: %s", tunnelLabel(tunnel), msg.Message)
+			if c.removeTunnel(msg.TunnelID) == 0 {
+				return ErrTunnelsClosed
+			}
+		}
 	}
-	defer control.Close()
+}
 
-	if err := relay.WriteJSON(control, relay.ControlMessage{Type: "hello", Token: c.token, ClientID: c.clientID, Version: "dev", TunnelID: uuid.NewString(), Protocol: "http", Subdomain: subdomain, Allowlist: allowlist, LocalHost: c.localHost, LocalPort: c.localPort}); err != nil {
+func (c *Client) register(control io.ReadWriter, tunnel Tunnel) error {
+	switch tunnel.Protocol {
+	case "http":
+		if tunnel.LocalBaseURL == "" {
+			return fmt.Errorf("%w: local base url required", ErrInvalidTunnel)
+		}
+	case "tcp", "udp":
+		if tunnel.ExternalPort == 0 {
+			return fmt.Errorf("%w: external port required", ErrInvalidTunnel)
+		}
+	default:
+		return fmt.Errorf("%w: unknown protocol %q", ErrInvalidTunnel, tunnel.Protocol)
+	}
+
+	if err := relay.WriteJSON(control, relay.ControlMessage{
+		Type:         "register_tunnel",
+		TunnelID:     tunnel.ID,
+		Name:         tunnel.Name,
+		Protocol:     tunnel.Protocol,
+		Subdomain:    tunnel.Subdomain,
+		Allowlist:    tunnel.Allowlist,
+		RateLimit:    tunnel.RateLimit,
+		RateBurst:    tunnel.RateBurst,
+		IPRateLimit:  tunnel.IPRateLimit,
+		IPRateBurst:  tunnel.IPRateBurst,
+		ExternalPort: tunnel.ExternalPort,
+		LocalHost:    tunnel.LocalHost,
+		LocalPort:    tunnel.LocalPort,
+	}); err != nil {
 		return err
 	}
 
+	// The relay's watchdog may ping before the reply arrives; answer it so
+	// the session stays up and keep waiting.
 	var response relay.ControlMessage
-	if err := relay.ReadJSON(control, &response); err != nil {
-		return err
+	for {
+		if err := relay.ReadJSON(control, &response); err != nil {
+			return err
+		}
+		if response.Type == "ping" {
+			if err := relay.WriteJSON(control, relay.ControlMessage{Type: "pong", Timestamp: response.Timestamp}); err != nil {
+				return err
+			}
+			continue
+		}
+		if response.Type != "pong" {
+			break
+		}
 	}
 	if response.Type == "error" {
-		return errors.New(response.Message)
+		return &RelayError{Code: response.ErrorCode, Message: response.Message}
 	}
-	if response.Type != "hello_ok" {
+	if response.Type != "register_ok" || response.TunnelID != tunnel.ID {
 		return errors.New("unexpected relay response")
 	}
+	return nil
+}
 
-	if c.localBase == "" {
-		return errors.New("local base url required")
+func (c *Client) handleStream(ctx context.Context, stream *yamux.Stream) {
+	var header relay.ControlMessage
+	if err := relay.ReadJSON(stream, &header); err != nil || header.Type != "stream_open" {
+		_ = stream.Close()
+		return
 	}
+	tunnel, ok := c.lookupTunnel(header.TunnelID)
+	if !ok {
+		_ = stream.Close()
+		return
+	}
+	switch tunnel.Protocol {
+	case "http":
+		c.handleHTTPStream(ctx, stream, tunnel)
+	case "tcp":
+		c.handleTCPStream(ctx, stream, tunnel)
+	case "udp":
+		c.handleUDPStream(ctx, stream, tunnel)
+	default:
+		_ = stream.Close()
+	}
+}
 
-	errCh := make(chan error, 1)
-	go func() {
-		for {
-			stream, err := session.AcceptStream()
-			if err != nil {
-				errCh <- err
-				return
-			}
-			handler := c.streamHandlers[strings.ToLower(strings.TrimSpace("http"))]
-			if handler == nil {
-				handler = c.handleHTTPStream
-			}
-			go handler(ctx, stream)
-		}
-	}()
-
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-errCh:
-		return err
+func tunnelLabel(tunnel Tunnel) string {
+	if tunnel.Name != "" {
+		return tunnel.Name
+	}
+	switch tunnel.Protocol {
+	case "http":
+		return tunnel.Subdomain
+	case "tcp", "udp":
+		return fmt.Sprintf("%s:%d", tunnel.Protocol, tunnel.ExternalPort)
+	default:
+		return tunnel.ID
 	}
 }
 
-func (c *Client) handleHTTPStream(ctx context.Context, stream *yamux.Stream) {
+func (c *Client) handleHTTPStream(ctx context.Context, stream *yamux.Stream, tunnel Tunnel) {
 	defer stream.Close()
 
 	var req relay.HTTPRequest
 	if err := relay.ReadJSON(stream, &req); err != nil {
 		return
 	}
-	body, err := relay.ReadFrame(stream)
-	if err != nil {
-		return
-	}
 
 	if req.IsWebSocket {
-		c.handleWebSocketStream(ctx, stream, req)
+		c.handleWebSocketStream(ctx, stream, tunnel, req)
 		return
 	}
 
-	respFrame, respBody := c.forwardHTTPRequest(ctx, req, body)
-	_ = relay.WriteJSON(stream, respFrame)
-	_ = relay.WriteFrame(stream, respBody)
+	c.forwardHTTPRequest(ctx, stream, tunnel, req)
 }
 
-func (c *Client) forwardHTTPRequest(ctx context.Context, req relay.HTTPRequest, body []byte) (relay.HTTPResponse, []byte) {
-	base, err := url.Parse(c.localBase)
+// forwardHTTPRequest replays a relayed request against the local service,
+// streaming the request body from the relay and the response body back to it.
+func (c *Client) forwardHTTPRequest(ctx context.Context, stream io.ReadWriter, tunnel Tunnel, req relay.HTTPRequest) {
+	body := relay.NewFrameReader(stream)
+
+	base, err := url.Parse(tunnel.LocalBaseURL)
 	if err != nil {
-		return relay.HTTPResponse{Status: http.StatusBadGateway}, []byte("invalid local base url")
+		writeHTTPError(stream, body, http.StatusBadGateway, "invalid local base url")
+		return
 	}
 
 	rel, err := url.Parse(req.Path)
 	if err != nil {
-		return relay.HTTPResponse{Status: http.StatusBadRequest}, []byte("invalid request path")
+		writeHTTPError(stream, body, http.StatusBadRequest, "invalid request path")
+		return
 	}
 
 	target := base.ResolveReference(rel)
-	request, err := http.NewRequestWithContext(ctx, req.Method, target.String(), bytes.NewReader(body))
+	request, err := http.NewRequestWithContext(ctx, req.Method, target.String(), nil)
 	if err != nil {
-		return relay.HTTPResponse{Status: http.StatusBadRequest}, []byte("invalid request")
+		writeHTTPError(stream, body, http.StatusBadRequest, "invalid request")
+		return
 	}
 	request.Header = req.Header.Clone()
+	httpbridge.SetForwardedHeaders(request.Header, req)
 	request.Host = base.Host
+	if tunnel.PreserveHost && req.Host != "" {
+		request.Host = req.Host
+	}
+	if err := httpbridge.SetRequestBody(request, req.ContentLength, body); err != nil {
+		return
+	}
 
+	started := time.Now()
 	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
-		return relay.HTTPResponse{Status: http.StatusBadGateway}, []byte("upstream error")
+		writeHTTPError(stream, body, http.StatusBadGateway, "upstream error")
+		return
 	}
+	defer resp.Body.Close()
 
-	respFrame, respBody, err := httpbridge.EncodeResponse(resp)
-	if err != nil {
-		return relay.HTTPResponse{Status: http.StatusBadGateway}, []byte("read response failed")
+	frame := httpbridge.EncodeResponse(resp)
+	frame.UpstreamMillis = float64(time.Since(started)) / float64(time.Millisecond)
+	if err := relay.WriteJSON(stream, frame); err != nil {
+		return
 	}
-	return respFrame, respBody
+	_, _ = httpbridge.WriteBody(stream, resp.Body)
 }
 
-func (c *Client) handleWebSocketStream(ctx context.Context, stream *yamux.Stream, req relay.HTTPRequest) {
-	wsURL := c.localBase
+// writeHTTPError answers a relayed request that never reached the local
+// service. Any unread request body is drained first so the relay is not left
+// blocked writing it.
+func writeHTTPError(stream io.Writer, body io.Reader, status int, message string) {
+	_, _ = io.Copy(io.Discard, body)
+	if err := relay.WriteJSON(stream, relay.HTTPResponse{Status: status}); err != nil {
+		return
+	}
+	_, _ = httpbridge.WriteBody(stream, strings.NewReader(message))
+}
+
+func (c *Client) handleWebSocketStream(ctx context.Context, stream *yamux.Stream, tunnel Tunnel, req relay.HTTPRequest) {
+	wsURL := tunnel.LocalBaseURL
 	if strings.HasPrefix(wsURL, "http://") {
 		wsURL = "ws://" + strings.TrimPrefix(wsURL, "http://")
 	} else if strings.HasPrefix(wsURL, "https://") {
@@ -247,7 +501,13 @@ func (c *Client) handleWebSocketStream(ctx context.Context, stream *yamux.Stream
 	}
 	wsURL = strings.TrimRight(wsURL, "/") + req.Path
 
-	conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{HTTPHeader: req.Header})
+	header := req.Header.Clone()
+	httpbridge.SetForwardedHeaders(header, req)
+	dialOptions := &websocket.DialOptions{HTTPHeader: header}
+	if tunnel.PreserveHost && req.Host != "" {
+		dialOptions.Host = req.Host
+	}
+	conn, _, err := websocket.Dial(ctx, wsURL, dialOptions)
 	if err != nil {
 		_ = relay.WriteJSON(stream, relay.HTTPResponse{Status: http.StatusBadGateway})
 		return
@@ -0,0 +1,43 @@
+package relayclient
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/AidyyJ/PortOpener/internal/relay"
+)
+
+// scriptedControl replays relay messages and records what the client sends.
+type scriptedControl struct {
+	replies bytes.Buffer
+	sent    bytes.Buffer
+}
+
+func (s *scriptedControl) Read(p []byte) (int, error)  { return s.replies.Read(p) }
+func (s *scriptedControl) Write(p []byte) (int, error) { return s.sent.Write(p) }
+
+func TestRegisterAnswersPingsWhileWaiting(t *testing.T) {
+	control := &scriptedControl{}
+	for _, msg := range []relay.ControlMessage{
+		{Type: "ping", Timestamp: "t1"},
+		{Type: "pong", Timestamp: "t0"},
+		{Type: "register_ok", TunnelID: "t-web"},
+	} {
+		if err := relay.WriteJSON(&control.replies, msg); err != nil {
+			t.Fatalf("script reply failed: %v", err)
+		}
+	}
+
+	client := &Client{}
+	if err := client.register(control, Tunnel{ID: "t-web", Protocol: "http", LocalBaseURL: "http://localhost:3000"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	var register, pong relay.ControlMessage
+	if err := relay.ReadJSON(&control.sent, &register); err != nil || register.Type != "register_tunnel" {
+		t.Fatalf("expected register_tunnel first, got %+v err=%v", register, err)
+	}
+	if err := relay.ReadJSON(&control.sent, &pong); err != nil || pong.Type != "pong" || pong.Timestamp != "t1" {
+		t.Fatalf("expected pong echoing the ping, got %+v err=%v", pong, err)
+	}
+}
@@ -0,0 +1,106 @@
+package relayclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Reconnect backoff bounds. Each delay is jittered so many clients dropped by
+// the same relay restart do not reconnect in lockstep.
+const (
+	minBackoff = 2 * time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// ErrInvalidTunnel marks a tunnel the client cannot register as configured.
+var ErrInvalidTunnel = errors.New("invalid tunnel")
+
+// RelayError is an error reported by the relay on the control stream.
+type RelayError struct {
+	Code    string
+	Message string
+}
+
+func (e *RelayError) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// IsPermanent reports whether err will recur on every reconnect: a rejected
+// token, a subdomain or port reserved by someone else, a tunnel outside the
+// token's scope, an invalid tunnel, or every tunnel closed by the relay.
+// Anything else, such as network errors, is worth retrying.
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrTunnelsClosed) || errors.Is(err, ErrInvalidTunnel) {
+		return true
+	}
+	var relayErr *RelayError
+	if errors.As(err, &relayErr) {
+		switch relayErr.Code {
+		case "unauthorized", "reserved_by_other", "forbidden_scope", "tunnel_exists":
+			return true
+		}
+	}
+	return false
+}
+
+// Serve runs relay sessions until ctx is done or a permanent error occurs,
+// reconnecting after retryable failures with jittered exponential backoff.
+// A status line is logged on every state change. It returns nil when ctx is
+// cancelled and the permanent error otherwise.
+func (c *Client) Serve(ctx context.Context) error {
+	backoff := minBackoff
+	attempt := 0
+	for first := true; ; first = false {
+		if first {
+			log.Printf("status: connecting to %s", c.url)
+		} else {
+			attempt++
+			log.Printf("status: reconnecting to %s (attempt %d)", c.url, attempt)
+		}
+		c.up.Store(false)
+		err := c.Run(ctx)
+		if ctx.Err() != nil {
+			log.Printf("status: stopped")
+			return nil
+		}
+		if c.up.Load() {
+			backoff = minBackoff
+			attempt = 0
+		}
+		if IsPermanent(err) {
+			log.Printf("status: stopped: %v", err)
+			return err
+		}
+
+		delay := jitter(backoff)
+		log.Printf("status: disconnected: %v; retrying in %s", err, delay.Round(100*time.Millisecond))
+		select {
+		case <-ctx.Done():
+			log.Printf("status: stopped")
+			return nil
+		case <-time.After(delay):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c *Client) setConnected(tunnels int) {
+	c.up.Store(true)
+	log.Printf("status: connected to %s with %d tunnel(s)", c.url, tunnels)
+}
+
+// jitter picks a delay uniformly between half of d and d.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
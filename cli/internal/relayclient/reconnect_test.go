@@ -0,0 +1,41 @@
+package relayclient
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIsPermanent(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{ErrTunnelsClosed, true},
+		{fmt.Errorf("tunnel web: %w", ErrInvalidTunnel), true},
+		{&RelayError{Code: "unauthorized"}, true},
+		{&RelayError{Code: "reserved_by_other"}, true},
+		{&RelayError{Code: "forbidden_scope"}, true},
+		{fmt.Errorf("register: %w", &RelayError{Code: "tunnel_exists"}), true},
+		{&RelayError{Code: "registration_failed"}, false},
+		{&RelayError{Message: "no code"}, false},
+		{errors.New("connection reset"), false},
+	}
+	for _, tc := range cases {
+		if got := IsPermanent(tc.err); got != tc.want {
+			t.Errorf("IsPermanent(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestJitterStaysWithinHalfAndFull(t *testing.T) {
+	for _, d := range []time.Duration{minBackoff, 5 * time.Second, maxBackoff, time.Nanosecond} {
+		for i := 0; i < 200; i++ {
+			got := jitter(d)
+			if got < d/2 || got > d {
+				t.Fatalf("jitter(%s) = %s, want between %s and %s", d, got, d/2, d)
+			}
+		}
+	}
+}
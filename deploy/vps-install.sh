@@ -129,9 +129,9 @@ prompt_default INSTALL_DIR "Install directory" "/opt/portopener"
 prompt_required BASE_DOMAIN "Base domain (example.com)"
 prompt_required ACME_EMAIL "ACME email"
 prompt_secret CLOUDFLARE_API_TOKEN "Cloudflare API token"
-prompt_secret PORTOPENER_RELAY_TOKEN "Relay/admin token (openssl rand -base64 32)"
+prompt_secret PORTOPENER_RELAY_TOKEN "Relay token (openssl rand -base64 32)"
 prompt_required PORTOPENER_ADMIN_ALLOWLIST "Admin allowlist CIDRs (comma-separated)"
-prompt_optional_secret PORTOPENER_ADMIN_TOKEN "Admin token override"
+prompt_secret PORTOPENER_ADMIN_TOKEN "Admin API token (openssl rand -base64 32)"
 
 if [ -d "$INSTALL_DIR" ] && [ -n "$(ls -A "$INSTALL_DIR" 2>/dev/null)" ]; then
   if [ -d "$INSTALL_DIR/.git" ]; then
@@ -171,6 +171,7 @@ PORTOPENER_DB_PATH=/data/portopener.db
 PORTOPENER_MIGRATIONS_DIR=/app/migrations
 PORTOPENER_ADMIN_TOKEN=${PORTOPENER_ADMIN_TOKEN}
 PORTOPENER_ADMIN_ALLOWLIST=${PORTOPENER_ADMIN_ALLOWLIST}
+PORTOPENER_TRUSTED_PROXIES=172.16.0.0/12
 PORTOPENER_RELAY_TOKEN=${PORTOPENER_RELAY_TOKEN}
 CLOUDFLARE_API_TOKEN=${CLOUDFLARE_API_TOKEN}
 ACME_EMAIL=${ACME_EMAIL}
@@ -1,9 +1,9 @@
 package httpbridge
 
 import (
-	"bytes"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 
@@ -12,53 +12,138 @@ import (
 
 var ErrUnsupportedUpgrade = errors.New("websocket upgrade not supported yet")
 
-func EncodeRequest(r *http.Request) (relay.HTTPRequest, []byte, error) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return relay.HTTPRequest{}, nil, err
-	}
-	_ = r.Body.Close()
-
+// EncodeRequest builds the request header frame. The body is not read; send it
+// with WriteBody after the header.
+func EncodeRequest(r *http.Request) relay.HTTPRequest {
 	return relay.HTTPRequest{
-		Method:      r.Method,
-		Path:        r.URL.RequestURI(),
-		Host:        r.Host,
-		Header:      r.Header.Clone(),
-		RemoteAddr:  r.RemoteAddr,
-		IsWebSocket: isWebSocketRequest(r),
-	}, body, nil
+		Method:        r.Method,
+		Path:          r.URL.RequestURI(),
+		Host:          r.Host,
+		Scheme:        requestScheme(r),
+		Header:        r.Header.Clone(),
+		ContentLength: r.ContentLength,
+		RemoteAddr:    r.RemoteAddr,
+		IsWebSocket:   isWebSocketRequest(r),
+	}
 }
 
-func DecodeRequest(req relay.HTTPRequest, body []byte) (*http.Request, error) {
+// DecodeRequest rebuilds a request whose body is read from the frame sequence
+// that follows the header frame.
+func DecodeRequest(req relay.HTTPRequest, body io.Reader) (*http.Request, error) {
 	if req.IsWebSocket {
 		return nil, ErrUnsupportedUpgrade
 	}
 
-	reader := bytes.NewReader(body)
-	request, err := http.NewRequest(req.Method, req.Path, reader)
+	request, err := http.NewRequest(req.Method, req.Path, nil)
 	if err != nil {
 		return nil, err
 	}
 	request.Host = req.Host
 	request.Header = req.Header.Clone()
+	if err := SetRequestBody(request, req.ContentLength, body); err != nil {
+		return nil, err
+	}
 	return request, nil
 }
 
-func EncodeResponse(resp *http.Response) (relay.HTTPResponse, []byte, error) {
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return relay.HTTPResponse{}, nil, err
+// SetRequestBody attaches a streamed body to an outgoing request. Bodies that
+// are known to be empty are drained so the terminating frame is consumed and
+// the request is sent without a body.
+func SetRequestBody(request *http.Request, contentLength int64, body io.Reader) error {
+	if contentLength == 0 {
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return err
+		}
+		request.Body = http.NoBody
+		request.ContentLength = 0
+		return nil
 	}
-	_ = resp.Body.Close()
-	return relay.HTTPResponse{Status: resp.StatusCode, Header: resp.Header.Clone()}, body, nil
+	request.Body = io.NopCloser(body)
+	request.ContentLength = contentLength
+	return nil
 }
 
-func DecodeResponse(resp relay.HTTPResponse, body []byte) *http.Response {
+func EncodeResponse(resp *http.Response) relay.HTTPResponse {
+	return relay.HTTPResponse{Status: resp.StatusCode, Header: resp.Header.Clone()}
+}
+
+func DecodeResponse(resp relay.HTTPResponse, body io.Reader) *http.Response {
 	return &http.Response{
 		StatusCode: resp.Status,
 		Header:     resp.Header.Clone(),
-		Body:       io.NopCloser(bytes.NewReader(body)),
+		Body:       io.NopCloser(body),
+	}
+}
+
+// WriteBody pipes body to w as a sequence of frames terminated by the
+// zero-length frame, returning the number of body bytes sent.
+func WriteBody(w io.Writer, body io.Reader) (int64, error) {
+	fw := relay.NewFrameWriter(w)
+	var written int64
+	if body != nil {
+		n, err := io.Copy(fw, body)
+		written = n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, fw.Close()
+}
+
+// SetForwardedHeaders describes the original request to the local service
+// with X-Forwarded-For/-Host/-Proto and an RFC 7239 Forwarded header. The
+// relay has already resolved the client address, so any inbound values are
+// replaced rather than appended to.
+func SetForwardedHeaders(header http.Header, req relay.HTTPRequest) {
+	clientIP := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	scheme := req.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	var forwarded []string
+	if clientIP != "" {
+		header.Set("X-Forwarded-For", clientIP)
+		forwarded = append(forwarded, "for="+forwardedNode(clientIP))
+	} else {
+		header.Del("X-Forwarded-For")
+	}
+	if req.Host != "" {
+		header.Set("X-Forwarded-Host", req.Host)
+		forwarded = append(forwarded, "host="+quoteForwarded(req.Host))
+	} else {
+		header.Del("X-Forwarded-Host")
+	}
+	header.Set("X-Forwarded-Proto", scheme)
+	forwarded = append(forwarded, "proto="+scheme)
+	header.Set("Forwarded", strings.Join(forwarded, ";"))
+}
+
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, `:;,"[] `) {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); proto == "https" || proto == "http" {
+		return proto
 	}
+	return "http"
 }
 
 func isWebSocketRequest(r *http.Request) bool {
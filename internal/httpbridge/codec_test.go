@@ -0,0 +1,35 @@
+package httpbridge
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/AidyyJ/PortOpener/internal/relay"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "10.9.9.9")
+	SetForwardedHeaders(header, relay.HTTPRequest{Host: "app.example.com", Scheme: "https", RemoteAddr: "203.0.113.5:4000"})
+
+	if got := header.Get("X-Forwarded-For"); got != "203.0.113.5" {
+		t.Fatalf("unexpected X-Forwarded-For %q", got)
+	}
+	if got := header.Get("X-Forwarded-Host"); got != "app.example.com" {
+		t.Fatalf("unexpected X-Forwarded-Host %q", got)
+	}
+	if got := header.Get("X-Forwarded-Proto"); got != "https" {
+		t.Fatalf("unexpected X-Forwarded-Proto %q", got)
+	}
+	if got := header.Get("Forwarded"); got != "for=203.0.113.5;host=app.example.com;proto=https" {
+		t.Fatalf("unexpected Forwarded %q", got)
+	}
+}
+
+func TestSetForwardedHeadersQuotesIPv6(t *testing.T) {
+	header := http.Header{}
+	SetForwardedHeaders(header, relay.HTTPRequest{Host: "app.example.com:8443", RemoteAddr: "2001:db8::1"})
+	if got := header.Get("Forwarded"); got != `for="[2001:db8::1]";host="app.example.com:8443";proto=http` {
+		t.Fatalf("unexpected Forwarded %q", got)
+	}
+}
@@ -116,13 +116,19 @@ func NewFrameWriter(w io.Writer) *FrameWriter {
 }
 
 func (fw *FrameWriter) Write(p []byte) (int, error) {
-	if len(p) == 0 {
-		return 0, nil
-	}
-	if err := WriteFrame(fw.w, p); err != nil {
-		return 0, err
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > frameSizeLimit {
+			chunk = chunk[:frameSizeLimit]
+		}
+		if err := WriteFrame(fw.w, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
 	}
-	return len(p), nil
+	return written, nil
 }
 
 func (fw *FrameWriter) Close() error {
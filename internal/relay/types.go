@@ -8,29 +8,39 @@ type ControlMessage struct {
 	ClientID     string   `json:"client_id,omitempty"`
 	Version      string   `json:"version,omitempty"`
 	TunnelID     string   `json:"tunnel_id,omitempty"`
+	Name         string   `json:"name,omitempty"`
 	Protocol     string   `json:"protocol,omitempty"`
 	Subdomain    string   `json:"subdomain,omitempty"`
 	Allowlist    []string `json:"allowlist,omitempty"`
 	LocalHost    string   `json:"local_host,omitempty"`
 	LocalPort    int      `json:"local_port,omitempty"`
 	ExternalPort int      `json:"external_port,omitempty"`
+	RateLimit    float64  `json:"rate_limit,omitempty"`
+	RateBurst    int      `json:"rate_burst,omitempty"`
+	IPRateLimit  float64  `json:"ip_rate_limit,omitempty"`
+	IPRateBurst  int      `json:"ip_rate_burst,omitempty"`
 	ErrorCode    string   `json:"code,omitempty"`
 	Message      string   `json:"message,omitempty"`
 	Timestamp    string   `json:"timestamp,omitempty"`
 }
 
 type HTTPRequest struct {
-	Method      string      `json:"method"`
-	Path        string      `json:"path"`
-	Host        string      `json:"host"`
-	Header      http.Header `json:"header"`
-	RemoteAddr  string      `json:"remote_addr"`
-	IsWebSocket bool        `json:"is_websocket"`
+	Method        string      `json:"method"`
+	Path          string      `json:"path"`
+	Host          string      `json:"host"`
+	Scheme        string      `json:"scheme,omitempty"`
+	Header        http.Header `json:"header"`
+	ContentLength int64       `json:"content_length,omitempty"`
+	RemoteAddr    string      `json:"remote_addr"`
+	IsWebSocket   bool        `json:"is_websocket"`
 }
 
 type HTTPResponse struct {
 	Status int         `json:"status"`
 	Header http.Header `json:"header"`
+	// UpstreamMillis is how long the local service took to return response
+	// headers, as measured by the client.
+	UpstreamMillis float64 `json:"upstream_ms,omitempty"`
 }
 
 type UDPDatagram struct {
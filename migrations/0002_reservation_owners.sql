@@ -0,0 +1,5 @@
+ALTER TABLE subdomains ADD COLUMN owner_token_id INTEGER REFERENCES tokens(id);
+ALTER TABLE port_reservations ADD COLUMN owner_token_id INTEGER REFERENCES tokens(id);
+
+CREATE INDEX IF NOT EXISTS idx_subdomains_owner ON subdomains(owner_token_id);
+CREATE INDEX IF NOT EXISTS idx_ports_owner ON port_reservations(owner_token_id);
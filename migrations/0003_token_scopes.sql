@@ -0,0 +1,8 @@
+ALTER TABLE tokens ADD COLUMN name TEXT;
+ALTER TABLE tokens ADD COLUMN expires_at TEXT;
+ALTER TABLE tokens ADD COLUMN last_used_at TEXT;
+ALTER TABLE tokens ADD COLUMN protocols TEXT;
+ALTER TABLE tokens ADD COLUMN subdomain_patterns TEXT;
+ALTER TABLE tokens ADD COLUMN port_ranges TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_tokens_revoked ON tokens(revoked_at);
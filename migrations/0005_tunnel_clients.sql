@@ -0,0 +1 @@
+ALTER TABLE tunnels ADD COLUMN client_id TEXT;
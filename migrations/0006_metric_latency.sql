@@ -0,0 +1,18 @@
+ALTER TABLE metrics_rollup ADD COLUMN status_2xx INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE metrics_rollup ADD COLUMN status_3xx INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE metrics_rollup ADD COLUMN status_4xx INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE metrics_rollup ADD COLUMN status_5xx INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE metrics_rollup ADD COLUMN relay_errors INTEGER NOT NULL DEFAULT 0;
+
+-- Per-minute latency histograms. source is "edge" (relay round trip) or
+-- "upstream" (local service time reported by the client); le_ms is the
+-- bucket's upper bound in milliseconds, -1 for the overflow bucket.
+CREATE TABLE IF NOT EXISTS metrics_latency (
+  tunnel_id TEXT NOT NULL,
+  minute_bucket INTEGER NOT NULL,
+  source TEXT NOT NULL,
+  le_ms INTEGER NOT NULL,
+  count INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (tunnel_id, minute_bucket, source, le_ms),
+  FOREIGN KEY (tunnel_id) REFERENCES tunnels(id)
+);
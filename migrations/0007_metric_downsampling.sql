@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS metrics_hourly (
+  tunnel_id TEXT NOT NULL,
+  hour_bucket INTEGER NOT NULL,
+  req_count INTEGER NOT NULL DEFAULT 0,
+  conn_count INTEGER NOT NULL DEFAULT 0,
+  bytes_in INTEGER NOT NULL DEFAULT 0,
+  bytes_out INTEGER NOT NULL DEFAULT 0,
+  status_2xx INTEGER NOT NULL DEFAULT 0,
+  status_3xx INTEGER NOT NULL DEFAULT 0,
+  status_4xx INTEGER NOT NULL DEFAULT 0,
+  status_5xx INTEGER NOT NULL DEFAULT 0,
+  relay_errors INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (tunnel_id, hour_bucket),
+  FOREIGN KEY (tunnel_id) REFERENCES tunnels(id)
+);
+
+CREATE TABLE IF NOT EXISTS metrics_daily (
+  tunnel_id TEXT NOT NULL,
+  day_bucket INTEGER NOT NULL,
+  req_count INTEGER NOT NULL DEFAULT 0,
+  conn_count INTEGER NOT NULL DEFAULT 0,
+  bytes_in INTEGER NOT NULL DEFAULT 0,
+  bytes_out INTEGER NOT NULL DEFAULT 0,
+  status_2xx INTEGER NOT NULL DEFAULT 0,
+  status_3xx INTEGER NOT NULL DEFAULT 0,
+  status_4xx INTEGER NOT NULL DEFAULT 0,
+  status_5xx INTEGER NOT NULL DEFAULT 0,
+  relay_errors INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (tunnel_id, day_bucket),
+  FOREIGN KEY (tunnel_id) REFERENCES tunnels(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_logs_ts ON logs(ts);
+CREATE INDEX IF NOT EXISTS idx_metrics_rollup_minute ON metrics_rollup(minute_bucket);
+CREATE INDEX IF NOT EXISTS idx_metrics_latency_minute ON metrics_latency(minute_bucket);
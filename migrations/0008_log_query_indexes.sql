@@ -0,0 +1,5 @@
+-- Indexes for /api/logs filters. SQLite appends the rowid to every index, so
+-- each also serves the (ts, id) keyset ordering used for pagination.
+CREATE INDEX IF NOT EXISTS idx_logs_kind_ts ON logs(kind, ts);
+CREATE INDEX IF NOT EXISTS idx_logs_remote_ts ON logs(remote_addr, ts);
+CREATE INDEX IF NOT EXISTS idx_logs_status_ts ON logs(status_code, ts);
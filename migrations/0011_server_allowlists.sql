@@ -0,0 +1,20 @@
+-- Allowlist rows now record whether the client or an operator set them, so
+-- re-registration only replaces the client's. SQLite cannot change a UNIQUE
+-- constraint in place, hence the rebuild.
+CREATE TABLE IF NOT EXISTS ip_allowlists_v2 (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tunnel_id TEXT NOT NULL,
+  source TEXT NOT NULL DEFAULT 'client',
+  cidr TEXT NOT NULL,
+  created_at TEXT NOT NULL,
+  UNIQUE (tunnel_id, source, cidr),
+  FOREIGN KEY (tunnel_id) REFERENCES tunnels(id)
+);
+
+INSERT INTO ip_allowlists_v2 (id, tunnel_id, source, cidr, created_at)
+  SELECT id, tunnel_id, 'client', cidr, created_at FROM ip_allowlists;
+
+DROP TABLE ip_allowlists;
+ALTER TABLE ip_allowlists_v2 RENAME TO ip_allowlists;
+
+ALTER TABLE tunnels ADD COLUMN allowlist_mode TEXT NOT NULL DEFAULT '';
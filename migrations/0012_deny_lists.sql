@@ -0,0 +1,19 @@
+-- Deny rules block CIDRs globally (tunnel_id '') or for one tunnel. Bans
+-- block a single address until expires_at; expired rows are ignored and
+-- pruned when the server starts.
+CREATE TABLE IF NOT EXISTS ip_denylists (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tunnel_id TEXT NOT NULL DEFAULT '',
+  cidr TEXT NOT NULL,
+  created_at TEXT NOT NULL,
+  UNIQUE (tunnel_id, cidr)
+);
+
+CREATE TABLE IF NOT EXISTS ip_bans (
+  ip TEXT PRIMARY KEY,
+  reason TEXT NOT NULL,
+  created_at TEXT NOT NULL,
+  expires_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_ip_bans_expires_at ON ip_bans (expires_at);
@@ -0,0 +1,13 @@
+-- Rate limits a tunnel's client registered with and those set by an
+-- operator, one row each. Rates are per second; zero is unlimited.
+CREATE TABLE IF NOT EXISTS tunnel_rate_limits (
+  tunnel_id TEXT NOT NULL,
+  source TEXT NOT NULL,
+  rate REAL NOT NULL DEFAULT 0,
+  burst INTEGER NOT NULL DEFAULT 0,
+  per_ip REAL NOT NULL DEFAULT 0,
+  per_ip_burst INTEGER NOT NULL DEFAULT 0,
+  updated_at TEXT NOT NULL,
+  PRIMARY KEY (tunnel_id, source),
+  FOREIGN KEY (tunnel_id) REFERENCES tunnels(id)
+);
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/AidyyJ/PortOpener/server/internal/admin"
+	"github.com/AidyyJ/PortOpener/server/internal/clientip"
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/guard"
 	"github.com/AidyyJ/PortOpener/server/internal/metrics"
 	"github.com/AidyyJ/PortOpener/server/internal/relayserver"
 	"github.com/AidyyJ/PortOpener/server/internal/storage"
 	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
+	"github.com/AidyyJ/PortOpener/server/internal/webhooks"
 )
 
 func main() {
@@ -30,13 +40,12 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
-	relayToken := firstNonEmpty(
-		getenv("PORTOPENER_RELAY_TOKEN", ""),
-		getenv("PORTOPENER_ADMIN_TOKEN", ""),
-	)
+	relayToken := getenv("PORTOPENER_RELAY_TOKEN", "")
+	adminToken := getenv("PORTOPENER_ADMIN_TOKEN", "")
 	registry := tunnels.NewRegistry()
 	collector := metrics.New()
 	logger := metrics.NewLogger(1000)
+	bus := events.NewBus()
 	store, err := storage.Open(dbPath)
 	if err != nil {
 		log.Fatalf("db open failed: %v", err)
@@ -48,11 +57,84 @@ func main() {
 	if err := store.EnsureToken(relayToken); err != nil {
 		log.Fatalf("token init failed: %v", err)
 	}
-	relaySrv := relayserver.New(relayserver.Config{Token: relayToken}, registry, store)
-	adminAPI := &admin.API{Store: store, Reg: registry, AdminAllowlist: getenv("PORTOPENER_ADMIN_ALLOWLIST", "")}
-	proxy := &relayserver.HTTPProxy{Registry: registry, Metrics: collector, Logs: logger, Store: store}
+	if err := store.EnsureAdminToken(adminToken); err != nil {
+		log.Fatalf("admin token init failed: %v", err)
+	}
+	if adminToken == "" {
+		log.Printf("PORTOPENER_ADMIN_TOKEN not set; admin API only accepts previously created admin tokens")
+	}
+	reconnectGrace, err := time.ParseDuration(getenv("PORTOPENER_RECONNECT_GRACE", "15s"))
+	if err != nil {
+		log.Fatalf("reconnect grace invalid: %v", err)
+	}
+	retention := &storage.RetentionWorker{
+		Store: store,
+		Policy: storage.RetentionPolicy{
+			Logs:          getenvDays("PORTOPENER_LOG_RETENTION_DAYS", 14),
+			MinuteMetrics: getenvDays("PORTOPENER_METRICS_RETENTION_DAYS", 60),
+			HourlyMetrics: getenvDays("PORTOPENER_HOURLY_METRICS_RETENTION_DAYS", 180),
+			DailyMetrics:  getenvDays("PORTOPENER_DAILY_METRICS_RETENTION_DAYS", 730),
+		},
+		VacuumEvery: 24 * time.Hour,
+	}
+	if retention.Interval, err = time.ParseDuration(getenv("PORTOPENER_RETENTION_INTERVAL", "1h")); err != nil {
+		log.Fatalf("retention interval invalid: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go retention.Run(ctx)
+
+	writeInterval, err := time.ParseDuration(getenv("PORTOPENER_WRITE_INTERVAL", "250ms"))
+	if err != nil {
+		log.Fatalf("write interval invalid: %v", err)
+	}
+	writeQueue, err := strconv.Atoi(getenv("PORTOPENER_WRITE_QUEUE", "10000"))
+	if err != nil {
+		log.Fatalf("write queue invalid: %v", err)
+	}
+	writer := storage.NewBatchWriter(store, writeInterval, writeQueue)
+	defer writer.Close()
+
+	banPolicy := guard.Policy{
+		Strikes:      getenvInt("PORTOPENER_BAN_STRIKES", 20),
+		RequestLimit: getenvInt("PORTOPENER_BAN_REQUEST_LIMIT", 0),
+	}
+	if banPolicy.Window, err = time.ParseDuration(getenv("PORTOPENER_BAN_WINDOW", "1m")); err != nil {
+		log.Fatalf("ban window invalid: %v", err)
+	}
+	if banPolicy.BanFor, err = time.ParseDuration(getenv("PORTOPENER_BAN_DURATION", "15m")); err != nil {
+		log.Fatalf("ban duration invalid: %v", err)
+	}
+	gate, err := guard.New(store, banPolicy, bus)
+	if err != nil {
+		log.Fatalf("guard init failed: %v", err)
+	}
+
+	dispatcher := &webhooks.Dispatcher{Store: store, Client: &http.Client{Timeout: 15 * time.Second}}
+	go dispatcher.Run(ctx, bus)
+
+	relaySrv := relayserver.New(relayserver.Config{Token: relayToken, ReconnectGrace: reconnectGrace, Metrics: collector, Recorder: writer, Events: bus, Guard: gate}, registry, store)
+	adminAPI := &admin.API{Store: store, Reg: registry, Relay: relaySrv, Retention: retention, Events: bus, Guard: gate, AdminAllowlist: getenv("PORTOPENER_ADMIN_ALLOWLIST", "")}
+	proxy := &relayserver.HTTPProxy{Registry: registry, Metrics: collector, Logs: logger, Store: store, Recorder: writer, Events: bus, Guard: gate}
 
 	mux.HandleFunc("/relay", relaySrv.Handler())
+	exporter := &metrics.Exporter{
+		Collector: collector,
+		Sessions: func() []metrics.SessionSample {
+			infos := relaySrv.Sessions()
+			samples := make([]metrics.SessionSample, 0, len(infos))
+			for _, info := range infos {
+				samples = append(samples, metrics.SessionSample{ClientID: info.ClientID, RTT: time.Duration(info.RTTMillis * float64(time.Millisecond))})
+			}
+			return samples
+		},
+		UDPSessions: relaySrv.UDPSessions,
+		Writer: func() metrics.WriterSample {
+			stats := writer.Stats()
+			return metrics.WriterSample{Queued: stats.Queued, Dropped: stats.Dropped, Written: stats.Written, Failed: stats.Failed}
+		},
+	}
+	mux.Handle("/metrics", adminAPI.ProtectMetrics(getenv("PORTOPENER_METRICS_TOKEN", ""), exporter))
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/proxy/") {
 			proxy.Handler().ServeHTTP(w, r)
@@ -69,10 +151,29 @@ func main() {
 		publicFS.ServeHTTP(w, r)
 	}))
 
+	resolver, err := clientip.NewResolver(getenv("PORTOPENER_TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatalf("trusted proxies invalid: %v", err)
+	}
+
+	server := &http.Server{Addr: addr, Handler: resolver.Middleware(mux)}
+	// ListenAndServe returns as soon as Shutdown starts, so wait for handlers
+	// to drain before the deferred writer close flushes their records.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
 	log.Printf("portopener-server listening on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("listen failed: %v", err)
 	}
+	<-shutdownDone
+	log.Printf("portopener-server shutting down; flushing pending logs and metrics")
 }
 
 func getenv(key, fallback string) string {
@@ -82,13 +183,22 @@ func getenv(key, fallback string) string {
 	return fallback
 }
 
-func firstNonEmpty(values ...string) string {
-	for _, value := range values {
-		if strings.TrimSpace(value) != "" {
-			return strings.TrimSpace(value)
-		}
+// getenvDays reads a whole number of days; 0 means keep forever.
+func getenvDays(key string, fallback int) time.Duration {
+	days, err := strconv.Atoi(getenv(key, strconv.Itoa(fallback)))
+	if err != nil || days < 0 {
+		log.Fatalf("%s must be a whole number of days", key)
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// getenvInt reads a non-negative whole number.
+func getenvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getenv(key, strconv.Itoa(fallback)))
+	if err != nil || value < 0 {
+		log.Fatalf("%s must be a non-negative whole number", key)
 	}
-	return ""
+	return value
 }
 
 func isAdminHost(hostport string) bool {
@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
+)
+
+// allowlistUpdate replaces a tunnel's server-side allowlist. Mode is
+// "intersect" (the default) or "override"; an empty Server list clears it.
+type allowlistUpdate struct {
+	Server []string
+	Mode   string
+}
+
+// handleTunnelAllowlist shows a tunnel's client and server allowlists and
+// replaces the server one. Live routes pick up the change immediately.
+func (a *API) handleTunnelAllowlist(w http.ResponseWriter, r *http.Request, tunnelID string) {
+	before, err := a.Store.GetTunnelAllowlist(tunnelID)
+	if errors.Is(err, storage.ErrTunnelNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load allowlist", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, before)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	var payload allowlistUpdate
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	mode, err := tunnels.ParseAllowlistMode(payload.Mode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := tunnels.ParseAllowlist(payload.Server); err != nil {
+		http.Error(w, "invalid cidr: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := a.Store.SetServerAllowlist(tunnelID, payload.Server, string(mode))
+	if err != nil {
+		http.Error(w, "failed to update allowlist", http.StatusInternalServerError)
+		return
+	}
+	if a.Reg != nil {
+		if err := a.Reg.SetServerAllowlist(tunnelID, after.Server, tunnels.AllowlistMode(after.Mode)); err != nil {
+			http.Error(w, "failed to apply allowlist", http.StatusInternalServerError)
+			return
+		}
+	}
+	a.audit(r, storage.AuditTunnelAllowlist, tunnelID, before, after)
+	writeJSON(w, after)
+}
@@ -0,0 +1,119 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+)
+
+type principalKey struct{}
+
+// principalFrom returns the admin token authorize resolved for r.
+func principalFrom(r *http.Request) storage.AdminToken {
+	principal, _ := r.Context().Value(principalKey{}).(storage.AdminToken)
+	return principal
+}
+
+func withPrincipal(r *http.Request, principal storage.AdminToken) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+// audit records a successful mutation by the request's principal. before and
+// after are stored as JSON; nil leaves the side empty. A failed write is
+// logged rather than failing a change that already happened.
+func (a *API) audit(r *http.Request, action, target string, before, after any) {
+	if a.Store == nil {
+		return
+	}
+	principal := principalFrom(r)
+	entry := storage.AuditEntry{
+		ActorID:    principal.ID,
+		Actor:      principal.Name,
+		ActorRole:  principal.Role,
+		RemoteAddr: r.RemoteAddr,
+		Action:     action,
+		Target:     target,
+		Before:     auditValue(before),
+		After:      auditValue(after),
+	}
+	if err := a.Store.InsertAudit(entry); err != nil {
+		log.Printf("audit %s %s failed: %v", action, target, err)
+	}
+}
+
+func auditValue(value any) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// handleAudit lists audit entries newest first. It accepts actor, action,
+// target, remote, since, until and before (an entry ID) filters.
+func (a *API) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	if a.Store == nil {
+		http.Error(w, "store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	query, err := parseAuditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Limit = min(parseLimit(r, 200), maxLogPage)
+	entries, err := a.Store.ListAudit(query)
+	if err != nil {
+		http.Error(w, "failed to list audit log", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []storage.AuditEntry{}
+	}
+	writeJSON(w, entries)
+}
+
+func parseAuditQuery(r *http.Request) (storage.AuditQuery, error) {
+	params := r.URL.Query()
+	query := storage.AuditQuery{
+		Actor:      params.Get("actor"),
+		Action:     params.Get("action"),
+		Target:     params.Get("target"),
+		RemoteAddr: params.Get("remote"),
+	}
+	if before := params.Get("before"); before != "" {
+		id, err := strconv.ParseInt(before, 10, 64)
+		if err != nil || id <= 0 {
+			return query, fmt.Errorf("before must be an audit entry id")
+		}
+		query.BeforeID = id
+	}
+	for _, field := range []struct {
+		name   string
+		target *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		value := params.Get(field.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return query, fmt.Errorf("%s must be an RFC 3339 time", field.name)
+		}
+		*field.target = parsed
+	}
+	return query, nil
+}
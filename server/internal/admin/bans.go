@@ -0,0 +1,127 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+)
+
+// denylistUpdate replaces a deny list; an empty CIDRs list clears it.
+type denylistUpdate struct {
+	CIDRs []string
+}
+
+// handleGlobalDenylist shows and replaces the deny list that applies to
+// every tunnel and to the relay endpoint.
+func (a *API) handleGlobalDenylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.NotFound(w, r)
+		return
+	}
+	a.handleDenylist(w, r, "")
+}
+
+// handleDenylist shows and replaces a deny list. Changes apply to new
+// requests, connections and datagrams straight away.
+func (a *API) handleDenylist(w http.ResponseWriter, r *http.Request, tunnelID string) {
+	before, err := a.Store.GetDenylist(tunnelID)
+	if errors.Is(err, storage.ErrTunnelNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load denylist", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, before)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	var payload denylistUpdate
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	for _, cidr := range payload.CIDRs {
+		if trimmed := strings.TrimSpace(cidr); trimmed != "" {
+			if _, _, err := net.ParseCIDR(trimmed); err != nil {
+				http.Error(w, "invalid cidr: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	after, err := a.Store.SetDenylist(tunnelID, payload.CIDRs)
+	if err != nil {
+		http.Error(w, "failed to update denylist", http.StatusInternalServerError)
+		return
+	}
+	if err := a.Guard.Reload(); err != nil {
+		http.Error(w, "failed to apply denylist", http.StatusInternalServerError)
+		return
+	}
+	a.audit(r, storage.AuditDenylistUpdate, tunnelID, before, after)
+	writeJSON(w, after)
+}
+
+func (a *API) handleListBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	bans, err := a.Store.ListBans()
+	if err != nil {
+		http.Error(w, "failed to list bans", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, bans)
+}
+
+// handleBanAction lifts the ban on one IP before its cooldown ends.
+func (a *API) handleBanAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.NotFound(w, r)
+		return
+	}
+	ip := net.ParseIP(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/bans/"), "/"))
+	if ip == nil {
+		http.Error(w, "ip required", http.StatusBadRequest)
+		return
+	}
+	bans, err := a.Store.ListBans()
+	if err != nil {
+		http.Error(w, "failed to load bans", http.StatusInternalServerError)
+		return
+	}
+	var before any
+	for _, ban := range bans {
+		if ban.IP == ip.String() {
+			before = ban
+		}
+	}
+	if a.Guard != nil {
+		err = a.Guard.Unban(ip.String())
+	} else {
+		err = a.Store.DeleteBan(ip.String())
+	}
+	if errors.Is(err, storage.ErrBanNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to clear ban", http.StatusInternalServerError)
+		return
+	}
+	a.audit(r, storage.AuditBanClear, ip.String(), before, nil)
+	writeJSON(w, map[string]string{"status": "cleared"})
+}
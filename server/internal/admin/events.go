@@ -0,0 +1,89 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	eventBuffer    = 256
+	eventKeepalive = 15 * time.Second
+)
+
+// handleEvents streams live activity as Server-Sent Events until the caller
+// disconnects. tunnel_id and type (comma-separated) narrow the feed.
+func (a *API) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	if a.Events == nil {
+		http.Error(w, "events not configured", http.StatusServiceUnavailable)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	tunnelID := r.URL.Query().Get("tunnel_id")
+	types := make(map[string]bool)
+	for _, value := range strings.Split(r.URL.Query().Get("type"), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			types[value] = true
+		}
+	}
+
+	sub := a.Events.Subscribe(eventBuffer)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	var reported int64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			// A comment line keeps idle proxies from closing the stream.
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if tunnelID != "" && ev.TunnelID != tunnelID {
+				continue
+			}
+			if len(types) > 0 && !types[ev.Type] {
+				continue
+			}
+			// Tell a slow reader how many events it has missed so far.
+			if dropped := sub.Dropped(); dropped != reported {
+				reported = dropped
+				if _, err := fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped); err != nil {
+					return
+				}
+			}
+			payload, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -2,37 +2,81 @@ package admin
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/guard"
+	"github.com/AidyyJ/PortOpener/server/internal/relayserver"
 	"github.com/AidyyJ/PortOpener/server/internal/storage"
 	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
 )
 
+// RelayControl is the live relay state the admin API reads and acts on.
+type RelayControl interface {
+	CloseTunnel(tunnelID, reason string) bool
+	Sessions() []relayserver.SessionInfo
+}
+
 type API struct {
 	Store          *storage.Store
 	Reg            *tunnels.Registry
+	Relay          RelayControl
+	Retention      *storage.RetentionWorker
+	Events         *events.Bus
+	Guard          *guard.Guard
 	AdminAllowlist string
 }
 
 func (a *API) Handler() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/reservations/http", a.withAuth(a.handleListHTTPReservations))
+	mux.HandleFunc("/api/reservations/http", a.withAuth(a.handleHTTPReservations))
+	mux.HandleFunc("/api/reservations/http/", a.withAuth(a.handleHTTPReservationAction))
 	mux.HandleFunc("/api/tunnels", a.withAuth(a.handleListTunnels))
 	mux.HandleFunc("/api/tunnels/", a.withAuth(a.handleTunnelAction))
+	mux.HandleFunc("/api/clients", a.withAuth(a.handleListClients))
+	mux.HandleFunc("/api/denylist", a.withAuth(a.handleGlobalDenylist))
+	mux.HandleFunc("/api/bans", a.withAuth(a.handleListBans))
+	mux.HandleFunc("/api/bans/", a.withAuth(a.handleBanAction))
 	mux.HandleFunc("/api/reservations/ports", a.withAuth(a.handleListPortReservations))
 	mux.HandleFunc("/api/domains", a.withAuth(a.handleDomains))
 	mux.HandleFunc("/api/tls/ask", a.handleTLSAsk)
 	mux.HandleFunc("/api/logs", a.withAuth(a.handleListLogs))
 	mux.HandleFunc("/api/metrics", a.withAuth(a.handleListMetrics))
-	mux.HandleFunc("/api/token/rotate", a.withAuth(a.handleRotateToken))
+	mux.HandleFunc("/api/retention", a.withAuth(a.handleRetention))
+	mux.HandleFunc("/api/events", a.withAuth(a.handleEvents))
+	mux.HandleFunc("/api/token/rotate", a.withRole(storage.RoleOwner, a.handleRotateToken))
+	mux.HandleFunc("/api/tokens", a.withRole(storage.RoleOwner, a.handleTokens))
+	mux.HandleFunc("/api/tokens/", a.withRole(storage.RoleOwner, a.handleTokenAction))
+	mux.HandleFunc("/api/admin-tokens", a.withRole(storage.RoleOwner, a.handleAdminTokens))
+	mux.HandleFunc("/api/admin-tokens/", a.withRole(storage.RoleOwner, a.handleAdminTokenAction))
+	mux.HandleFunc("/api/webhooks", a.withRole(storage.RoleOwner, a.handleWebhooks))
+	mux.HandleFunc("/api/webhooks/", a.withRole(storage.RoleOwner, a.handleWebhookAction))
+	mux.HandleFunc("/api/audit", a.withRole(storage.RoleOwner, a.handleAudit))
 	return mux
 }
 
+// withAuth lets viewers read and requires an operator for anything else.
 func (a *API) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return a.authorize(func(r *http.Request) storage.AdminRole {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			return storage.RoleViewer
+		}
+		return storage.RoleOperator
+	}, next)
+}
+
+// withRole requires role for every method.
+func (a *API) withRole(role storage.AdminRole, next http.HandlerFunc) http.HandlerFunc {
+	return a.authorize(func(*http.Request) storage.AdminRole { return role }, next)
+}
+
+// authorize checks the caller's admin token. Relay tokens are not accepted.
+func (a *API) authorize(required func(*http.Request) storage.AdminRole, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !a.allowAdminIP(r) {
 			http.Error(w, "forbidden", http.StatusForbidden)
@@ -47,7 +91,7 @@ func (a *API) withAuth(next http.HandlerFunc) http.HandlerFunc {
 		if token == "" {
 			token = strings.TrimSpace(r.Header.Get("X-Admin-Token"))
 		}
-		ok, err := a.Store.ValidateToken(token)
+		principal, ok, err := a.Store.AuthenticateAdminToken(token)
 		if err != nil {
 			http.Error(w, "auth failed", http.StatusInternalServerError)
 			return
@@ -56,7 +100,11 @@ func (a *API) withAuth(next http.HandlerFunc) http.HandlerFunc {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-		next(w, r)
+		if !principal.Role.Allows(required(r)) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, withPrincipal(r, principal))
 	}
 }
 
@@ -71,11 +119,9 @@ func (a *API) allowAdminIP(r *http.Request) bool {
 	if r.RemoteAddr == "" {
 		return false
 	}
+	// RemoteAddr is already resolved through the trusted-proxy configuration;
+	// forwarding headers are never consulted here.
 	remote := r.RemoteAddr
-	if forwarded := strings.TrimSpace(r.Header.Get("X-Forwarded-For")); forwarded != "" {
-		parts := strings.Split(forwarded, ",")
-		remote = strings.TrimSpace(parts[0])
-	}
 	if host, _, err := net.SplitHostPort(remote); err == nil {
 		remote = host
 	}
@@ -85,21 +131,6 @@ func (a *API) allowAdminIP(r *http.Request) bool {
 	return parsed.Allowlist.Allows(remote)
 }
 
-func (a *API) handleListHTTPReservations(w http.ResponseWriter, _ *http.Request) {
-	if a.Store == nil {
-		http.Error(w, "store not configured", http.StatusServiceUnavailable)
-		return
-	}
-
-	reservations, err := a.Store.ListHTTPReservations()
-	if err != nil {
-		http.Error(w, "failed to list reservations", http.StatusInternalServerError)
-		return
-	}
-
-	writeJSON(w, reservations)
-}
-
 func (a *API) handleListTunnels(w http.ResponseWriter, r *http.Request) {
 	if a.Store == nil {
 		http.Error(w, "store not configured", http.StatusServiceUnavailable)
@@ -114,32 +145,72 @@ func (a *API) handleListTunnels(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, tunnels)
 }
 
+// handleTunnelAction serves DELETE /api/tunnels/{id} to terminate a tunnel
+// and GET or PUT /api/tunnels/{id}/allowlist.
 func (a *API) handleTunnelAction(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		http.NotFound(w, r)
-		return
-	}
 	if a.Store == nil {
 		http.Error(w, "store not configured", http.StatusServiceUnavailable)
 		return
 	}
-	path := strings.TrimPrefix(r.URL.Path, "/api/tunnels/")
-	if path == "" {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tunnels/"), "/")
+	tunnelID, action, _ := strings.Cut(path, "/")
+	if tunnelID == "" {
 		http.Error(w, "tunnel id required", http.StatusBadRequest)
 		return
 	}
+	switch {
+	case r.Method == http.MethodDelete && action == "":
+		a.terminateTunnel(w, r, tunnelID)
+	case (r.Method == http.MethodGet || r.Method == http.MethodPut) && action == "allowlist":
+		a.handleTunnelAllowlist(w, r, tunnelID)
+	case (r.Method == http.MethodGet || r.Method == http.MethodPut) && action == "denylist":
+		a.handleDenylist(w, r, tunnelID)
+	case (r.Method == http.MethodGet || r.Method == http.MethodPut) && action == "ratelimit":
+		a.handleTunnelRateLimit(w, r, tunnelID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *API) terminateTunnel(w http.ResponseWriter, r *http.Request, tunnelID string) {
+	before, _, err := a.Store.GetTunnel(tunnelID)
+	if err != nil {
+		http.Error(w, "failed to load tunnel", http.StatusInternalServerError)
+		return
+	}
+	// The relay publishes tunnel_closed for live tunnels; offline ones are
+	// announced here.
+	if a.Relay == nil || !a.Relay.CloseTunnel(tunnelID, "terminated by admin") {
+		a.Events.Publish(events.Event{Type: events.TunnelClosed, TunnelID: tunnelID, Message: "terminated by admin"})
+	}
 	if a.Reg != nil {
-		_ = a.Reg.RemoveHTTPByTunnelID(path)
-		_ = a.Reg.RemoveTCPByTunnelID(path)
-		_ = a.Reg.RemoveUDPByTunnelID(path)
+		_ = a.Reg.RemoveHTTPByTunnelID(tunnelID)
+		_ = a.Reg.RemoveTCPByTunnelID(tunnelID)
+		_ = a.Reg.RemoveUDPByTunnelID(tunnelID)
 	}
-	if err := a.Store.MarkTunnelStatus(path, "terminated"); err != nil {
+	if err := a.Store.MarkTunnelStatus(tunnelID, "terminated"); err != nil {
 		http.Error(w, "failed to update tunnel", http.StatusInternalServerError)
 		return
 	}
+	after := before
+	after.Status = "terminated"
+	a.audit(r, storage.AuditTunnelTerminate, tunnelID, before, after)
 	writeJSON(w, map[string]string{"status": "terminated"})
 }
 
+// handleListClients lists connected CLI clients with their round-trip time.
+func (a *API) handleListClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	if a.Relay == nil {
+		writeJSON(w, []relayserver.SessionInfo{})
+		return
+	}
+	writeJSON(w, a.Relay.Sessions())
+}
+
 func (a *API) handleListPortReservations(w http.ResponseWriter, r *http.Request) {
 	if a.Store == nil {
 		http.Error(w, "store not configured", http.StatusServiceUnavailable)
@@ -181,10 +252,31 @@ func (a *API) handleDomains(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "invalid json", http.StatusBadRequest)
 			return
 		}
+		previous, existed, err := a.Store.GetCustomDomain(payload.Domain)
+		if err != nil {
+			http.Error(w, "failed to upsert domain", http.StatusInternalServerError)
+			return
+		}
 		if err := a.Store.UpsertCustomDomain(payload); err != nil {
 			http.Error(w, "failed to upsert domain", http.StatusInternalServerError)
 			return
 		}
+		if current, ok, err := a.Store.GetCustomDomain(payload.Domain); err == nil && ok {
+			var before any
+			if existed {
+				before = previous
+			}
+			a.audit(r, storage.AuditDomainUpsert, current.Domain, before, current)
+			if current.Status != previous.Status {
+				a.Events.Publish(events.Event{
+					Type:           events.DomainStatusChanged,
+					TunnelID:       current.TunnelID,
+					Domain:         current.Domain,
+					DomainStatus:   current.Status,
+					PreviousStatus: previous.Status,
+				})
+			}
+		}
 		writeJSON(w, payload)
 		return
 	default:
@@ -219,6 +311,9 @@ func (a *API) handleTLSAsk(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleRotateToken is the deprecated POST /api/token/rotate. It rotates the
+// token seeded from PORTOPENER_RELAY_TOKEN as POST /api/tokens/{id}/rotate
+// would, leaving every other token alone.
 func (a *API) handleRotateToken(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.NotFound(w, r)
@@ -228,30 +323,203 @@ func (a *API) handleRotateToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "store not configured", http.StatusServiceUnavailable)
 		return
 	}
-	newToken, err := storage.GenerateToken()
+	id, err := a.Store.SeedTokenID()
+	if errors.Is(err, storage.ErrTokenNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "token lookup failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Deprecation", "true")
+	a.rotateToken(w, r, id, storage.AuditRelayTokenRotate)
+}
+
+func (a *API) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if a.Store == nil {
+		http.Error(w, "store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := a.Store.ListTokens()
+		if err != nil {
+			http.Error(w, "failed to list tokens", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, tokens)
+		return
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		var payload storage.Token
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		raw, err := storage.GenerateToken()
+		if err != nil {
+			http.Error(w, "token generation failed", http.StatusInternalServerError)
+			return
+		}
+		created, err := a.Store.CreateToken(payload, raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.audit(r, storage.AuditTokenCreate, strconv.FormatInt(created.ID, 10), nil, created)
+		a.Events.Publish(events.Event{Type: events.TokenCreated, TokenID: created.ID, TokenName: created.Name, Message: "relay token"})
+		writeJSON(w, map[string]any{"token": raw, "info": created})
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+}
+
+// handleTokenAction serves DELETE /api/tokens/{id} to revoke a single token
+// and POST /api/tokens/{id}/rotate to replace its secret.
+func (a *API) handleTokenAction(w http.ResponseWriter, r *http.Request) {
+	if a.Store == nil {
+		http.Error(w, "store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tokens/"), "/")
+	idText, action, _ := strings.Cut(path, "/")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "token id required", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Method == http.MethodDelete && action == "":
+		before, _, err := a.Store.GetToken(id)
+		if err != nil {
+			http.Error(w, "token revoke failed", http.StatusInternalServerError)
+			return
+		}
+		if err := a.Store.RevokeToken(id); err != nil {
+			if errors.Is(err, storage.ErrTokenNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, "token revoke failed", http.StatusInternalServerError)
+			return
+		}
+		after, _, _ := a.Store.GetToken(id)
+		a.audit(r, storage.AuditTokenRevoke, idText, before, after)
+		a.Events.Publish(events.Event{Type: events.TokenRevoked, TokenID: id, Message: "relay token"})
+		writeJSON(w, map[string]string{"status": "revoked"})
+	case r.Method == http.MethodPost && action == "rotate":
+		a.rotateToken(w, r, id, storage.AuditTokenRotate)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// rotateToken replaces the secret of token id and returns the new one, which
+// is shown only this once.
+func (a *API) rotateToken(w http.ResponseWriter, r *http.Request, id int64, auditAction string) {
+	raw, err := storage.GenerateToken()
 	if err != nil {
 		http.Error(w, "token generation failed", http.StatusInternalServerError)
 		return
 	}
-	if err := a.Store.RotateToken(newToken); err != nil {
+	if err := a.Store.RotateTokenByID(id, raw); err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			http.NotFound(w, r)
+			return
+		}
 		http.Error(w, "token rotation failed", http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, map[string]string{"token": newToken})
+	a.audit(r, auditAction, strconv.FormatInt(id, 10), nil, nil)
+	a.Events.Publish(events.Event{Type: events.TokenRotated, TokenID: id, Message: "relay token"})
+	writeJSON(w, map[string]string{"token": raw})
 }
 
-func (a *API) handleListLogs(w http.ResponseWriter, r *http.Request) {
+func (a *API) handleAdminTokens(w http.ResponseWriter, r *http.Request) {
 	if a.Store == nil {
 		http.Error(w, "store not configured", http.StatusServiceUnavailable)
 		return
 	}
-	limit := parseLimit(r, 200)
-	logs, err := a.Store.ListLogs(limit)
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := a.Store.ListAdminTokens()
+		if err != nil {
+			http.Error(w, "failed to list admin tokens", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, tokens)
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		var payload storage.AdminToken
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		raw, err := storage.GenerateToken()
+		if err != nil {
+			http.Error(w, "token generation failed", http.StatusInternalServerError)
+			return
+		}
+		created, err := a.Store.CreateAdminToken(payload, raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.audit(r, storage.AuditAdminTokenCreate, strconv.FormatInt(created.ID, 10), nil, created)
+		a.Events.Publish(events.Event{Type: events.TokenCreated, TokenID: created.ID, TokenName: created.Name, Message: "admin token"})
+		writeJSON(w, map[string]any{"token": raw, "info": created})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleAdminTokenAction serves DELETE /api/admin-tokens/{id}.
+func (a *API) handleAdminTokenAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.NotFound(w, r)
+		return
+	}
+	if a.Store == nil {
+		http.Error(w, "store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin-tokens/"), "/"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "token id required", http.StatusBadRequest)
+		return
+	}
+	before, _, err := a.Store.GetAdminToken(id)
 	if err != nil {
-		http.Error(w, "failed to list logs", http.StatusInternalServerError)
+		http.Error(w, "admin token revoke failed", http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, logs)
+	if err := a.Store.RevokeAdminToken(id); err != nil {
+		if errors.Is(err, storage.ErrAdminTokenNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, storage.ErrLastOwnerToken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "admin token revoke failed", http.StatusInternalServerError)
+		return
+	}
+	after, _, _ := a.Store.GetAdminToken(id)
+	a.audit(r, storage.AuditAdminTokenRevoke, strconv.FormatInt(id, 10), before, after)
+	a.Events.Publish(events.Event{Type: events.TokenRevoked, TokenID: id, Message: "admin token"})
+	writeJSON(w, map[string]string{"status": "revoked"})
 }
 
 func (a *API) handleListMetrics(w http.ResponseWriter, r *http.Request) {
@@ -265,7 +533,54 @@ func (a *API) handleListMetrics(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "failed to list metrics", http.StatusInternalServerError)
 		return
 	}
-	writeJSON(w, metrics)
+	views := make([]metricView, 0, len(metrics))
+	for _, rollup := range metrics {
+		views = append(views, metricView{
+			MetricRollup:   rollup,
+			EdgeMillis:     percentilesOf(rollup.EdgeLatency),
+			UpstreamMillis: percentilesOf(rollup.UpstreamLatency),
+		})
+	}
+	writeJSON(w, views)
+}
+
+// metricView is a rollup with latency percentiles derived from its histograms.
+type metricView struct {
+	storage.MetricRollup
+	EdgeMillis     latencyPercentiles
+	UpstreamMillis latencyPercentiles
+}
+
+type latencyPercentiles struct {
+	P50 float64
+	P95 float64
+	P99 float64
+}
+
+func percentilesOf(h storage.LatencyHistogram) latencyPercentiles {
+	return latencyPercentiles{P50: h.Quantile(0.50), P95: h.Quantile(0.95), P99: h.Quantile(0.99)}
+}
+
+// handleRetention reports the retention windows and the last pruning pass.
+func (a *API) handleRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	if a.Retention == nil {
+		http.Error(w, "retention not configured", http.StatusServiceUnavailable)
+		return
+	}
+	policy := a.Retention.Policy
+	writeJSON(w, map[string]any{
+		"policy": map[string]string{
+			"logs":           policy.Logs.String(),
+			"minute_metrics": policy.MinuteMetrics.String(),
+			"hourly_metrics": policy.HourlyMetrics.String(),
+			"daily_metrics":  policy.DailyMetrics.String(),
+		},
+		"last_run": a.Retention.LastReport(),
+	})
 }
 
 func parseLimit(r *http.Request, fallback int) int {
@@ -1,9 +1,20 @@
 package admin
 
 import (
+	"bufio"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/guard"
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+	"github.com/AidyyJ/PortOpener/server/internal/storage/storagetest"
+	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
 )
 
 func TestAllowAdminIP(t *testing.T) {
@@ -22,12 +33,598 @@ func TestAllowAdminIP(t *testing.T) {
 	}
 }
 
-func TestAllowAdminIPUsesForwardedFor(t *testing.T) {
+func TestAllowAdminIPIgnoresForwardedFor(t *testing.T) {
 	api := &API{AdminAllowlist: "203.0.113.0/24"}
 	req := httptest.NewRequest(http.MethodGet, "/api/tunnels", nil)
 	req.RemoteAddr = "10.0.0.1:1234"
 	req.Header.Set("X-Forwarded-For", "203.0.113.5, 70.41.3.18")
-	if !api.allowAdminIP(req) {
-		t.Fatalf("expected allowlist to use X-Forwarded-For first hop")
+	if api.allowAdminIP(req) {
+		t.Fatalf("expected spoofed X-Forwarded-For to be ignored")
+	}
+}
+
+func TestTokensEndpointCreatesAndRevokes(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "root", Role: storage.RoleOwner}, "admin"); err != nil {
+		t.Fatalf("create admin token failed: %v", err)
+	}
+	handler := (&API{Store: store}).Handler()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/tokens", strings.NewReader(`{"name":"ci","protocols":["http"]}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create token: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Token string
+		Info  storage.Token
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if created.Token == "" || created.Info.Name != "ci" {
+		t.Fatalf("unexpected create response %+v", created)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/tokens/"+strconv.FormatInt(created.Info.ID, 10), nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke token: expected 200, got %d", rec.Code)
+	}
+	if ok, _ := store.ValidateToken(created.Token); ok {
+		t.Fatalf("expected created token revoked")
+	}
+}
+
+func TestLegacyRotateRotatesOnlySeedToken(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "root", Role: storage.RoleOwner}, "admin"); err != nil {
+		t.Fatalf("create admin token failed: %v", err)
+	}
+	if err := store.EnsureToken("seed"); err != nil {
+		t.Fatalf("ensure token failed: %v", err)
+	}
+	seedID, _, err := store.LookupTokenID("seed")
+	if err != nil {
+		t.Fatalf("lookup token failed: %v", err)
+	}
+	if _, err := store.CreateToken(storage.Token{Name: "ci"}, "ci"); err != nil {
+		t.Fatalf("create token failed: %v", err)
+	}
+	handler := (&API{Store: store}).Handler()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/token/rotate", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Deprecation") == "" {
+		t.Fatalf("rotate: expected deprecated 200, got %d %v: %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+	var rotated struct{ Token string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &rotated); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if ok, _ := store.ValidateToken("seed"); ok {
+		t.Fatalf("expected old seed secret rejected")
+	}
+	if id, ok, _ := store.LookupTokenID(rotated.Token); !ok || id != seedID {
+		t.Fatalf("expected new secret on seed token %d, got %d ok=%v", seedID, id, ok)
+	}
+	if ok, _ := store.ValidateToken("ci"); !ok {
+		t.Fatalf("expected other tokens left alone")
+	}
+	entries, err := store.ListAudit(storage.AuditQuery{Action: storage.AuditRelayTokenRotate})
+	if err != nil || len(entries) != 1 || entries[0].Target != strconv.FormatInt(seedID, 10) {
+		t.Fatalf("unexpected audit entries %+v err=%v", entries, err)
+	}
+}
+
+func TestAdminAuthSeparatesRelayTokensAndRoles(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if err := store.InsertToken("relay"); err != nil {
+		t.Fatalf("insert relay token failed: %v", err)
+	}
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "ops", Role: storage.RoleViewer}, "viewer"); err != nil {
+		t.Fatalf("create viewer failed: %v", err)
+	}
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "oncall", Role: storage.RoleOperator}, "operator"); err != nil {
+		t.Fatalf("create operator failed: %v", err)
+	}
+	handler := (&API{Store: store}).Handler()
+
+	cases := []struct {
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"relay", http.MethodGet, "/api/tunnels", http.StatusUnauthorized},
+		{"viewer", http.MethodGet, "/api/tunnels", http.StatusOK},
+		{"viewer", http.MethodDelete, "/api/tunnels/abc", http.StatusForbidden},
+		{"operator", http.MethodDelete, "/api/tunnels/abc", http.StatusOK},
+		{"operator", http.MethodGet, "/api/tokens", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("%s %s as %s: expected %d, got %d", tc.method, tc.path, tc.token, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestProtectMetrics(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	cases := []struct {
+		name      string
+		allowlist string
+		token     string
+		auth      string
+		remote    string
+		want      int
+	}{
+		{name: "no allowlist or token", remote: "10.0.0.10:1234", want: http.StatusForbidden},
+		{name: "allowlisted", allowlist: "10.0.0.0/24", remote: "10.0.0.10:1234", want: http.StatusOK},
+		{name: "outside allowlist", allowlist: "10.0.0.0/24", remote: "192.168.1.10:1234", want: http.StatusForbidden},
+		{name: "token", token: "scrape", auth: "Bearer scrape", remote: "192.168.1.10:1234", want: http.StatusOK},
+		{name: "wrong token", token: "scrape", auth: "Bearer nope", remote: "10.0.0.10:1234", want: http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		api := &API{AdminAllowlist: tc.allowlist}
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.RemoteAddr = tc.remote
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		api.ProtectMetrics(tc.token, ok).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestLogsEndpointPaginatesAndExports(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "viewer", Role: storage.RoleViewer}, "viewer"); err != nil {
+		t.Fatalf("create admin token failed: %v", err)
+	}
+	if err := store.UpsertTunnel(storage.Tunnel{ID: "tunnel-1", Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 8080}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+	for i, status := range []int{200, 404, 500} {
+		entry := storage.LogEntry{TunnelID: "tunnel-1", Timestamp: time.Unix(int64(1_700_000_000+i), 0), Summary: "GET /", Status: status}
+		if err := store.InsertLog(entry); err != nil {
+			t.Fatalf("insert log failed: %v", err)
+		}
+	}
+	handler := (&API{Store: store}).Handler()
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer viewer")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/api/logs?tunnel_id=tunnel-1&status=4xx-5xx")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for malformed status, got %d", rec.Code)
+	}
+
+	rec = get("/api/logs?limit=2")
+	var page []storage.LogEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	next := rec.Header().Get("X-Next-Cursor")
+	if len(page) != 2 || page[0].Status != 500 || next == "" {
+		t.Fatalf("unexpected first page %+v, cursor %q", page, next)
+	}
+	rec = get("/api/logs?limit=2&cursor=" + next)
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(page) != 1 || page[0].Status != 200 || rec.Header().Get("X-Next-Cursor") != "" {
+		t.Fatalf("unexpected last page %+v", page)
+	}
+
+	rec = get("/api/logs?format=csv&status=400-599")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Header().Get("Content-Type") != "text/csv" || len(lines) != 3 || !strings.HasPrefix(lines[0], "id,timestamp") {
+		t.Fatalf("unexpected csv export: %q", rec.Body.String())
+	}
+}
+
+func TestEventsStreamFiltersByTunnel(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "viewer", Role: storage.RoleViewer}, "viewer"); err != nil {
+		t.Fatalf("create admin token failed: %v", err)
+	}
+	bus := events.NewBus()
+	server := httptest.NewServer((&API{Store: store, Events: bus}).Handler())
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/events?tunnel_id=tunnel-1", nil)
+	if err != nil {
+		t.Fatalf("new request failed: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer viewer")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("subscribe failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	bus.Publish(events.Event{Type: events.HTTPRequest, TunnelID: "tunnel-2", Path: "/skipped"})
+	bus.Publish(events.Event{Type: events.HTTPRequest, TunnelID: "tunnel-1", Method: "GET", Path: "/wanted", Status: 200})
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event: http_request" || !strings.Contains(lines[1], `"path":"/wanted"`) {
+		t.Fatalf("unexpected event %q", lines)
+	}
+}
+
+func TestWebhooksEndpointHidesSecrets(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "root", Role: storage.RoleOwner}, "admin"); err != nil {
+		t.Fatalf("create admin token failed: %v", err)
+	}
+	handler := (&API{Store: store}).Handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/api/webhooks", `{"URL":"https://hooks.example.com","Events":["http_request"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown event rejected, got %d", rec.Code)
+	}
+	rec := do(http.MethodPost, "/api/webhooks", `{"URL":"https://hooks.example.com","Events":["tunnel_closed"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create webhook: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Secret string
+		Info   storage.Webhook
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if created.Secret == "" || created.Info.Secret != "" || created.Info.ID == 0 {
+		t.Fatalf("unexpected create response %+v", created)
+	}
+
+	rec = do(http.MethodGet, "/api/webhooks", "")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), created.Secret) {
+		t.Fatalf("expected listing without secret, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodDelete, "/api/webhooks/"+strconv.FormatInt(created.Info.ID, 10), ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete webhook: expected 200, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/webhooks/"+strconv.FormatInt(created.Info.ID, 10), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected second delete to 404, got %d", rec.Code)
+	}
+}
+
+func TestAuditRecordsAdminMutations(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "root", Role: storage.RoleOwner}, "owner"); err != nil {
+		t.Fatalf("create owner failed: %v", err)
+	}
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "oncall", Role: storage.RoleOperator}, "operator"); err != nil {
+		t.Fatalf("create operator failed: %v", err)
+	}
+	if err := store.UpsertTunnel(storage.Tunnel{ID: "t1", Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 3000, Status: "active"}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+	handler := (&API{Store: store}).Handler()
+	do := func(token, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("operator", http.MethodDelete, "/api/tunnels/t1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("terminate: expected 200, got %d", rec.Code)
+	}
+	if rec := do("operator", http.MethodPost, "/api/domains", `{"Domain":"app.example.com","TunnelID":"t1","Status":"enabled"}`); rec.Code != http.StatusOK {
+		t.Fatalf("domain upsert: expected 200, got %d", rec.Code)
+	}
+	if rec := do("operator", http.MethodGet, "/api/audit", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected operator forbidden from audit, got %d", rec.Code)
+	}
+
+	rec := do("owner", http.MethodGet, "/api/audit?action=tunnel.terminate", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("audit: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var entries []storage.AuditEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 terminate entry, got %+v", entries)
+	}
+	entry := entries[0]
+	if entry.Actor != "oncall" || entry.ActorRole != storage.RoleOperator || entry.Target != "t1" || entry.RemoteAddr == "" {
+		t.Fatalf("unexpected audit entry %+v", entry)
+	}
+	var before, after storage.Tunnel
+	if err := json.Unmarshal(entry.Before, &before); err != nil || before.Status != "active" {
+		t.Fatalf("unexpected before value %s", entry.Before)
+	}
+	if err := json.Unmarshal(entry.After, &after); err != nil || after.Status != "terminated" {
+		t.Fatalf("unexpected after value %s", entry.After)
+	}
+
+	rec = do("owner", http.MethodGet, "/api/audit?actor=oncall", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Action != storage.AuditDomainUpsert || string(entries[0].Before) != "null" {
+		t.Fatalf("unexpected actor listing %+v", entries)
+	}
+}
+
+func TestHTTPReservationsCRUDUpdatesRouting(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "oncall", Role: storage.RoleOperator}, "operator"); err != nil {
+		t.Fatalf("create operator failed: %v", err)
+	}
+	owner, err := store.CreateToken(storage.Token{Name: "ci"}, "ci")
+	if err != nil {
+		t.Fatalf("create token failed: %v", err)
+	}
+	registry := tunnels.NewRegistry()
+	handler := (&API{Store: store, Reg: registry}).Handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer operator")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/api/reservations/http", `{"Subdomain":"bad.name"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid subdomain rejected, got %d", rec.Code)
+	}
+	if err := registry.RegisterHTTP("t0", nil, tunnels.HTTPRegistration{Subdomain: "app", OwnerTokenID: owner.ID + 1}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	rec := do(http.MethodPost, "/api/reservations/http", `{"Subdomain":"app","OwnerTokenID":`+strconv.FormatInt(owner.ID, 10)+`}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := registry.LookupHTTP("app"); ok {
+		t.Fatalf("expected another token's tunnel to stop routing once reserved")
+	}
+	if rec := do(http.MethodPost, "/api/reservations/http", `{"Subdomain":"app"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected duplicate to conflict, got %d", rec.Code)
+	}
+
+	if err := registry.RegisterHTTP("t1", nil, tunnels.HTTPRegistration{Subdomain: "app"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	rec = do(http.MethodPatch, "/api/reservations/http/app", `{"Subdomain":"web"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rename: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var updated storage.HTTPReservation
+	if err := json.Unmarshal(rec.Body.Bytes(), &updated); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if updated.Subdomain != "web" || updated.OwnerTokenID != owner.ID {
+		t.Fatalf("unexpected rename response %+v", updated)
+	}
+	if _, ok := registry.LookupHTTP("app"); ok {
+		t.Fatalf("expected old subdomain to stop routing")
+	}
+
+	if rec := do(http.MethodPatch, "/api/reservations/http/web", `{"OwnerTokenID":0}`); rec.Code != http.StatusOK {
+		t.Fatalf("unassign: expected 200, got %d", rec.Code)
+	}
+	if res, _, _ := store.GetHTTPReservation("web"); res.OwnerTokenID != 0 {
+		t.Fatalf("expected reservation unowned, got %+v", res)
+	}
+	if rec := do(http.MethodDelete, "/api/reservations/http/web", ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete: expected 200, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/reservations/http/web", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected second delete to 404, got %d", rec.Code)
+	}
+}
+
+func TestTunnelAllowlistUpdatesLiveRoute(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "oncall", Role: storage.RoleOperator}, "operator"); err != nil {
+		t.Fatalf("create operator failed: %v", err)
+	}
+	if err := store.UpsertTunnel(storage.Tunnel{ID: "t1", Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 3000}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterHTTP("t1", nil, tunnels.HTTPRegistration{Subdomain: "app"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	handler := (&API{Store: store, Reg: registry}).Handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer operator")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/api/tunnels/t1/allowlist", `{"Server":["not-a-cidr"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid cidr rejected, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/api/tunnels/missing/allowlist", `{"Server":["10.0.0.0/8"]}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown tunnel to 404, got %d", rec.Code)
+	}
+	rec := do(http.MethodPut, "/api/tunnels/t1/allowlist", `{"Server":["198.51.100.0/24"],"Mode":"override"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("put allowlist: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	entry, _ := registry.LookupHTTP("app")
+	if entry.Allows("192.0.2.1:1234") || !entry.Allows("198.51.100.7:1234") {
+		t.Fatalf("expected live route to use the new allowlist, got %+v", entry)
+	}
+
+	rec = do(http.MethodGet, "/api/tunnels/t1/allowlist", "")
+	var got storage.TunnelAllowlist
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if got.Mode != "override" || len(got.Server) != 1 {
+		t.Fatalf("unexpected allowlist %+v", got)
+	}
+}
+
+func TestDenylistsAndBansEndpoints(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "oncall", Role: storage.RoleOperator}, "operator"); err != nil {
+		t.Fatalf("create operator failed: %v", err)
+	}
+	if err := store.UpsertTunnel(storage.Tunnel{ID: "t1", Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 3000}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+	gate, err := guard.New(store, guard.Policy{Strikes: 1, Window: time.Minute, BanFor: time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("new guard failed: %v", err)
+	}
+	handler := (&API{Store: store, Guard: gate}).Handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer operator")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/api/denylist", `{"CIDRs":["bogus"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid cidr rejected, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/api/denylist", `{"CIDRs":["203.0.113.0/24"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("put global denylist: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPut, "/api/tunnels/missing/denylist", `{"CIDRs":["198.51.100.0/24"]}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown tunnel to 404, got %d", rec.Code)
+	}
+	rec := do(http.MethodPut, "/api/tunnels/t1/denylist", `{"CIDRs":["198.51.100.0/24"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("put tunnel denylist: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if gate.Check("t1", "198.51.100.9:1") != guard.ReasonDenylist || gate.Check("t2", "203.0.113.9:1") != guard.ReasonDenylist {
+		t.Fatalf("expected deny lists applied to the guard")
+	}
+	var denylist storage.Denylist
+	if err := json.Unmarshal(do(http.MethodGet, "/api/tunnels/t1/denylist", "").Body.Bytes(), &denylist); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if denylist.TunnelID != "t1" || len(denylist.CIDRs) != 1 {
+		t.Fatalf("unexpected denylist %+v", denylist)
+	}
+
+	gate.Record("192.0.2.1:4000", guard.AuthFailure)
+	var bans []storage.Ban
+	if err := json.Unmarshal(do(http.MethodGet, "/api/bans", "").Body.Bytes(), &bans); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(bans) != 1 || bans[0].IP != "192.0.2.1" {
+		t.Fatalf("expected one ban listed, got %+v", bans)
+	}
+	if rec := do(http.MethodDelete, "/api/bans/192.0.2.1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("clear ban: expected 200, got %d", rec.Code)
+	}
+	if gate.Check("", "192.0.2.1:4000") != "" {
+		t.Fatalf("expected ban lifted")
+	}
+	if rec := do(http.MethodDelete, "/api/bans/192.0.2.1", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected cleared ban to 404, got %d", rec.Code)
+	}
+	entries, err := store.ListAudit(storage.AuditQuery{Action: storage.AuditBanClear})
+	if err != nil || len(entries) != 1 || entries[0].Target != "192.0.2.1" {
+		t.Fatalf("expected ban clear audited, got %+v (%v)", entries, err)
+	}
+}
+
+func TestTunnelRateLimitUpdatesLiveRoute(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateAdminToken(storage.AdminToken{Name: "oncall", Role: storage.RoleOperator}, "operator"); err != nil {
+		t.Fatalf("create operator failed: %v", err)
+	}
+	if err := store.UpsertTunnel(storage.Tunnel{ID: "t1", Protocol: "tcp", LocalHost: "127.0.0.1", LocalPort: 22}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+	if err := store.SetClientRateLimit("t1", storage.RateLimit{Rate: 50}); err != nil {
+		t.Fatalf("set client rate limit failed: %v", err)
+	}
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterTCP("t1", nil, tunnels.PortRegistration{ExternalPort: 2222, RateLimit: tunnels.RateLimit{Rate: 50}}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	handler := (&API{Store: store, Reg: registry}).Handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer operator")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/api/tunnels/t1/ratelimit", `{"PerIP":-1}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected negative limit rejected, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/api/tunnels/missing/ratelimit", `{"PerIP":1}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown tunnel to 404, got %d", rec.Code)
+	}
+	rec := do(http.MethodPut, "/api/tunnels/t1/ratelimit", `{"PerIP":1,"PerIPBurst":1}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("put rate limit: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	entry, _ := registry.LookupTCP(2222)
+	if ok, _ := entry.AllowRate("192.0.2.1:1000"); !ok {
+		t.Fatalf("expected first connection allowed")
+	}
+	if ok, _ := entry.AllowRate("192.0.2.1:1001"); ok {
+		t.Fatalf("expected live route to use the new per-IP limit")
+	}
+
+	var got storage.TunnelRateLimit
+	if err := json.Unmarshal(do(http.MethodGet, "/api/tunnels/t1/ratelimit", "").Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if got.Client.Rate != 50 || got.Server.PerIP != 1 || got.Server.PerIPBurst != 1 {
+		t.Fatalf("unexpected rate limits %+v", got)
+	}
+	if rec := do(http.MethodPut, "/api/tunnels/t1/ratelimit", `{}`); rec.Code != http.StatusOK {
+		t.Fatalf("clear rate limit: expected 200, got %d", rec.Code)
+	}
+	if got, _ := store.GetTunnelRateLimit("t1"); got.Server != (storage.RateLimit{}) || got.Client.Rate != 50 {
+		t.Fatalf("expected only the server limit cleared, got %+v", got)
 	}
 }
@@ -0,0 +1,183 @@
+package admin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+)
+
+const (
+	maxLogPage     = 1000
+	exportPageSize = 1000
+)
+
+// handleListLogs serves filtered, paginated logs. The cursor for the next page
+// is returned in the X-Next-Cursor header. format=csv or format=ndjson
+// streams every matching row (up to limit, when given) as a download instead.
+func (a *API) handleListLogs(w http.ResponseWriter, r *http.Request) {
+	if a.Store == nil {
+		http.Error(w, "store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	query, err := parseLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		query.Limit = min(parseLimit(r, 200), maxLogPage)
+		logs, next, err := a.Store.QueryLogs(query)
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to list logs", http.StatusInternalServerError)
+			return
+		}
+		if next != "" {
+			w.Header().Set("X-Next-Cursor", next)
+		}
+		if logs == nil {
+			logs = []storage.LogEntry{}
+		}
+		writeJSON(w, logs)
+	case "csv", "ndjson":
+		a.exportLogs(w, r, query, format)
+	default:
+		http.Error(w, "format must be json, csv or ndjson", http.StatusBadRequest)
+	}
+}
+
+func (a *API) exportLogs(w http.ResponseWriter, r *http.Request, query storage.LogQuery, format string) {
+	remaining := parseLimit(r, 0)
+	var write func(storage.LogEntry) error
+	var flush func()
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="logs.csv"`)
+		out := csv.NewWriter(w)
+		_ = out.Write([]string{"id", "timestamp", "tunnel_id", "kind", "remote_addr", "summary", "status", "bytes_in", "bytes_out"})
+		write = func(entry storage.LogEntry) error {
+			return out.Write([]string{
+				strconv.FormatInt(entry.ID, 10),
+				entry.Timestamp.UTC().Format(time.RFC3339),
+				entry.TunnelID,
+				entry.Kind,
+				entry.RemoteAddr,
+				entry.Summary,
+				strconv.Itoa(entry.Status),
+				strconv.FormatInt(entry.BytesIn, 10),
+				strconv.FormatInt(entry.BytesOut, 10),
+			})
+		}
+		flush = out.Flush
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="logs.ndjson"`)
+		enc := json.NewEncoder(w)
+		write = func(entry storage.LogEntry) error { return enc.Encode(entry) }
+		flush = func() {}
+	}
+	defer flush()
+
+	for {
+		query.Limit = exportPageSize
+		if remaining > 0 {
+			query.Limit = min(remaining, exportPageSize)
+		}
+		logs, next, err := a.Store.QueryLogs(query)
+		if err != nil {
+			// Headers are already sent; a truncated export is all we can do.
+			return
+		}
+		for _, entry := range logs {
+			if err := write(entry); err != nil {
+				return
+			}
+		}
+		if remaining > 0 {
+			remaining -= len(logs)
+			if remaining <= 0 {
+				return
+			}
+		}
+		if next == "" || r.Context().Err() != nil {
+			return
+		}
+		query.Cursor = next
+	}
+}
+
+// parseLogQuery reads the tunnel_id, kind, remote, status, since, until and
+// cursor parameters.
+func parseLogQuery(r *http.Request) (storage.LogQuery, error) {
+	params := r.URL.Query()
+	query := storage.LogQuery{
+		TunnelID:   params.Get("tunnel_id"),
+		Kind:       params.Get("kind"),
+		RemoteAddr: params.Get("remote"),
+		Cursor:     params.Get("cursor"),
+	}
+	switch query.Kind {
+	case "", "http", "tcp", "udp":
+	default:
+		return query, fmt.Errorf("kind must be http, tcp or udp")
+	}
+	if status := params.Get("status"); status != "" {
+		low, high, err := parseStatusRange(status)
+		if err != nil {
+			return query, err
+		}
+		query.StatusMin, query.StatusMax = low, high
+	}
+	for _, field := range []struct {
+		name   string
+		target *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		value := params.Get(field.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return query, fmt.Errorf("%s must be an RFC 3339 time", field.name)
+		}
+		*field.target = parsed
+	}
+	return query, nil
+}
+
+// parseStatusRange accepts "404", "4xx" or "400-499".
+func parseStatusRange(value string) (int, int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	invalid := fmt.Errorf("status must look like 404, 4xx or 400-499")
+	if len(value) == 3 && strings.HasSuffix(value, "xx") {
+		class, err := strconv.Atoi(value[:1])
+		if err != nil || class < 1 || class > 5 {
+			return 0, 0, invalid
+		}
+		return class * 100, class*100 + 99, nil
+	}
+	lowText, highText, isRange := strings.Cut(value, "-")
+	low, err := strconv.Atoi(lowText)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	high := low
+	if isRange {
+		if high, err = strconv.Atoi(highText); err != nil || high < low {
+			return 0, 0, invalid
+		}
+	}
+	return low, high, nil
+}
@@ -0,0 +1,33 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
+)
+
+// ProtectMetrics guards a scrape endpoint. With a token, scrapers must send it
+// as a bearer token. Without one, only addresses in an explicitly configured
+// admin allowlist may scrape; an empty allowlist keeps the endpoint closed.
+func (a *API) ProtectMetrics(token string, next http.Handler) http.Handler {
+	token = strings.TrimSpace(token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got := strings.TrimPrefix(strings.TrimSpace(r.Header.Get("Authorization")), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		parsed, err := tunnels.ParseAllowlistCSV(a.AdminAllowlist)
+		if err != nil || parsed.Any || !a.allowAdminIP(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
+)
+
+// handleTunnelRateLimit shows a tunnel's client and server rate limits and
+// replaces the server one; all zero values clear it. The stricter of the two
+// applies, and live routes pick up the change immediately.
+func (a *API) handleTunnelRateLimit(w http.ResponseWriter, r *http.Request, tunnelID string) {
+	before, err := a.Store.GetTunnelRateLimit(tunnelID)
+	if errors.Is(err, storage.ErrTunnelNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load rate limit", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, before)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	var payload tunnels.RateLimit
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if err := payload.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := a.Store.SetServerRateLimit(tunnelID, storage.RateLimit(payload))
+	if err != nil {
+		http.Error(w, "failed to update rate limit", http.StatusInternalServerError)
+		return
+	}
+	if a.Reg != nil {
+		a.Reg.SetServerRateLimit(tunnelID, payload)
+	}
+	a.audit(r, storage.AuditTunnelRateLimit, tunnelID, before, after)
+	writeJSON(w, after)
+}
@@ -0,0 +1,158 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+)
+
+// handleHTTPReservations lists subdomain reservations and pre-creates new
+// ones, optionally owned by a relay token. A live tunnel from another token on
+// a newly owned subdomain is closed so routing changes immediately.
+func (a *API) handleHTTPReservations(w http.ResponseWriter, r *http.Request) {
+	if a.Store == nil {
+		http.Error(w, "store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		reservations, err := a.Store.ListHTTPReservations()
+		if err != nil {
+			http.Error(w, "failed to list reservations", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, reservations)
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		var payload storage.HTTPReservation
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		created, err := a.Store.CreateHTTPReservation(storage.HTTPReservation{Subdomain: payload.Subdomain, OwnerTokenID: payload.OwnerTokenID})
+		if err != nil {
+			reservationError(w, err, "failed to create reservation")
+			return
+		}
+		if a.Reg != nil && created.OwnerTokenID != 0 {
+			if entry, ok := a.Reg.LookupHTTP(created.Subdomain); ok && entry.OwnerTokenID != created.OwnerTokenID {
+				a.releaseHTTPRoute(created.Subdomain, "reservation created")
+			}
+		}
+		a.audit(r, storage.AuditReservationCreate, created.Subdomain, nil, created)
+		writeJSON(w, created)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// reservationUpdate is a partial update; omitted fields keep their value and
+// an OwnerTokenID of 0 makes the reservation unowned.
+type reservationUpdate struct {
+	Subdomain    *string
+	OwnerTokenID *int64
+}
+
+// handleHTTPReservationAction serves PATCH /api/reservations/http/{subdomain}
+// to rename or reassign a reservation and DELETE to remove it. A live tunnel
+// on the old subdomain is closed so routing changes immediately.
+func (a *API) handleHTTPReservationAction(w http.ResponseWriter, r *http.Request) {
+	if a.Store == nil {
+		http.Error(w, "store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	subdomain := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/reservations/http/"), "/"))
+	if subdomain == "" {
+		http.Error(w, "subdomain required", http.StatusBadRequest)
+		return
+	}
+	before, ok, err := a.Store.GetHTTPReservation(subdomain)
+	if err != nil {
+		http.Error(w, "failed to load reservation", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		var payload reservationUpdate
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		next := before
+		if payload.Subdomain != nil {
+			next.Subdomain = *payload.Subdomain
+		}
+		if payload.OwnerTokenID != nil {
+			next.OwnerTokenID = *payload.OwnerTokenID
+		}
+		updated, err := a.Store.UpdateHTTPReservation(subdomain, next)
+		if err != nil {
+			reservationError(w, err, "failed to update reservation")
+			return
+		}
+		switch {
+		case updated.Subdomain != before.Subdomain:
+			a.releaseHTTPRoute(before.Subdomain, "reservation renamed to "+updated.Subdomain)
+		case updated.OwnerTokenID != before.OwnerTokenID:
+			a.releaseHTTPRoute(before.Subdomain, "reservation reassigned")
+		}
+		a.audit(r, storage.AuditReservationUpdate, before.Subdomain, before, updated)
+		writeJSON(w, updated)
+	case http.MethodDelete:
+		if err := a.Store.DeleteHTTPReservation(subdomain); err != nil {
+			reservationError(w, err, "failed to delete reservation")
+			return
+		}
+		a.releaseHTTPRoute(subdomain, "reservation deleted")
+		a.audit(r, storage.AuditReservationDelete, subdomain, before, nil)
+		writeJSON(w, map[string]string{"status": "deleted"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// releaseHTTPRoute stops routing subdomain. A live tunnel is closed so its
+// client learns why; otherwise the registry entry is dropped.
+func (a *API) releaseHTTPRoute(subdomain, reason string) {
+	if a.Reg == nil {
+		return
+	}
+	entry, ok := a.Reg.LookupHTTP(subdomain)
+	if !ok {
+		return
+	}
+	if a.Relay == nil || !a.Relay.CloseTunnel(entry.TunnelID, reason) {
+		a.Reg.RemoveHTTP(subdomain)
+	}
+}
+
+func reservationError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, storage.ErrInvalidSubdomain), errors.Is(err, storage.ErrUnknownOwner):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrReservationExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrReservationNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
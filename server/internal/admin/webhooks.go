@@ -0,0 +1,120 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+	"github.com/AidyyJ/PortOpener/server/internal/webhooks"
+)
+
+// handleWebhooks lists webhooks (without secrets) and creates new ones. The
+// signing secret is generated here and returned only once, on creation.
+func (a *API) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if a.Store == nil {
+		http.Error(w, "store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		hooks, err := a.Store.ListWebhooks()
+		if err != nil {
+			http.Error(w, "failed to list webhooks", http.StatusInternalServerError)
+			return
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		writeJSON(w, hooks)
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		var payload storage.Webhook
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		for _, event := range payload.Events {
+			if !isWebhookEvent(event) {
+				http.Error(w, "unknown webhook event "+strconv.Quote(event)+"; expected one of "+strings.Join(webhooks.Lifecycle, ", "), http.StatusBadRequest)
+				return
+			}
+		}
+		secret, err := storage.GenerateToken()
+		if err != nil {
+			http.Error(w, "secret generation failed", http.StatusInternalServerError)
+			return
+		}
+		payload.Secret = secret
+		created, err := a.Store.CreateWebhook(payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		created.Secret = ""
+		a.audit(r, storage.AuditWebhookCreate, strconv.FormatInt(created.ID, 10), nil, created)
+		writeJSON(w, map[string]any{"secret": secret, "info": created})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleWebhookAction serves DELETE /api/webhooks/{id} and
+// GET /api/webhooks/{id}/deliveries.
+func (a *API) handleWebhookAction(w http.ResponseWriter, r *http.Request) {
+	if a.Store == nil {
+		http.Error(w, "store not configured", http.StatusServiceUnavailable)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/webhooks/"), "/")
+	idText, action, _ := strings.Cut(path, "/")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "webhook id required", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Method == http.MethodDelete && action == "":
+		before, _, err := a.Store.GetWebhook(id)
+		if err != nil {
+			http.Error(w, "webhook delete failed", http.StatusInternalServerError)
+			return
+		}
+		before.Secret = ""
+		if err := a.Store.DeleteWebhook(id); err != nil {
+			if errors.Is(err, storage.ErrWebhookNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, "webhook delete failed", http.StatusInternalServerError)
+			return
+		}
+		a.audit(r, storage.AuditWebhookDelete, idText, before, nil)
+		writeJSON(w, map[string]string{"status": "deleted"})
+	case r.Method == http.MethodGet && action == "deliveries":
+		deliveries, err := a.Store.ListWebhookDeliveries(id, parseLimit(r, 200))
+		if err != nil {
+			http.Error(w, "failed to list deliveries", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, deliveries)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func isWebhookEvent(event string) bool {
+	for _, candidate := range webhooks.Lifecycle {
+		if strings.EqualFold(candidate, strings.TrimSpace(event)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver derives the real client address of a request. Forwarding headers
+// are only honored when the direct peer is one of the trusted proxies, so a
+// caller reaching the server directly cannot spoof its address.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver parses a comma-separated list of trusted proxy CIDRs. Bare IPs
+// are accepted as single-host networks. An empty list trusts no proxy.
+func NewResolver(values string) (*Resolver, error) {
+	resolver := &Resolver{}
+	for _, value := range strings.Split(values, ",") {
+		trimmed := strings.TrimSpace(value)
+		if trimmed == "" {
+			continue
+		}
+		if !strings.Contains(trimmed, "/") {
+			if ip := net.ParseIP(trimmed); ip != nil && ip.To4() != nil {
+				trimmed += "/32"
+			} else {
+				trimmed += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		resolver.trusted = append(resolver.trusted, network)
+	}
+	return resolver, nil
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	if r == nil || ip == nil {
+		return false
+	}
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the resolved client IP for the request. When the peer is
+// a trusted proxy, X-Forwarded-For is walked from the right, skipping trusted
+// hops, and X-Real-IP and Forwarded are used as fallbacks.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer := hostOnly(req.RemoteAddr)
+	if !r.isTrusted(net.ParseIP(peer)) {
+		return peer
+	}
+
+	if chain := headerChain(req.Header.Values("X-Forwarded-For")); len(chain) > 0 {
+		if ip := r.firstUntrusted(chain); ip != "" {
+			return ip
+		}
+	}
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); realIP != "" {
+		if ip := net.ParseIP(hostOnly(realIP)); ip != nil {
+			return ip.String()
+		}
+	}
+	if chain := forwardedChain(req.Header.Values("Forwarded")); len(chain) > 0 {
+		if ip := r.firstUntrusted(chain); ip != "" {
+			return ip
+		}
+	}
+	return peer
+}
+
+// forwardingHeaders are stripped from requests of untrusted peers so later
+// handlers can rely on whatever forwarding headers remain.
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-IP", "Forwarded"}
+
+// Middleware rewrites RemoteAddr to the resolved client IP so allowlists,
+// logs, metrics and relayed requests all see the same address.
+func (r *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.isTrusted(net.ParseIP(hostOnly(req.RemoteAddr))) {
+			for _, name := range forwardingHeaders {
+				req.Header.Del(name)
+			}
+		} else if ip := r.ClientIP(req); ip != "" && ip != hostOnly(req.RemoteAddr) {
+			req.RemoteAddr = ip
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (r *Resolver) firstUntrusted(chain []string) string {
+	var leftmost string
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hostOnly(chain[i]))
+		if ip == nil {
+			// An unparsable hop means the chain cannot be trusted beyond here.
+			return leftmost
+		}
+		leftmost = ip.String()
+		if !r.isTrusted(ip) {
+			return leftmost
+		}
+	}
+	return leftmost
+}
+
+func headerChain(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if trimmed := strings.TrimSpace(part); trimmed != "" {
+				chain = append(chain, trimmed)
+			}
+		}
+	}
+	return chain
+}
+
+// forwardedChain extracts the for= parameters of RFC 7239 Forwarded headers.
+func forwardedChain(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				val = strings.Trim(strings.TrimSpace(val), `"`)
+				chain = append(chain, val)
+			}
+		}
+	}
+	return chain
+}
+
+func hostOnly(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,93 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPIgnoresHeadersFromUntrustedPeer(t *testing.T) {
+	resolver, err := NewResolver("172.16.0.0/12")
+	if err != nil {
+		t.Fatalf("new resolver failed: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.7:4000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	if got := resolver.ClientIP(req); got != "198.51.100.7" {
+		t.Fatalf("expected peer address, got %s", got)
+	}
+}
+
+func TestClientIPWalksForwardedForFromTrustedPeer(t *testing.T) {
+	resolver, err := NewResolver("172.16.0.0/12,10.0.0.5")
+	if err != nil {
+		t.Fatalf("new resolver failed: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "172.18.0.3:4000"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.5, 10.0.0.5")
+	if got := resolver.ClientIP(req); got != "203.0.113.5" {
+		t.Fatalf("expected first untrusted hop, got %s", got)
+	}
+}
+
+func TestClientIPFallsBackToRealIPAndForwarded(t *testing.T) {
+	resolver, err := NewResolver("172.16.0.0/12")
+	if err != nil {
+		t.Fatalf("new resolver failed: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "172.18.0.3:4000"
+	req.Header.Set("X-Real-IP", "203.0.113.9")
+	if got := resolver.ClientIP(req); got != "203.0.113.9" {
+		t.Fatalf("expected X-Real-IP, got %s", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "172.18.0.3:4000"
+	req.Header.Set("Forwarded", `for="[2001:db8::1]:4711";proto=https`)
+	if got := resolver.ClientIP(req); got != "2001:db8::1" {
+		t.Fatalf("expected Forwarded for=, got %s", got)
+	}
+}
+
+func TestMiddlewareRewritesRemoteAddr(t *testing.T) {
+	resolver, err := NewResolver("172.16.0.0/12")
+	if err != nil {
+		t.Fatalf("new resolver failed: %v", err)
+	}
+	var seen string
+	handler := resolver.Middleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "172.18.0.3:4000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if seen != "203.0.113.5" {
+		t.Fatalf("expected rewritten remote addr, got %s", seen)
+	}
+}
+
+func TestMiddlewareStripsHeadersFromUntrustedPeer(t *testing.T) {
+	resolver, err := NewResolver("172.16.0.0/12")
+	if err != nil {
+		t.Fatalf("new resolver failed: %v", err)
+	}
+	var seen *http.Request
+	handler := resolver.Middleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		seen = r
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.7:4000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if seen.RemoteAddr != "198.51.100.7:4000" {
+		t.Fatalf("expected remote addr untouched, got %s", seen.RemoteAddr)
+	}
+	if seen.Header.Get("X-Forwarded-For") != "" || seen.Header.Get("X-Forwarded-Proto") != "" {
+		t.Fatalf("expected forwarding headers stripped")
+	}
+}
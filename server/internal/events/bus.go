@@ -0,0 +1,133 @@
+// Package events fans out live relay activity to admin subscribers.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types published by the relay, proxies and admin API.
+const (
+	TunnelConnected     = "tunnel_connected"
+	TunnelDisconnected  = "tunnel_disconnected"
+	TunnelClosed        = "tunnel_closed"
+	RegistrationFailed  = "registration_failed"
+	DomainStatusChanged = "domain_status_changed"
+	HTTPRequest         = "http_request"
+	TCPOpen             = "tcp_open"
+	TCPClose            = "tcp_close"
+	UDPSessionOpen      = "udp_session_open"
+	UDPSessionClose     = "udp_session_close"
+	TokenCreated        = "token_created"
+	TokenRevoked        = "token_revoked"
+	TokenRotated        = "token_rotated"
+	IPBanned            = "ip_banned"
+)
+
+// Event is one piece of live activity. Only the fields relevant to Type are
+// set.
+type Event struct {
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	TunnelID       string    `json:"tunnel_id,omitempty"`
+	ClientID       string    `json:"client_id,omitempty"`
+	Protocol       string    `json:"protocol,omitempty"`
+	RemoteAddr     string    `json:"remote_addr,omitempty"`
+	Method         string    `json:"method,omitempty"`
+	Path           string    `json:"path,omitempty"`
+	Status         int       `json:"status,omitempty"`
+	DurationMillis float64   `json:"duration_ms,omitempty"`
+	BytesIn        int64     `json:"bytes_in,omitempty"`
+	BytesOut       int64     `json:"bytes_out,omitempty"`
+	Subdomain      string    `json:"subdomain,omitempty"`
+	Port           int       `json:"port,omitempty"`
+	Domain         string    `json:"domain,omitempty"`
+	DomainStatus   string    `json:"domain_status,omitempty"`
+	PreviousStatus string    `json:"previous_status,omitempty"`
+	TokenID        int64     `json:"token_id,omitempty"`
+	TokenName      string    `json:"token_name,omitempty"`
+	Message        string    `json:"message,omitempty"`
+}
+
+// Bus delivers published events to every current subscriber. Publishing never
+// blocks: a subscriber that falls behind loses events and counts them.
+// A nil *Bus discards everything.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives events on C until Close is called.
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	bus     *Bus
+	types   map[string]bool
+	dropped atomic.Int64
+	once    sync.Once
+}
+
+// Subscribe registers a subscriber holding up to buffer undelivered events.
+func (b *Bus) Subscribe(buffer int) *Subscription {
+	return b.SubscribeTypes(buffer)
+}
+
+// SubscribeTypes registers a subscriber that is only sent events of the given
+// types, or every event when none are given. Filtering at publish time keeps
+// busy types such as http_request from crowding rare ones out of the buffer.
+func (b *Bus) SubscribeTypes(buffer int, types ...string) *Subscription {
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, bus: b}
+	if len(types) > 0 {
+		sub.types = make(map[string]bool, len(types))
+		for _, eventType := range types {
+			sub.types[eventType] = true
+		}
+	}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Close unsubscribes and closes C.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+		close(s.ch)
+	})
+}
+
+// Dropped is the number of events this subscriber missed.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Publish stamps ev with the current time if unset and delivers it.
+func (b *Bus) Publish(ev Event) {
+	if b == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if sub.types != nil && !sub.types[ev.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Package guard keeps abusive clients out: operator deny lists, plus
+// temporary bans earned by repeated 403s, failed relay authentications or
+// excessive request rates.
+package guard
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+)
+
+// Reasons returned by Check; they double as rejection metric reasons.
+const (
+	ReasonDenylist = "denylist"
+	ReasonBanned   = "banned"
+)
+
+// Offence is behaviour that counts towards a ban.
+type Offence string
+
+const (
+	// Forbidden is an HTTP request answered with 403.
+	Forbidden Offence = "forbidden"
+	// AuthFailure is a rejected relay handshake.
+	AuthFailure Offence = "auth_failure"
+	// Request is one HTTP request, TCP connection or new UDP session,
+	// counted against Policy.RequestLimit.
+	Request Offence = "request"
+)
+
+// Policy sets when an address is banned. Each offence is counted separately
+// in fixed windows of Window; a zero limit disables that trigger.
+type Policy struct {
+	// Strikes is how many 403s, or failed relay authentications, earn a ban.
+	Strikes int
+	// RequestLimit is how many requests, connections and UDP sessions earn a
+	// ban.
+	RequestLimit int
+	Window       time.Duration
+	// BanFor is how long a ban lasts.
+	BanFor time.Duration
+}
+
+// Guard decides whether a remote address may reach the relay or a tunnel.
+// Deny lists and bans are persisted in the store and cached here. A nil
+// *Guard allows everyone.
+type Guard struct {
+	store  *storage.Store
+	policy Policy
+	events *events.Bus
+
+	mu        sync.Mutex
+	global    []*net.IPNet
+	perTunnel map[string][]*net.IPNet
+	bans      map[string]time.Time
+	tallies   map[tallyKey]*tally
+	lastSweep time.Time
+}
+
+type tallyKey struct {
+	ip      string
+	offence Offence
+}
+
+type tally struct {
+	start time.Time
+	count int
+}
+
+// New loads deny lists and active bans from store, pruning expired bans.
+// store may be nil, in which case nothing is persisted.
+func New(store *storage.Store, policy Policy, bus *events.Bus) (*Guard, error) {
+	g := &Guard{
+		store:     store,
+		policy:    policy,
+		events:    bus,
+		perTunnel: make(map[string][]*net.IPNet),
+		bans:      make(map[string]time.Time),
+		tallies:   make(map[tallyKey]*tally),
+	}
+	if store == nil {
+		return g, nil
+	}
+	if _, err := store.DeleteExpiredBans(); err != nil {
+		return nil, err
+	}
+	bans, err := store.ListBans()
+	if err != nil {
+		return nil, err
+	}
+	for _, ban := range bans {
+		g.bans[ban.IP] = ban.ExpiresAt
+	}
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload re-reads every deny list from the store.
+func (g *Guard) Reload() error {
+	if g == nil || g.store == nil {
+		return nil
+	}
+	lists, err := g.store.ListDenylists()
+	if err != nil {
+		return err
+	}
+	perTunnel := make(map[string][]*net.IPNet, len(lists))
+	for tunnelID, cidrs := range lists {
+		nets, err := parseCIDRs(cidrs)
+		if err != nil {
+			return fmt.Errorf("denylist for %q: %w", tunnelID, err)
+		}
+		perTunnel[tunnelID] = nets
+	}
+	g.mu.Lock()
+	g.global = perTunnel[""]
+	delete(perTunnel, "")
+	g.perTunnel = perTunnel
+	g.mu.Unlock()
+	return nil
+}
+
+// Check reports why remoteAddr may not reach tunnelID, or "" if it may. An
+// empty tunnelID checks only the global deny list and bans, as the relay
+// endpoint does.
+func (g *Guard) Check(tunnelID, remoteAddr string) string {
+	if g == nil {
+		return ""
+	}
+	ip := parseIP(remoteAddr)
+	if ip == nil {
+		return ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until, ok := g.bans[ip.String()]; ok {
+		if time.Now().Before(until) {
+			return ReasonBanned
+		}
+		delete(g.bans, ip.String())
+	}
+	if contains(g.global, ip) || (tunnelID != "" && contains(g.perTunnel[tunnelID], ip)) {
+		return ReasonDenylist
+	}
+	return ""
+}
+
+// Record counts an offence by remoteAddr and bans it once the policy's limit
+// is reached within one window.
+func (g *Guard) Record(remoteAddr string, offence Offence) {
+	if g == nil {
+		return
+	}
+	limit := g.policy.Strikes
+	if offence == Request {
+		limit = g.policy.RequestLimit
+	}
+	if limit <= 0 || g.policy.Window <= 0 {
+		return
+	}
+	ip := parseIP(remoteAddr)
+	if ip == nil {
+		return
+	}
+	now := time.Now()
+	key := tallyKey{ip: ip.String(), offence: offence}
+
+	g.mu.Lock()
+	g.sweep(now)
+	t, ok := g.tallies[key]
+	if !ok || now.Sub(t.start) >= g.policy.Window {
+		t = &tally{start: now}
+		g.tallies[key] = t
+	}
+	t.count++
+	if t.count < limit {
+		g.mu.Unlock()
+		return
+	}
+	delete(g.tallies, key)
+	g.mu.Unlock()
+
+	g.ban(key.ip, fmt.Sprintf("%d %s within %s", t.count, offence, g.policy.Window), now)
+}
+
+func (g *Guard) ban(ip, reason string, now time.Time) {
+	until := now.Add(g.policy.BanFor)
+	g.mu.Lock()
+	g.bans[ip] = until
+	g.mu.Unlock()
+	log.Printf("banned %s until %s: %s", ip, until.UTC().Format(time.RFC3339), reason)
+	if g.store != nil {
+		if err := g.store.PutBan(storage.Ban{IP: ip, Reason: reason, CreatedAt: now, ExpiresAt: until}); err != nil {
+			log.Printf("ban persist failed: %v", err)
+		}
+	}
+	g.events.Publish(events.Event{Type: events.IPBanned, RemoteAddr: ip, Message: reason})
+}
+
+// Unban lifts a ban early and forgets the address's offences.
+func (g *Guard) Unban(ip string) error {
+	if g == nil {
+		return nil
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	g.mu.Lock()
+	_, banned := g.bans[ip]
+	delete(g.bans, ip)
+	for key := range g.tallies {
+		if key.ip == ip {
+			delete(g.tallies, key)
+		}
+	}
+	g.mu.Unlock()
+	if g.store == nil {
+		if !banned {
+			return storage.ErrBanNotFound
+		}
+		return nil
+	}
+	return g.store.DeleteBan(ip)
+}
+
+// sweep drops finished windows so tallies for one-off visitors do not
+// accumulate. Callers hold g.mu.
+func (g *Guard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.policy.Window {
+		return
+	}
+	g.lastSweep = now
+	for key, t := range g.tallies {
+		if now.Sub(t.start) >= g.policy.Window {
+			delete(g.tallies, key)
+		}
+	}
+	for ip, until := range g.bans {
+		if !now.Before(until) {
+			delete(g.bans, ip)
+		}
+	}
+}
+
+func parseIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, network := range nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package guard
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+	"github.com/AidyyJ/PortOpener/server/internal/storage/storagetest"
+)
+
+func TestGuardBansRepeatOffendersAcrossRestarts(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	policy := Policy{Strikes: 3, Window: time.Minute, BanFor: time.Hour}
+	g, err := New(store, policy, nil)
+	if err != nil {
+		t.Fatalf("new guard failed: %v", err)
+	}
+
+	g.Record("192.0.2.1:4000", Forbidden)
+	g.Record("192.0.2.1:4001", AuthFailure)
+	g.Record("192.0.2.1:4002", Forbidden)
+	if reason := g.Check("t1", "192.0.2.1:5000"); reason != "" {
+		t.Fatalf("expected offences counted separately, got %q", reason)
+	}
+	g.Record("192.0.2.1:4003", Forbidden)
+	if reason := g.Check("t1", "192.0.2.1:5000"); reason != ReasonBanned {
+		t.Fatalf("expected ban after 3 strikes, got %q", reason)
+	}
+	if reason := g.Check("t1", "192.0.2.2:5000"); reason != "" {
+		t.Fatalf("expected other addresses unaffected, got %q", reason)
+	}
+
+	restarted, err := New(store, policy, nil)
+	if err != nil {
+		t.Fatalf("reload guard failed: %v", err)
+	}
+	if reason := restarted.Check("", "192.0.2.1:5000"); reason != ReasonBanned {
+		t.Fatalf("expected ban to survive a restart, got %q", reason)
+	}
+	if err := restarted.Unban("192.0.2.1"); err != nil {
+		t.Fatalf("unban failed: %v", err)
+	}
+	if reason := restarted.Check("", "192.0.2.1:5000"); reason != "" {
+		t.Fatalf("expected ban lifted, got %q", reason)
+	}
+	if err := restarted.Unban("192.0.2.1"); !errors.Is(err, storage.ErrBanNotFound) {
+		t.Fatalf("expected ErrBanNotFound, got %v", err)
+	}
+}
+
+func TestGuardRequestLimit(t *testing.T) {
+	g, err := New(nil, Policy{RequestLimit: 2, Window: time.Minute, BanFor: time.Minute}, nil)
+	if err != nil {
+		t.Fatalf("new guard failed: %v", err)
+	}
+	g.Record("[2001:db8::1]:80", Request)
+	g.Record("[2001:db8::1]:81", Forbidden)
+	if reason := g.Check("", "[2001:db8::1]:80"); reason != "" {
+		t.Fatalf("expected strikes disabled, got %q", reason)
+	}
+	g.Record("[2001:db8::1]:82", Request)
+	if reason := g.Check("", "[2001:db8::1]:80"); reason != ReasonBanned {
+		t.Fatalf("expected ban after request limit, got %q", reason)
+	}
+}
+
+func TestGuardDenylists(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if err := store.UpsertTunnel(storage.Tunnel{ID: "t1", Protocol: "tcp", LocalHost: "127.0.0.1", LocalPort: 22}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+	g, err := New(store, Policy{}, nil)
+	if err != nil {
+		t.Fatalf("new guard failed: %v", err)
+	}
+	if _, err := store.SetDenylist("", []string{"203.0.113.0/24"}); err != nil {
+		t.Fatalf("set global denylist failed: %v", err)
+	}
+	if _, err := store.SetDenylist("t1", []string{"198.51.100.7/24"}); err != nil {
+		t.Fatalf("set tunnel denylist failed: %v", err)
+	}
+	if _, err := store.SetDenylist("missing", []string{"198.51.100.0/24"}); !errors.Is(err, storage.ErrTunnelNotFound) {
+		t.Fatalf("expected ErrTunnelNotFound, got %v", err)
+	}
+	if err := g.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	cases := []struct {
+		tunnelID, remote, want string
+	}{
+		{"", "203.0.113.9:1000", ReasonDenylist},
+		{"t2", "203.0.113.9:1000", ReasonDenylist},
+		{"t1", "198.51.100.20:1000", ReasonDenylist},
+		{"t2", "198.51.100.20:1000", ""},
+		{"", "198.51.100.20:1000", ""},
+	}
+	for _, tc := range cases {
+		if got := g.Check(tc.tunnelID, tc.remote); got != tc.want {
+			t.Fatalf("Check(%q, %q) = %q, want %q", tc.tunnelID, tc.remote, got, tc.want)
+		}
+	}
+}
@@ -9,6 +9,19 @@ type Counters struct {
 	Requests int64
 	BytesIn  int64
 	BytesOut int64
+	// TCPConnections is the number of TCP connections currently open.
+	TCPConnections int64
+	// Statuses counts HTTP responses by status code.
+	Statuses map[int]int64
+	// Rejected counts connections, requests and datagrams refused before
+	// reaching the client.
+	Rejected map[Rejection]int64
+}
+
+// Rejection labels refused traffic by protocol and the rule that refused it.
+type Rejection struct {
+	Protocol string
+	Reason   string
 }
 
 type Collector struct {
@@ -33,11 +46,67 @@ func (c *Collector) Add(tunnelID string, reqs, bytesIn, bytesOut int64) {
 	c.byTunnel[tunnelID] = entry
 }
 
+// AddStatus counts one HTTP response with status for the tunnel.
+func (c *Collector) AddStatus(tunnelID string, status int) {
+	if tunnelID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.byTunnel[tunnelID]
+	if entry.Statuses == nil {
+		entry.Statuses = make(map[int]int64)
+	}
+	entry.Statuses[status]++
+	c.byTunnel[tunnelID] = entry
+}
+
+// TrackTCP adjusts the tunnel's open TCP connection count by delta.
+func (c *Collector) TrackTCP(tunnelID string, delta int64) {
+	if tunnelID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.byTunnel[tunnelID]
+	entry.TCPConnections += delta
+	c.byTunnel[tunnelID] = entry
+}
+
+// AddRejected counts one connection, request or datagram refused for reason.
+func (c *Collector) AddRejected(tunnelID, protocol, reason string) {
+	if tunnelID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.byTunnel[tunnelID]
+	if entry.Rejected == nil {
+		entry.Rejected = make(map[Rejection]int64)
+	}
+	entry.Rejected[Rejection{Protocol: protocol, Reason: reason}]++
+	c.byTunnel[tunnelID] = entry
+}
+
 func (c *Collector) Snapshot() map[string]Counters {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	snap := make(map[string]Counters, len(c.byTunnel))
 	for k, v := range c.byTunnel {
+		if v.Statuses != nil {
+			statuses := make(map[int]int64, len(v.Statuses))
+			for code, count := range v.Statuses {
+				statuses[code] = count
+			}
+			v.Statuses = statuses
+		}
+		if v.Rejected != nil {
+			rejected := make(map[Rejection]int64, len(v.Rejected))
+			for key, count := range v.Rejected {
+				rejected[key] = count
+			}
+			v.Rejected = rejected
+		}
 		snap[k] = v
 	}
 	return snap
@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SessionSample is one connected relay client as reported to Prometheus.
+type SessionSample struct {
+	ClientID string
+	RTT      time.Duration
+}
+
+// WriterSample is the batched log writer's record counters.
+type WriterSample struct {
+	Queued  int64
+	Dropped int64
+	Written int64
+	Failed  int64
+}
+
+// Exporter serves the collector, relay session state and Go runtime stats in
+// the Prometheus text exposition format.
+type Exporter struct {
+	Collector *Collector
+	// Sessions lists connected relay clients. Optional.
+	Sessions func() []SessionSample
+	// UDPSessions counts active UDP sessions per tunnel ID. Optional.
+	UDPSessions func() map[string]int
+	// Writer reports the batched log writer's counters. Optional.
+	Writer func() WriterSample
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.Write(w)
+}
+
+// Write renders every metric family to w.
+func (e *Exporter) Write(w io.Writer) {
+	var snap map[string]Counters
+	if e.Collector != nil {
+		snap = e.Collector.Snapshot()
+	}
+	tunnelIDs := make([]string, 0, len(snap))
+	for id := range snap {
+		tunnelIDs = append(tunnelIDs, id)
+	}
+	sort.Strings(tunnelIDs)
+
+	family(w, "portopener_tunnel_requests_total", "counter", "HTTP requests proxied per tunnel.")
+	for _, id := range tunnelIDs {
+		sample(w, "portopener_tunnel_requests_total", labels("tunnel_id", id), float64(snap[id].Requests))
+	}
+	family(w, "portopener_tunnel_bytes_in_total", "counter", "Bytes received from the public side per tunnel.")
+	for _, id := range tunnelIDs {
+		sample(w, "portopener_tunnel_bytes_in_total", labels("tunnel_id", id), float64(snap[id].BytesIn))
+	}
+	family(w, "portopener_tunnel_bytes_out_total", "counter", "Bytes sent to the public side per tunnel.")
+	for _, id := range tunnelIDs {
+		sample(w, "portopener_tunnel_bytes_out_total", labels("tunnel_id", id), float64(snap[id].BytesOut))
+	}
+	family(w, "portopener_tunnel_http_responses_total", "counter", "HTTP responses per tunnel and status code.")
+	for _, id := range tunnelIDs {
+		codes := make([]int, 0, len(snap[id].Statuses))
+		for code := range snap[id].Statuses {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			sample(w, "portopener_tunnel_http_responses_total", labels("tunnel_id", id, "code", strconv.Itoa(code)), float64(snap[id].Statuses[code]))
+		}
+	}
+	family(w, "portopener_tunnel_rejected_total", "counter", "Traffic refused per tunnel, by protocol and reason.")
+	for _, id := range tunnelIDs {
+		keys := make([]Rejection, 0, len(snap[id].Rejected))
+		for key := range snap[id].Rejected {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].Protocol != keys[j].Protocol {
+				return keys[i].Protocol < keys[j].Protocol
+			}
+			return keys[i].Reason < keys[j].Reason
+		})
+		for _, key := range keys {
+			sample(w, "portopener_tunnel_rejected_total", labels("tunnel_id", id, "protocol", key.Protocol, "reason", key.Reason), float64(snap[id].Rejected[key]))
+		}
+	}
+	family(w, "portopener_tunnel_tcp_connections", "gauge", "Open TCP connections per tunnel.")
+	for _, id := range tunnelIDs {
+		sample(w, "portopener_tunnel_tcp_connections", labels("tunnel_id", id), float64(snap[id].TCPConnections))
+	}
+
+	if e.UDPSessions != nil {
+		counts := e.UDPSessions()
+		ids := make([]string, 0, len(counts))
+		for id := range counts {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		family(w, "portopener_tunnel_udp_sessions", "gauge", "Active UDP sessions per tunnel.")
+		for _, id := range ids {
+			sample(w, "portopener_tunnel_udp_sessions", labels("tunnel_id", id), float64(counts[id]))
+		}
+	}
+
+	if e.Sessions != nil {
+		sessions := e.Sessions()
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].ClientID < sessions[j].ClientID })
+		family(w, "portopener_relay_sessions", "gauge", "Connected relay sessions.")
+		sample(w, "portopener_relay_sessions", "", float64(len(sessions)))
+		family(w, "portopener_relay_rtt_seconds", "gauge", "Last heartbeat round-trip time per relay client.")
+		for _, session := range sessions {
+			sample(w, "portopener_relay_rtt_seconds", labels("client_id", session.ClientID), session.RTT.Seconds())
+		}
+	}
+
+	if e.Writer != nil {
+		stats := e.Writer()
+		family(w, "portopener_writer_records_total", "counter", "Log and metric records handled by the batched writer, by result.")
+		sample(w, "portopener_writer_records_total", labels("result", "queued"), float64(stats.Queued))
+		sample(w, "portopener_writer_records_total", labels("result", "dropped"), float64(stats.Dropped))
+		sample(w, "portopener_writer_records_total", labels("result", "written"), float64(stats.Written))
+		sample(w, "portopener_writer_records_total", labels("result", "failed"), float64(stats.Failed))
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	family(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	sample(w, "go_goroutines", "", float64(runtime.NumGoroutine()))
+	family(w, "go_info", "gauge", "Information about the Go environment.")
+	sample(w, "go_info", labels("version", runtime.Version()), 1)
+	family(w, "go_memstats_heap_alloc_bytes", "gauge", "Heap bytes allocated and still in use.")
+	sample(w, "go_memstats_heap_alloc_bytes", "", float64(mem.HeapAlloc))
+	family(w, "go_memstats_sys_bytes", "gauge", "Bytes obtained from the system.")
+	sample(w, "go_memstats_sys_bytes", "", float64(mem.Sys))
+	family(w, "go_memstats_gc_cycles_total", "counter", "Completed GC cycles.")
+	sample(w, "go_memstats_gc_cycles_total", "", float64(mem.NumGC))
+}
+
+func family(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sample(w io.Writer, name, labelSet string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labelSet, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// labels renders alternating name/value pairs as a Prometheus label set.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -5,22 +5,36 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/AidyyJ/PortOpener/internal/httpbridge"
 	"github.com/AidyyJ/PortOpener/internal/relay"
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/guard"
 	"github.com/AidyyJ/PortOpener/server/internal/metrics"
 	"github.com/AidyyJ/PortOpener/server/internal/storage"
 	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
 	"github.com/coder/websocket"
 )
 
+// reconnectRetryAfter is the Retry-After sent, in seconds, when a tunnel's
+// client did not reconnect within the grace period.
+const reconnectRetryAfter = "5"
+
 type HTTPProxy struct {
 	Registry *tunnels.Registry
 	Metrics  *metrics.Collector
 	Logs     *metrics.Logger
 	Store    *storage.Store
+	// Recorder receives access logs and metrics; Store is used when unset.
+	Recorder storage.Recorder
+	// Events, when set, receives one event per proxied request.
+	Events *events.Bus
+	// Guard, when set, turns away denied and banned addresses and counts
+	// requests and 403s towards bans.
+	Guard *guard.Guard
 }
 
 func (p *HTTPProxy) Handler() http.HandlerFunc {
@@ -70,49 +84,94 @@ func (p *HTTPProxy) Handler() http.HandlerFunc {
 			}
 		}
 
-		allow, err := tunnels.ParseAllowlist(entry.Allowlist)
-		if err != nil || !allow.Allows(r.RemoteAddr) {
+		if reason := p.Guard.Check(entry.TunnelID, r.RemoteAddr); reason != "" {
+			if p.Metrics != nil {
+				p.Metrics.AddRejected(entry.TunnelID, "http", reason)
+			}
 			http.Error(w, "forbidden", http.StatusForbidden)
 			return
 		}
+		p.Guard.Record(r.RemoteAddr, guard.Request)
+		if !entry.Allows(r.RemoteAddr) {
+			if p.Metrics != nil {
+				p.Metrics.AddRejected(entry.TunnelID, "http", "allowlist")
+			}
+			p.Guard.Record(r.RemoteAddr, guard.Forbidden)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if ok, wait := entry.AllowRate(r.RemoteAddr); !ok {
+			if p.Metrics != nil {
+				p.Metrics.AddRejected(entry.TunnelID, "http", "rate_limit")
+			}
+			w.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		if entry.Reconnecting() {
+			entry, ok = p.Registry.AwaitHTTP(r.Context(), entry)
+			if !ok {
+				w.Header().Set("Retry-After", reconnectRetryAfter)
+				p.relayError(w, r, entry.TunnelID, http.StatusServiceUnavailable, "tunnel reconnecting")
+				return
+			}
+		}
 
 		if entry.Session == nil {
-			http.Error(w, "tunnel unavailable", http.StatusServiceUnavailable)
+			p.relayError(w, r, entry.TunnelID, http.StatusServiceUnavailable, "tunnel unavailable")
 			return
 		}
 
+		started := time.Now()
 		stream, err := entry.Session.OpenStream()
 		if err != nil {
-			http.Error(w, "relay unavailable", http.StatusBadGateway)
+			p.relayError(w, r, entry.TunnelID, http.StatusBadGateway, "relay unavailable")
 			return
 		}
 		defer stream.Close()
 
-		reqFrame, body, err := httpbridge.EncodeRequest(r)
-		if err != nil {
-			http.Error(w, "encode request failed", http.StatusBadRequest)
+		if err := relay.WriteJSON(stream, relay.ControlMessage{Type: "stream_open", TunnelID: entry.TunnelID, Protocol: "http"}); err != nil {
+			log.Printf("relay write stream header failed: %v", err)
+			p.relayError(w, r, entry.TunnelID, http.StatusBadGateway, "relay failed")
 			return
 		}
 
+		reqFrame := httpbridge.EncodeRequest(r)
 		if err := relay.WriteJSON(stream, reqFrame); err != nil {
 			log.Printf("relay write request failed: %v", err)
-			http.Error(w, "relay failed", http.StatusBadGateway)
+			p.relayError(w, r, entry.TunnelID, http.StatusBadGateway, "relay failed")
 			return
 		}
-		if !reqFrame.IsWebSocket {
-			if err := relay.WriteFrame(stream, body); err != nil {
-				log.Printf("relay write body failed: %v", err)
-				http.Error(w, "relay failed", http.StatusBadGateway)
-				return
-			}
+
+		// The body is written while the response is read: the local service
+		// may answer before reading all of it, as with a 413 or 401 on a large
+		// upload, and the client then stops reading. Closing the stream ends
+		// such a write; it is waited for so r.Body is not read after return.
+		var bytesIn int64
+		var bodyErr error
+		bodyDone := make(chan struct{})
+		if reqFrame.IsWebSocket {
+			close(bodyDone)
+		} else {
+			go func() {
+				defer close(bodyDone)
+				bytesIn, bodyErr = httpbridge.WriteBody(stream, r.Body)
+			}()
 		}
+		defer func() {
+			_ = stream.Close()
+			<-bodyDone
+		}()
 
 		var respFrame relay.HTTPResponse
 		if err := relay.ReadJSON(stream, &respFrame); err != nil {
 			log.Printf("relay read response failed: %v", err)
-			http.Error(w, "relay failed", http.StatusBadGateway)
+			p.relayError(w, r, entry.TunnelID, http.StatusBadGateway, "relay failed")
 			return
 		}
+		edge := time.Since(started)
 		if reqFrame.IsWebSocket {
 			if err := proxyWebSocket(w, r, respFrame, stream); err != nil {
 				log.Printf("websocket proxy failed: %v", err)
@@ -120,26 +179,29 @@ func (p *HTTPProxy) Handler() http.HandlerFunc {
 			return
 		}
 
-		respBody, err := relay.ReadFrame(stream)
-		if err != nil {
-			log.Printf("relay read body failed: %v", err)
-			http.Error(w, "relay failed", http.StatusBadGateway)
-			return
-		}
-
-		resp := httpbridge.DecodeResponse(respFrame, respBody)
+		resp := httpbridge.DecodeResponse(respFrame, relay.NewFrameReader(stream))
 		for key, values := range resp.Header {
 			for _, value := range values {
 				w.Header().Add(key, value)
 			}
 		}
 		w.WriteHeader(resp.StatusCode)
-		_, _ = w.Write(respBody)
+		bytesOut, err := io.Copy(newFlushWriter(w), resp.Body)
+		if err != nil {
+			log.Printf("relay read body failed: %v", err)
+		}
+		_ = stream.Close()
+		<-bodyDone
+		if bodyErr != nil {
+			log.Printf("relay write body ended early: %v", bodyErr)
+		}
 
-		bytesIn := int64(len(body))
-		bytesOut := int64(len(respBody))
+		if resp.StatusCode == http.StatusForbidden {
+			p.Guard.Record(r.RemoteAddr, guard.Forbidden)
+		}
 		if p.Metrics != nil {
 			p.Metrics.Add(entry.TunnelID, 1, bytesIn, bytesOut)
+			p.Metrics.AddStatus(entry.TunnelID, resp.StatusCode)
 		}
 		if p.Logs != nil {
 			p.Logs.Add(metrics.LogEntry{
@@ -153,8 +215,20 @@ func (p *HTTPProxy) Handler() http.HandlerFunc {
 				BytesOut:   bytesOut,
 			})
 		}
-		if p.Store != nil {
-			_ = p.Store.InsertLog(storage.LogEntry{
+		p.Events.Publish(events.Event{
+			Type:           events.HTTPRequest,
+			TunnelID:       entry.TunnelID,
+			Protocol:       "http",
+			RemoteAddr:     r.RemoteAddr,
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			Status:         resp.StatusCode,
+			DurationMillis: float64(time.Since(started)) / float64(time.Millisecond),
+			BytesIn:        bytesIn,
+			BytesOut:       bytesOut,
+		})
+		if rec := p.recorder(); rec != nil {
+			_ = rec.InsertLog(storage.LogEntry{
 				TunnelID:   entry.TunnelID,
 				Timestamp:  time.Now().UTC(),
 				Kind:       "http",
@@ -164,11 +238,87 @@ func (p *HTTPProxy) Handler() http.HandlerFunc {
 				BytesIn:    bytesIn,
 				BytesOut:   bytesOut,
 			})
-			_ = p.Store.AddMetric(entry.TunnelID, time.Now().UTC(), 1, 0, bytesIn, bytesOut)
+			_ = rec.AddHTTPMetric(entry.TunnelID, time.Now().UTC(), storage.HTTPSample{
+				Status:   resp.StatusCode,
+				BytesIn:  bytesIn,
+				BytesOut: bytesOut,
+				Edge:     edge,
+				Upstream: time.Duration(respFrame.UpstreamMillis * float64(time.Millisecond)),
+			})
 		}
 	}
 }
 
+// retryAfter renders a wait as whole seconds for a Retry-After header,
+// rounding up so callers do not retry too early.
+func retryAfter(wait time.Duration) string {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+func (p *HTTPProxy) recorder() storage.Recorder {
+	return recorderFor(p.Recorder, p.Store)
+}
+
+// recorderFor prefers rec and falls back to writing straight to store.
+func recorderFor(rec storage.Recorder, store *storage.Store) storage.Recorder {
+	if rec != nil {
+		return rec
+	}
+	if store != nil {
+		return store
+	}
+	return nil
+}
+
+// relayError answers a request the tunnel could not serve and counts it as a
+// relay error rather than an application response.
+func (p *HTTPProxy) relayError(w http.ResponseWriter, r *http.Request, tunnelID string, status int, message string) {
+	http.Error(w, message, status)
+	p.Events.Publish(events.Event{
+		Type:       events.HTTPRequest,
+		TunnelID:   tunnelID,
+		Protocol:   "http",
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     status,
+		Message:    message,
+	})
+	if p.Metrics != nil {
+		p.Metrics.AddStatus(tunnelID, status)
+	}
+	if rec := p.recorder(); rec != nil {
+		_ = rec.AddHTTPMetric(tunnelID, time.Now().UTC(), storage.HTTPSample{Status: status, RelayError: true})
+	}
+}
+
+// flushWriter flushes after every write so streamed responses such as
+// Server-Sent Events reach the caller as soon as each frame arrives.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) io.Writer {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return w
+	}
+	return &flushWriter{w: w, flusher: flusher}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if n > 0 {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
 func proxyWebSocket(w http.ResponseWriter, r *http.Request, resp relay.HTTPResponse, stream io.ReadWriter) error {
 	if resp.Status != http.StatusSwitchingProtocols {
 		w.WriteHeader(resp.Status)
@@ -0,0 +1,258 @@
+package relayserver
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/internal/httpbridge"
+	"github.com/AidyyJ/PortOpener/internal/relay"
+	"github.com/AidyyJ/PortOpener/server/internal/guard"
+	"github.com/AidyyJ/PortOpener/server/internal/metrics"
+	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
+	"github.com/hashicorp/yamux"
+)
+
+func newSessionPair(t *testing.T) (*yamux.Session, *yamux.Session) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	serverSession, err := yamux.Server(serverConn, nil)
+	if err != nil {
+		t.Fatalf("yamux server failed: %v", err)
+	}
+	clientSession, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatalf("yamux client failed: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = clientSession.Close()
+		_ = serverSession.Close()
+	})
+	return serverSession, clientSession
+}
+
+func TestHTTPProxyStreamsLargeBodies(t *testing.T) {
+	serverSession, clientSession := newSessionPair(t)
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterHTTP("t1", serverSession, tunnels.HTTPRegistration{Subdomain: "app"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	const size = 17 * 1024 * 1024
+	go func() {
+		stream, err := clientSession.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		var header relay.ControlMessage
+		if err := relay.ReadJSON(stream, &header); err != nil {
+			return
+		}
+		var req relay.HTTPRequest
+		if err := relay.ReadJSON(stream, &req); err != nil {
+			return
+		}
+		received, err := io.Copy(io.Discard, relay.NewFrameReader(stream))
+		if err != nil {
+			return
+		}
+		_ = relay.WriteJSON(stream, relay.HTTPResponse{Status: http.StatusOK, Header: http.Header{"X-Received": {strconv.FormatInt(received, 10)}}})
+		_, _ = httpbridge.WriteBody(stream, bytes.NewReader(make([]byte, size)))
+	}()
+
+	proxy := &HTTPProxy{Registry: registry}
+	req := httptest.NewRequest(http.MethodPost, "http://app.example.com/upload", bytes.NewReader(make([]byte, size)))
+	rec := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Received"); got != strconv.Itoa(size) {
+		t.Fatalf("expected local side to receive %d bytes, got %s", size, got)
+	}
+	if rec.Body.Len() != size {
+		t.Fatalf("expected %d response bytes, got %d", size, rec.Body.Len())
+	}
+}
+
+func TestHTTPProxyRelaysEarlyResponseToLargeUpload(t *testing.T) {
+	serverSession, clientSession := newSessionPair(t)
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterHTTP("t1", serverSession, tunnels.HTTPRegistration{Subdomain: "app"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	// The local side answers without reading the body and keeps the stream
+	// open, as a service rejecting an upload would.
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		stream, err := clientSession.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		var header relay.ControlMessage
+		var req relay.HTTPRequest
+		if relay.ReadJSON(stream, &header) != nil || relay.ReadJSON(stream, &req) != nil {
+			return
+		}
+		_ = relay.WriteJSON(stream, relay.HTTPResponse{Status: http.StatusRequestEntityTooLarge})
+		_, _ = httpbridge.WriteBody(stream, strings.NewReader("too large"))
+		<-release
+	}()
+
+	proxy := &HTTPProxy{Registry: registry}
+	rec := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		req := httptest.NewRequest(http.MethodPost, "http://app.example.com/upload", bytes.NewReader(make([]byte, 8*1024*1024)))
+		proxy.Handler().ServeHTTP(rec, req)
+	}()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("proxy blocked writing a body the local side never read")
+	}
+	if rec.Code != http.StatusRequestEntityTooLarge || rec.Body.String() != "too large" {
+		t.Fatalf("expected the local 413, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHTTPProxyHoldsRequestsWhileTunnelReconnects(t *testing.T) {
+	oldSession, _ := newSessionPair(t)
+	newServer, newClient := newSessionPair(t)
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterHTTP("t1", oldSession, tunnels.HTTPRegistration{Subdomain: "app"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if !registry.SuspendHTTP("app", oldSession, 5*time.Second) {
+		t.Fatalf("expected tunnel suspended")
+	}
+
+	go func() {
+		stream, err := newClient.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		var header relay.ControlMessage
+		var req relay.HTTPRequest
+		if relay.ReadJSON(stream, &header) != nil || relay.ReadJSON(stream, &req) != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, relay.NewFrameReader(stream))
+		_ = relay.WriteJSON(stream, relay.HTTPResponse{Status: http.StatusOK})
+		_, _ = httpbridge.WriteBody(stream, strings.NewReader("resumed"))
+	}()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = registry.RegisterHTTP("t1", newServer, tunnels.HTTPRegistration{Subdomain: "app"})
+	}()
+
+	proxy := &HTTPProxy{Registry: registry}
+	rec := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "resumed" {
+		t.Fatalf("expected request served after reconnect, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHTTPProxyReturns503AfterGraceExpires(t *testing.T) {
+	oldSession, _ := newSessionPair(t)
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterHTTP("t1", oldSession, tunnels.HTTPRegistration{Subdomain: "app"}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	registry.SuspendHTTP("app", oldSession, 50*time.Millisecond)
+
+	proxy := &HTTPProxy{Registry: registry}
+	rec := httptest.NewRecorder()
+	proxy.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d %v", rec.Code, rec.Header())
+	}
+	if _, ok := registry.LookupHTTP("app"); ok {
+		t.Fatalf("expected placeholder removed after grace")
+	}
+}
+
+func TestHTTPProxyBansRepeatedForbiddenRequests(t *testing.T) {
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterHTTP("t1", nil, tunnels.HTTPRegistration{Subdomain: "app", Allowlist: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	gate, err := guard.New(nil, guard.Policy{Strikes: 2, Window: time.Minute, BanFor: time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("new guard failed: %v", err)
+	}
+	collector := metrics.New()
+	proxy := &HTTPProxy{Registry: registry, Metrics: collector, Guard: gate}
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:4000"
+		rec := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("request %d: expected 403, got %d", i, rec.Code)
+		}
+	}
+	rejected := collector.Snapshot()["t1"].Rejected
+	if rejected[metrics.Rejection{Protocol: "http", Reason: "allowlist"}] != 2 || rejected[metrics.Rejection{Protocol: "http", Reason: guard.ReasonBanned}] != 1 {
+		t.Fatalf("expected 2 allowlist rejections then a ban, got %+v", rejected)
+	}
+
+	// A banned address cannot reach the relay endpoint either.
+	srv := New(Config{Token: "secret", Guard: gate}, registry, nil)
+	req := httptest.NewRequest(http.MethodGet, "/relay", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected banned relay connection refused, got %d", rec.Code)
+	}
+}
+
+func TestHTTPProxyRateLimitReturns429(t *testing.T) {
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterHTTP("t1", nil, tunnels.HTTPRegistration{Subdomain: "app", RateLimit: tunnels.RateLimit{PerIP: 0.5, PerIPBurst: 1}}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	collector := metrics.New()
+	proxy := &HTTPProxy{Registry: registry, Metrics: collector}
+	send := func(remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		proxy.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The tunnel has no session, so an admitted request fails with 503.
+	if rec := send("192.0.2.1:4000"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected first request admitted, got %d", rec.Code)
+	}
+	rec := send("192.0.2.1:4001")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After 2, got %q", got)
+	}
+	if rec := send("192.0.2.2:4000"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected other addresses unaffected, got %d", rec.Code)
+	}
+	if got := collector.Snapshot()["t1"].Rejected[metrics.Rejection{Protocol: "http", Reason: "rate_limit"}]; got != 1 {
+		t.Fatalf("expected 1 rate limited request, got %d", got)
+	}
+}
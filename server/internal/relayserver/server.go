@@ -2,20 +2,60 @@ package relayserver
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/AidyyJ/PortOpener/internal/relay"
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/guard"
+	"github.com/AidyyJ/PortOpener/server/internal/metrics"
 	"github.com/AidyyJ/PortOpener/server/internal/storage"
 	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
 	"github.com/coder/websocket"
 	"github.com/hashicorp/yamux"
 )
 
+// errReservedByOther rejects a registration for a subdomain or port that is
+// reserved by a different token.
+var errReservedByOther = errors.New("reserved by another token")
+
+// errOutsideScope rejects a registration the token's scopes do not permit.
+var errOutsideScope = errors.New("tunnel not permitted by token scope")
+
+// Liveness defaults. A client must open its control stream and send hello
+// within helloTimeout. After that the server pings it every pingInterval and
+// drops the session once it has sent nothing for heartbeatTimeout.
+const (
+	defaultHelloTimeout     = 10 * time.Second
+	defaultPingInterval     = 10 * time.Second
+	defaultHeartbeatTimeout = 30 * time.Second
+)
+
 type Config struct {
 	Token string
+	// ReconnectGrace keeps a dropped session's tunnels reserved as
+	// placeholders for this long so the client can resume them; proxies hold
+	// new requests and connections meanwhile. Zero releases them at once.
+	ReconnectGrace time.Duration
+	// Metrics, when set, receives TCP and UDP traffic counters.
+	Metrics *metrics.Collector
+	// Recorder receives TCP and UDP logs and metrics; the store is used when
+	// unset.
+	Recorder storage.Recorder
+	// Events, when set, receives tunnel and connection activity.
+	Events *events.Bus
+	// Guard, when set, turns away denied and banned addresses at the relay
+	// endpoint and the TCP and UDP listeners, and counts failed handshakes
+	// towards bans.
+	Guard *guard.Guard
 }
 
 type Server struct {
@@ -24,17 +64,235 @@ type Server struct {
 	store *storage.Store
 	tcp   *TCPProxy
 	udp   *UDPProxy
+
+	helloTimeout     time.Duration
+	pingInterval     time.Duration
+	heartbeatTimeout time.Duration
+	grace            time.Duration
+	events           *events.Bus
+	guard            *guard.Guard
+
+	mu       sync.Mutex
+	live     map[string]liveTunnel
+	sessions map[*yamux.Session]*clientSession
+}
+
+// SessionInfo describes one connected CLI client.
+type SessionInfo struct {
+	ClientID    string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	LastSeen    time.Time
+	RTTMillis   float64
+	Tunnels     []string
+}
+
+// clientSession tracks liveness and round-trip latency for one session.
+type clientSession struct {
+	clientID    string
+	remoteAddr  string
+	connectedAt time.Time
+
+	mu       sync.Mutex
+	lastSeen time.Time
+	rtt      time.Duration
+}
+
+func (c *clientSession) touch() {
+	c.mu.Lock()
+	c.lastSeen = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *clientSession) idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastSeen)
+}
+
+func (c *clientSession) setRTT(rtt time.Duration) {
+	c.mu.Lock()
+	c.rtt = rtt
+	c.mu.Unlock()
+}
+
+// liveTunnel is a tunnel registered on a connected session, kept so it can be
+// closed from outside the session's handler.
+type liveTunnel struct {
+	session *yamux.Session
+	control *controlConn
+	msg     relay.ControlMessage
+}
+
+// controlConn serialises writes to a session's control stream, which is
+// written both by the session handler and by CloseTunnel.
+type controlConn struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (c *controlConn) send(msg relay.ControlMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return relay.WriteJSON(c.w, msg)
 }
 
 func New(cfg Config, registry *tunnels.Registry, store *storage.Store) *Server {
-	return &Server{token: strings.TrimSpace(cfg.Token), reg: registry, store: store, tcp: &TCPProxy{Registry: registry, Store: store}, udp: &UDPProxy{Registry: registry, Store: store}}
+	return &Server{
+		token: strings.TrimSpace(cfg.Token),
+		reg:   registry,
+		store: store,
+		tcp:   &TCPProxy{Registry: registry, Recorder: recorderFor(cfg.Recorder, store), Metrics: cfg.Metrics, Events: cfg.Events, Guard: cfg.Guard},
+		udp:   &UDPProxy{Registry: registry, Recorder: recorderFor(cfg.Recorder, store), Metrics: cfg.Metrics, Events: cfg.Events, Guard: cfg.Guard},
+		live:  make(map[string]liveTunnel),
+
+		grace:            cfg.ReconnectGrace,
+		events:           cfg.Events,
+		guard:            cfg.Guard,
+		helloTimeout:     defaultHelloTimeout,
+		pingInterval:     defaultPingInterval,
+		heartbeatTimeout: defaultHeartbeatTimeout,
+		sessions:         make(map[*yamux.Session]*clientSession),
+	}
+}
+
+// UDPSessions counts the active UDP sessions of each live UDP tunnel.
+func (s *Server) UDPSessions() map[string]int {
+	counts := make(map[string]int)
+	if s.udp == nil {
+		return counts
+	}
+	for port, n := range s.udp.sessionCounts() {
+		if entry, ok := s.reg.LookupUDP(port); ok {
+			counts[entry.TunnelID] += n
+		}
+	}
+	return counts
+}
+
+// Sessions lists connected clients with their last measured round-trip time
+// and the tunnels they carry.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	index := make(map[*yamux.Session]int, len(s.sessions))
+	for session, cs := range s.sessions {
+		cs.mu.Lock()
+		info := SessionInfo{
+			ClientID:    cs.clientID,
+			RemoteAddr:  cs.remoteAddr,
+			ConnectedAt: cs.connectedAt,
+			LastSeen:    cs.lastSeen,
+			RTTMillis:   float64(cs.rtt) / float64(time.Millisecond),
+		}
+		cs.mu.Unlock()
+		index[session] = len(infos)
+		infos = append(infos, info)
+	}
+	for tunnelID, tunnel := range s.live {
+		if i, ok := index[tunnel.session]; ok {
+			infos[i].Tunnels = append(infos[i].Tunnels, tunnelID)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ConnectedAt.Before(infos[j].ConnectedAt) })
+	return infos
+}
+
+// watchSession pings the client every pingInterval and closes the session
+// once it has been silent for heartbeatTimeout. It runs independently of the
+// control read, which would otherwise block forever on a dead client.
+func (s *Server) watchSession(session *yamux.Session, cs *clientSession, out *controlConn) {
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.CloseChan():
+			return
+		case t := <-ticker.C:
+			if cs.idle() > s.heartbeatTimeout {
+				log.Printf("relay heartbeat timeout for %s", cs.clientID)
+				_ = session.Close()
+				return
+			}
+			if err := out.send(relay.ControlMessage{Type: "ping", Timestamp: t.UTC().Format(time.RFC3339Nano)}); err != nil {
+				_ = session.Close()
+				return
+			}
+		}
+	}
+}
+
+// CloseTunnel tears down a live tunnel: its routing entries and listeners are
+// released and the client is told with a tunnel_closed message carrying
+// reason. Other tunnels on the same session keep running. It reports whether
+// the tunnel was live.
+func (s *Server) CloseTunnel(tunnelID, reason string) bool {
+	s.mu.Lock()
+	tunnel, ok := s.live[tunnelID]
+	delete(s.live, tunnelID)
+	s.mu.Unlock()
+	if !ok {
+		s.dropPlaceholders(tunnelID)
+		return false
+	}
+	s.unregisterTunnel(tunnel.session, tunnel.msg)
+	s.events.Publish(events.Event{Type: events.TunnelClosed, TunnelID: tunnelID, ClientID: tunnel.msg.ClientID, Protocol: tunnel.msg.Protocol, Message: reason})
+	if err := tunnel.control.send(relay.ControlMessage{Type: "tunnel_closed", TunnelID: tunnelID, Message: reason}); err != nil {
+		log.Printf("relay tunnel_closed write failed: %v", err)
+	}
+	return true
+}
+
+func (s *Server) trackTunnel(session *yamux.Session, control *controlConn, msg relay.ControlMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live[msg.TunnelID] = liveTunnel{session: session, control: control, msg: msg}
+}
+
+// untrackTunnel forgets a tunnel if it is still tracked for session and
+// reports whether it was.
+func (s *Server) untrackTunnel(session *yamux.Session, tunnelID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tunnel, ok := s.live[tunnelID]
+	if !ok || tunnel.session != session {
+		return false
+	}
+	delete(s.live, tunnelID)
+	return true
+}
+
+// auditAuthFailure records a rejected handshake and counts it towards a ban.
+// The presented token is never stored.
+func (s *Server) auditAuthFailure(r *http.Request, clientID, reason string) {
+	s.guard.Record(r.RemoteAddr, guard.AuthFailure)
+	if s.store == nil {
+		return
+	}
+	after, _ := json.Marshal(map[string]string{"reason": reason})
+	if err := s.store.InsertAudit(storage.AuditEntry{
+		RemoteAddr: r.RemoteAddr,
+		Action:     storage.AuditRelayAuthFailed,
+		Target:     clientID,
+		After:      after,
+	}); err != nil {
+		log.Printf("relay audit failed: %v", err)
+	}
 }
 
 func (s *Server) Handler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if s.guard.Check("", r.RemoteAddr) != "" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		// Once the store holds any token, revoked or not, the configured
+		// token is no longer accepted on its own; otherwise revoking the
+		// seeded copy would bring it back without scopes or reservations.
 		var storedAuth bool
 		if s.store != nil {
-			ok, err := s.store.HasActiveToken()
+			ok, err := s.store.HasTokens()
 			if err != nil {
 				http.Error(w, "relay token lookup failed", http.StatusInternalServerError)
 				return
@@ -64,7 +322,11 @@ func (s *Server) Handler() http.HandlerFunc {
 		}
 		defer session.Close()
 
-		control, err := session.AcceptStream()
+		// The watchdog only starts after hello_ok, so a client that connects
+		// and never says hello is cut off here instead.
+		acceptCtx, cancelAccept := context.WithTimeout(ctx, s.helloTimeout)
+		control, err := session.AcceptStreamWithContext(acceptCtx)
+		cancelAccept()
 		if err != nil {
 			log.Printf("relay control stream failed: %v", err)
 			return
@@ -72,29 +334,15 @@ func (s *Server) Handler() http.HandlerFunc {
 		defer control.Close()
 
 		var hello relay.ControlMessage
+		_ = control.SetReadDeadline(time.Now().Add(s.helloTimeout))
 		if err := relay.ReadJSON(control, &hello); err != nil {
 			log.Printf("relay read hello failed: %v", err)
 			return
 		}
-		defer func() {
-			if s.reg != nil && hello.Subdomain != "" {
-				s.reg.RemoveHTTP(hello.Subdomain)
-			}
-			if s.reg != nil && hello.Protocol == "tcp" && hello.ExternalPort != 0 {
-				s.reg.RemoveTCP(hello.ExternalPort)
-				if s.tcp != nil {
-					s.tcp.RemoveListener(hello.ExternalPort)
-				}
-			}
-			if s.reg != nil && hello.Protocol == "udp" && hello.ExternalPort != 0 {
-				s.reg.RemoveUDP(hello.ExternalPort)
-				if s.udp != nil {
-					s.udp.RemoveListener(hello.ExternalPort)
-				}
-			}
-		}()
+		_ = control.SetReadDeadline(time.Time{})
 
 		if hello.Type != "hello" {
+			s.auditAuthFailure(r, hello.ClientID, "expected hello, got "+hello.Type)
 			_ = relay.WriteJSON(control, relay.ControlMessage{
 				Type:      "error",
 				ErrorCode: "unauthorized",
@@ -102,17 +350,13 @@ func (s *Server) Handler() http.HandlerFunc {
 			})
 			return
 		}
+		// The token's scopes are resolved once here and applied to every
+		// tunnel registered on this session.
+		var token storage.Token
 		if storedAuth {
-			ok, err := s.store.ValidateToken(hello.Token)
-			if err != nil {
-				_ = relay.WriteJSON(control, relay.ControlMessage{
-					Type:      "error",
-					ErrorCode: "unauthorized",
-					Message:   "invalid token",
-				})
-				return
-			}
-			if !ok {
+			authed, ok, err := s.store.AuthenticateToken(hello.Token)
+			if err != nil || !ok {
+				s.auditAuthFailure(r, hello.ClientID, "invalid token")
 				_ = relay.WriteJSON(control, relay.ControlMessage{
 					Type:      "error",
 					ErrorCode: "unauthorized",
@@ -120,7 +364,9 @@ func (s *Server) Handler() http.HandlerFunc {
 				})
 				return
 			}
+			token = authed
 		} else if hello.Token != s.token {
+			s.auditAuthFailure(r, hello.ClientID, "invalid token")
 			_ = relay.WriteJSON(control, relay.ControlMessage{
 				Type:      "error",
 				ErrorCode: "unauthorized",
@@ -134,98 +380,27 @@ func (s *Server) Handler() http.HandlerFunc {
 			return
 		}
 
-		if s.reg != nil && hello.Subdomain != "" {
-			if err := s.reg.RegisterHTTP(hello.TunnelID, session, tunnels.HTTPRegistration{
-				Subdomain: hello.Subdomain,
-				Allowlist: hello.Allowlist,
-			}); err != nil {
-				_ = relay.WriteJSON(control, relay.ControlMessage{Type: "error", ErrorCode: "registration_failed", Message: err.Error()})
-				return
-			}
-			if s.store != nil {
-				if err := s.store.UpsertHTTPReservation(storage.HTTPReservation{
-					TunnelID:  hello.TunnelID,
-					Subdomain: hello.Subdomain,
-					Allowlist: hello.Allowlist,
-				}); err != nil {
-					log.Printf("persist reservation failed: %v", err)
-				}
-				if err := s.store.UpsertTunnel(storage.Tunnel{
-					ID:        hello.TunnelID,
-					Protocol:  "http",
-					LocalHost: hello.LocalHost,
-					LocalPort: hello.LocalPort,
-					Status:    "active",
-					LastSeen:  time.Now().UTC(),
-				}); err != nil {
-					log.Printf("persist tunnel failed: %v", err)
-				}
-			}
-		}
-
-		if s.reg != nil && hello.Protocol == "tcp" && hello.ExternalPort != 0 {
-			if err := s.reg.RegisterTCP(hello.TunnelID, session, hello.ExternalPort); err != nil {
-				_ = relay.WriteJSON(control, relay.ControlMessage{Type: "error", ErrorCode: "registration_failed", Message: err.Error()})
-				return
-			}
-			if s.store != nil {
-				if err := s.store.UpsertPortReservation(storage.PortReservation{
-					Protocol:     "tcp",
-					ExternalPort: hello.ExternalPort,
-					TunnelID:     hello.TunnelID,
-					Reserved:     true,
-				}); err != nil {
-					log.Printf("persist port reservation failed: %v", err)
-				}
-				if err := s.store.UpsertTunnel(storage.Tunnel{
-					ID:        hello.TunnelID,
-					Protocol:  "tcp",
-					LocalHost: hello.LocalHost,
-					LocalPort: hello.LocalPort,
-					Status:    "active",
-					LastSeen:  time.Now().UTC(),
-				}); err != nil {
-					log.Printf("persist tunnel failed: %v", err)
-				}
-			}
-			if s.tcp != nil {
-				if err := s.tcp.EnsureListener(hello.ExternalPort); err != nil {
-					log.Printf("tcp listener failed: %v", err)
-				}
-			}
-		}
-
-		if s.reg != nil && hello.Protocol == "udp" && hello.ExternalPort != 0 {
-			if err := s.reg.RegisterUDP(hello.TunnelID, session, hello.ExternalPort); err != nil {
-				_ = relay.WriteJSON(control, relay.ControlMessage{Type: "error", ErrorCode: "registration_failed", Message: err.Error()})
-				return
-			}
-			if s.store != nil {
-				if err := s.store.UpsertPortReservation(storage.PortReservation{
-					Protocol:     "udp",
-					ExternalPort: hello.ExternalPort,
-					TunnelID:     hello.TunnelID,
-					Reserved:     true,
-				}); err != nil {
-					log.Printf("persist port reservation failed: %v", err)
-				}
-				if err := s.store.UpsertTunnel(storage.Tunnel{
-					ID:        hello.TunnelID,
-					Protocol:  "udp",
-					LocalHost: hello.LocalHost,
-					LocalPort: hello.LocalPort,
-					Status:    "active",
-					LastSeen:  time.Now().UTC(),
-				}); err != nil {
-					log.Printf("persist tunnel failed: %v", err)
-				}
-			}
-			if s.udp != nil {
-				if err := s.udp.EnsureListener(hello.ExternalPort); err != nil {
-					log.Printf("udp listener failed: %v", err)
+		out := &controlConn{w: control}
+		now := time.Now()
+		cs := &clientSession{clientID: hello.ClientID, remoteAddr: r.RemoteAddr, connectedAt: now, lastSeen: now}
+		s.mu.Lock()
+		s.sessions[session] = cs
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			delete(s.sessions, session)
+			s.mu.Unlock()
+		}()
+		go s.watchSession(session, cs, out)
+		var registered []relay.ControlMessage
+		defer func() {
+			for _, msg := range registered {
+				if s.untrackTunnel(session, msg.TunnelID) {
+					s.events.Publish(events.Event{Type: events.TunnelDisconnected, TunnelID: msg.TunnelID, ClientID: msg.ClientID, Protocol: msg.Protocol})
+					s.suspendTunnel(session, msg)
 				}
 			}
-		}
+		}()
 
 		go func() {
 			for {
@@ -237,25 +412,344 @@ func (s *Server) Handler() http.HandlerFunc {
 			}
 		}()
 
-		lastHeartbeat := time.Now()
 		for {
 			var msg relay.ControlMessage
 			if err := relay.ReadJSON(control, &msg); err != nil {
 				log.Printf("relay control read failed: %v", err)
 				return
 			}
-			if msg.Type == "heartbeat" {
-				lastHeartbeat = time.Now()
-				log.Printf("relay heartbeat from %s", hello.ClientID)
-			} else if msg.Type != "" {
+			cs.touch()
+			switch msg.Type {
+			case "heartbeat":
+				// Sent by clients that predate ping/pong; it only proves liveness.
+			case "ping":
+				if err := out.send(relay.ControlMessage{Type: "pong", Timestamp: msg.Timestamp}); err != nil {
+					return
+				}
+			case "pong":
+				if sent, err := time.Parse(time.RFC3339Nano, msg.Timestamp); err == nil {
+					cs.setRTT(time.Since(sent))
+				}
+			case "register_tunnel":
+				msg.Protocol = strings.ToLower(strings.TrimSpace(msg.Protocol))
+				msg.ClientID = hello.ClientID
+				if err := s.registerTunnel(session, token, msg); err != nil {
+					log.Printf("relay register tunnel %s failed: %v", msg.TunnelID, err)
+					s.events.Publish(events.Event{Type: events.RegistrationFailed, TunnelID: msg.TunnelID, ClientID: msg.ClientID, Protocol: msg.Protocol, Message: err.Error()})
+					code := "registration_failed"
+					if errors.Is(err, errReservedByOther) {
+						code = "reserved_by_other"
+					} else if errors.Is(err, errOutsideScope) {
+						code = "forbidden_scope"
+					} else if errors.Is(err, tunnels.ErrTunnelExists) {
+						code = "tunnel_exists"
+					}
+					if err := out.send(relay.ControlMessage{Type: "error", TunnelID: msg.TunnelID, ErrorCode: code, Message: err.Error()}); err != nil {
+						return
+					}
+					continue
+				}
+				registered = append(registered, msg)
+				s.trackTunnel(session, out, msg)
+				s.events.Publish(events.Event{
+					Type:       events.TunnelConnected,
+					TunnelID:   msg.TunnelID,
+					ClientID:   msg.ClientID,
+					Protocol:   msg.Protocol,
+					RemoteAddr: r.RemoteAddr,
+					Subdomain:  msg.Subdomain,
+					Port:       msg.ExternalPort,
+				})
+				if err := out.send(relay.ControlMessage{Type: "register_ok", TunnelID: msg.TunnelID}); err != nil {
+					log.Printf("relay register_ok write failed: %v", err)
+					return
+				}
+			case "":
+			default:
 				log.Printf("relay message type=%s", msg.Type)
 			}
+		}
+	}
+}
 
-			if time.Since(lastHeartbeat) > 30*time.Second {
-				log.Printf("relay heartbeat timeout for %s", hello.ClientID)
-				return
+// registerTunnel binds one tunnel announced on the control stream to the
+// session so inbound traffic for it is routed over that session. A tunnel ID
+// that is already registered resumes on the new session, keeping its row,
+// logs and metrics.
+func (s *Server) registerTunnel(session *yamux.Session, token storage.Token, msg relay.ControlMessage) error {
+	if s.reg == nil {
+		return errors.New("registry not configured")
+	}
+	if msg.TunnelID == "" {
+		return errors.New("tunnel id required")
+	}
+	if !token.Permits(msg.Protocol, msg.Subdomain, msg.ExternalPort) {
+		return errOutsideScope
+	}
+	tokenID := token.ID
+	if err := s.checkReservation(tokenID, msg); err != nil {
+		return err
+	}
+
+	server, mode, err := s.serverAllowlist(msg.TunnelID)
+	if err != nil {
+		return err
+	}
+	rateLimit := tunnels.RateLimit{Rate: msg.RateLimit, Burst: msg.RateBurst, PerIP: msg.IPRateLimit, PerIPBurst: msg.IPRateBurst}
+	if err := rateLimit.Validate(); err != nil {
+		return err
+	}
+	serverRateLimit, err := s.serverRateLimit(msg.TunnelID)
+	if err != nil {
+		return err
+	}
+	port := tunnels.PortRegistration{
+		ExternalPort:    msg.ExternalPort,
+		Allowlist:       msg.Allowlist,
+		ServerAllowlist: server,
+		AllowlistMode:   mode,
+		RateLimit:       rateLimit,
+		ServerRateLimit: serverRateLimit,
+		OwnerTokenID:    tokenID,
+	}
+
+	switch msg.Protocol {
+	case "http":
+		if err := s.reg.RegisterHTTP(msg.TunnelID, session, tunnels.HTTPRegistration{
+			Subdomain:       msg.Subdomain,
+			Allowlist:       msg.Allowlist,
+			ServerAllowlist: server,
+			AllowlistMode:   mode,
+			RateLimit:       rateLimit,
+			ServerRateLimit: serverRateLimit,
+			OwnerTokenID:    tokenID,
+		}); err != nil {
+			return err
+		}
+		if s.store != nil {
+			s.persistTunnel(msg)
+			if err := s.store.UpsertHTTPReservation(storage.HTTPReservation{
+				TunnelID:     msg.TunnelID,
+				Subdomain:    msg.Subdomain,
+				Allowlist:    msg.Allowlist,
+				OwnerTokenID: tokenID,
+			}); err != nil {
+				log.Printf("persist reservation failed: %v", err)
+			}
+		}
+	case "tcp":
+		if err := s.reg.RegisterTCP(msg.TunnelID, session, port); err != nil {
+			return err
+		}
+		if s.store != nil {
+			s.persistTunnel(msg)
+			if err := s.store.SetClientAllowlist(msg.TunnelID, msg.Allowlist); err != nil {
+				log.Printf("persist allowlist failed: %v", err)
+			}
+			if err := s.store.UpsertPortReservation(storage.PortReservation{
+				Protocol:     "tcp",
+				ExternalPort: msg.ExternalPort,
+				TunnelID:     msg.TunnelID,
+				Reserved:     true,
+				OwnerTokenID: tokenID,
+			}); err != nil {
+				log.Printf("persist port reservation failed: %v", err)
+			}
+		}
+		if s.tcp != nil {
+			if err := s.tcp.EnsureListener(msg.ExternalPort); err != nil {
+				log.Printf("tcp listener failed: %v", err)
+			}
+		}
+	case "udp":
+		if err := s.reg.RegisterUDP(msg.TunnelID, session, port); err != nil {
+			return err
+		}
+		if s.store != nil {
+			s.persistTunnel(msg)
+			if err := s.store.SetClientAllowlist(msg.TunnelID, msg.Allowlist); err != nil {
+				log.Printf("persist allowlist failed: %v", err)
+			}
+			if err := s.store.UpsertPortReservation(storage.PortReservation{
+				Protocol:     "udp",
+				ExternalPort: msg.ExternalPort,
+				TunnelID:     msg.TunnelID,
+				Reserved:     true,
+				OwnerTokenID: tokenID,
+			}); err != nil {
+				log.Printf("persist port reservation failed: %v", err)
+			}
+		}
+		if s.udp != nil {
+			if err := s.udp.EnsureListener(msg.ExternalPort); err != nil {
+				log.Printf("udp listener failed: %v", err)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported protocol %q", msg.Protocol)
+	}
+	if s.store != nil {
+		if err := s.store.SetClientRateLimit(msg.TunnelID, storage.RateLimit(rateLimit)); err != nil {
+			log.Printf("persist rate limit failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// serverRateLimit loads the operator-set rate limit of a tunnel that has
+// registered before, failing the registration if it cannot be read.
+func (s *Server) serverRateLimit(tunnelID string) (tunnels.RateLimit, error) {
+	if s.store == nil {
+		return tunnels.RateLimit{}, nil
+	}
+	limits, err := s.store.GetTunnelRateLimit(tunnelID)
+	if errors.Is(err, storage.ErrTunnelNotFound) {
+		return tunnels.RateLimit{}, nil
+	}
+	if err != nil {
+		return tunnels.RateLimit{}, fmt.Errorf("rate limit lookup failed: %w", err)
+	}
+	return tunnels.RateLimit(limits.Server), nil
+}
+
+// serverAllowlist loads the operator-set allowlist of a tunnel that has
+// registered before. A lookup failure rejects the registration rather than
+// opening the tunnel without it.
+func (s *Server) serverAllowlist(tunnelID string) ([]string, tunnels.AllowlistMode, error) {
+	if s.store == nil {
+		return nil, "", nil
+	}
+	allowlist, err := s.store.GetTunnelAllowlist(tunnelID)
+	if errors.Is(err, storage.ErrTunnelNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("allowlist lookup failed: %w", err)
+	}
+	return allowlist.Server, tunnels.AllowlistMode(allowlist.Mode), nil
+}
+
+// checkReservation rejects a tunnel whose subdomain or port is reserved by a
+// different token. Unowned reservations are claimed on registration.
+func (s *Server) checkReservation(tokenID int64, msg relay.ControlMessage) error {
+	if s.store == nil || tokenID == 0 {
+		return nil
+	}
+	var owner int64
+	switch msg.Protocol {
+	case "http":
+		res, ok, err := s.store.GetHTTPReservation(msg.Subdomain)
+		if err != nil {
+			return fmt.Errorf("reservation lookup failed: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+		owner = res.OwnerTokenID
+	case "tcp", "udp":
+		res, ok, err := s.store.GetPortReservation(msg.Protocol, msg.ExternalPort)
+		if err != nil {
+			return fmt.Errorf("reservation lookup failed: %w", err)
+		}
+		if !ok || !res.Reserved {
+			return nil
+		}
+		owner = res.OwnerTokenID
+	}
+	if owner != 0 && owner != tokenID {
+		return errReservedByOther
+	}
+	return nil
+}
+
+func (s *Server) persistTunnel(msg relay.ControlMessage) {
+	if err := s.store.UpsertTunnel(storage.Tunnel{
+		ID:        msg.TunnelID,
+		Name:      msg.Name,
+		ClientID:  msg.ClientID,
+		Protocol:  msg.Protocol,
+		LocalHost: msg.LocalHost,
+		LocalPort: msg.LocalPort,
+		Status:    "active",
+		LastSeen:  time.Now().UTC(),
+	}); err != nil {
+		log.Printf("persist tunnel failed: %v", err)
+	}
+}
+
+// suspendTunnel keeps a dropped tunnel's routing entries as placeholders for
+// the reconnect grace period, releasing them when it expires. Without a grace
+// period the tunnel is unregistered at once.
+func (s *Server) suspendTunnel(session *yamux.Session, msg relay.ControlMessage) {
+	if s.reg == nil {
+		return
+	}
+	if s.grace <= 0 {
+		s.unregisterTunnel(session, msg)
+		return
+	}
+	port := msg.ExternalPort
+	switch msg.Protocol {
+	case "http":
+		s.reg.SuspendHTTP(msg.Subdomain, session, s.grace)
+	case "tcp":
+		s.reg.SuspendTCP(port, session, s.grace, func() {
+			if s.tcp != nil {
+				s.tcp.RemoveListener(port)
 			}
+		})
+	case "udp":
+		s.reg.SuspendUDP(port, session, s.grace, func() {
+			if s.udp != nil {
+				s.udp.RemoveListener(port)
+			}
+		})
+	}
+}
+
+// dropPlaceholders removes the reconnect placeholders of a tunnel that is not
+// live and releases their listeners.
+func (s *Server) dropPlaceholders(tunnelID string) {
+	if s.reg == nil {
+		return
+	}
+	s.reg.RemoveHTTPByTunnelID(tunnelID)
+	for _, entry := range s.reg.RemoveTCPByTunnelID(tunnelID) {
+		if s.tcp != nil {
+			s.tcp.RemoveListener(entry.ExternalPort)
 		}
 	}
+	for _, entry := range s.reg.RemoveUDPByTunnelID(tunnelID) {
+		if s.udp != nil {
+			s.udp.RemoveListener(entry.ExternalPort)
+		}
+	}
+}
 
+// unregisterTunnel drops a tunnel's routing entries, but only while they still
+// point at this session; a reconnecting client may already own them again.
+func (s *Server) unregisterTunnel(session *yamux.Session, msg relay.ControlMessage) {
+	if s.reg == nil {
+		return
+	}
+	switch msg.Protocol {
+	case "http":
+		if entry, ok := s.reg.LookupHTTP(msg.Subdomain); ok && entry.Session == session {
+			s.reg.RemoveHTTP(msg.Subdomain)
+		}
+	case "tcp":
+		if entry, ok := s.reg.LookupTCP(msg.ExternalPort); ok && entry.Session == session {
+			s.reg.RemoveTCP(msg.ExternalPort)
+			if s.tcp != nil {
+				s.tcp.RemoveListener(msg.ExternalPort)
+			}
+		}
+	case "udp":
+		if entry, ok := s.reg.LookupUDP(msg.ExternalPort); ok && entry.Session == session {
+			s.reg.RemoveUDP(msg.ExternalPort)
+			if s.udp != nil {
+				s.udp.RemoveListener(msg.ExternalPort)
+			}
+		}
+	}
 }
@@ -0,0 +1,441 @@
+package relayserver
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/internal/relay"
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+	"github.com/AidyyJ/PortOpener/server/internal/storage/storagetest"
+	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
+	"github.com/coder/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+func dialRelay(t *testing.T, ctx context.Context, url, token string) (*yamux.Session, *yamux.Stream) {
+	t.Helper()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(url, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	session, err := yamux.Client(websocket.NetConn(ctx, conn, websocket.MessageBinary), nil)
+	if err != nil {
+		t.Fatalf("yamux client failed: %v", err)
+	}
+	control, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("open control failed: %v", err)
+	}
+	if err := relay.WriteJSON(control, relay.ControlMessage{Type: "hello", Token: token, ClientID: "client-1"}); err != nil {
+		t.Fatalf("write hello failed: %v", err)
+	}
+	var resp relay.ControlMessage
+	if err := relay.ReadJSON(control, &resp); err != nil {
+		t.Fatalf("read hello response failed: %v", err)
+	}
+	if resp.Type != "hello_ok" {
+		t.Fatalf("expected hello_ok, got %+v", resp)
+	}
+	return session, control
+}
+
+func registerTunnel(t *testing.T, control *yamux.Stream, msg relay.ControlMessage) relay.ControlMessage {
+	t.Helper()
+	msg.Type = "register_tunnel"
+	if err := relay.WriteJSON(control, msg); err != nil {
+		t.Fatalf("write register failed: %v", err)
+	}
+	var resp relay.ControlMessage
+	if err := relay.ReadJSON(control, &resp); err != nil {
+		t.Fatalf("read register response failed: %v", err)
+	}
+	return resp
+}
+
+func TestHandlerRegistersMultipleTunnelsOnOneSession(t *testing.T) {
+	registry := tunnels.NewRegistry()
+	srv := httptest.NewServer(New(Config{Token: "secret"}, registry, nil).Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, control := dialRelay(t, ctx, srv.URL, "secret")
+
+	for _, sub := range []string{"app", "api"} {
+		resp := registerTunnel(t, control, relay.ControlMessage{TunnelID: "t-" + sub, Protocol: "http", Subdomain: sub})
+		if resp.Type != "register_ok" || resp.TunnelID != "t-"+sub {
+			t.Fatalf("expected register_ok for %s, got %+v", sub, resp)
+		}
+	}
+
+	resp := registerTunnel(t, control, relay.ControlMessage{TunnelID: "t-dup", Protocol: "http", Subdomain: "app"})
+	if resp.Type != "error" || resp.TunnelID != "t-dup" {
+		t.Fatalf("expected error for duplicate subdomain, got %+v", resp)
+	}
+
+	app, ok := registry.LookupHTTP("app")
+	if !ok {
+		t.Fatalf("expected app registered")
+	}
+	api, ok := registry.LookupHTTP("api")
+	if !ok {
+		t.Fatalf("expected api registered")
+	}
+	if app.Session == nil || app.Session != api.Session {
+		t.Fatalf("expected tunnels to share one relay session")
+	}
+
+	_ = session.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(registry.ListHTTP()) == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected tunnels removed after session close")
+}
+
+func TestCloseTunnelNotifiesClientAndReleasesListener(t *testing.T) {
+	registry := tunnels.NewRegistry()
+	relaySrv := New(Config{Token: "secret"}, registry, nil)
+	srv := httptest.NewServer(relaySrv.Handler())
+	defer srv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, control := dialRelay(t, ctx, srv.URL, "secret")
+
+	if resp := registerTunnel(t, control, relay.ControlMessage{TunnelID: "t-web", Protocol: "http", Subdomain: "web"}); resp.Type != "register_ok" {
+		t.Fatalf("expected register_ok, got %+v", resp)
+	}
+	if resp := registerTunnel(t, control, relay.ControlMessage{TunnelID: "t-db", Protocol: "tcp", ExternalPort: port}); resp.Type != "register_ok" {
+		t.Fatalf("expected register_ok, got %+v", resp)
+	}
+
+	if !relaySrv.CloseTunnel("t-db", "terminated by admin") {
+		t.Fatalf("expected live tunnel closed")
+	}
+	var msg relay.ControlMessage
+	if err := relay.ReadJSON(control, &msg); err != nil {
+		t.Fatalf("read tunnel_closed failed: %v", err)
+	}
+	if msg.Type != "tunnel_closed" || msg.TunnelID != "t-db" || msg.Message != "terminated by admin" {
+		t.Fatalf("unexpected control message %+v", msg)
+	}
+	if _, ok := registry.LookupTCP(port); ok {
+		t.Fatalf("expected tcp entry removed")
+	}
+	if _, ok := registry.LookupHTTP("web"); !ok {
+		t.Fatalf("expected other tunnel on the session kept")
+	}
+	ln, err = net.Listen("tcp", net.JoinHostPort("", itoa(port)))
+	if err != nil {
+		t.Fatalf("expected listener released: %v", err)
+	}
+	_ = ln.Close()
+
+	if relaySrv.CloseTunnel("t-db", "again") {
+		t.Fatalf("expected closed tunnel no longer live")
+	}
+}
+
+func TestWatchdogDropsSilentSession(t *testing.T) {
+	registry := tunnels.NewRegistry()
+	relaySrv := New(Config{Token: "secret"}, registry, nil)
+	relaySrv.pingInterval = 20 * time.Millisecond
+	relaySrv.heartbeatTimeout = 100 * time.Millisecond
+	srv := httptest.NewServer(relaySrv.Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, control := dialRelay(t, ctx, srv.URL, "secret")
+	if resp := registerTunnel(t, control, relay.ControlMessage{TunnelID: "t-app", Protocol: "http", Subdomain: "app"}); resp.Type != "register_ok" {
+		t.Fatalf("expected register_ok, got %+v", resp)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := registry.LookupHTTP("app"); !ok && len(relaySrv.Sessions()) == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected silent session dropped")
+}
+
+func TestHandlerDropsClientThatNeverSaysHello(t *testing.T) {
+	relaySrv := New(Config{Token: "secret"}, tunnels.NewRegistry(), nil)
+	relaySrv.helloTimeout = 100 * time.Millisecond
+	srv := httptest.NewServer(relaySrv.Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	session, err := yamux.Client(websocket.NetConn(ctx, conn, websocket.MessageBinary), nil)
+	if err != nil {
+		t.Fatalf("yamux client failed: %v", err)
+	}
+	defer session.Close()
+	control, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("open control failed: %v", err)
+	}
+	var resp relay.ControlMessage
+	if err := relay.ReadJSON(control, &resp); err == nil {
+		t.Fatalf("expected the silent session closed, got %+v", resp)
+	}
+	select {
+	case <-session.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the relay to close the session")
+	}
+}
+
+func TestPongRecordsRoundTripTime(t *testing.T) {
+	relaySrv := New(Config{Token: "secret"}, tunnels.NewRegistry(), nil)
+	relaySrv.pingInterval = 20 * time.Millisecond
+	srv := httptest.NewServer(relaySrv.Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, control := dialRelay(t, ctx, srv.URL, "secret")
+
+	var ping relay.ControlMessage
+	if err := relay.ReadJSON(control, &ping); err != nil {
+		t.Fatalf("read ping failed: %v", err)
+	}
+	if ping.Type != "ping" || ping.Timestamp == "" {
+		t.Fatalf("expected ping, got %+v", ping)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := relay.WriteJSON(control, relay.ControlMessage{Type: "pong", Timestamp: ping.Timestamp}); err != nil {
+		t.Fatalf("write pong failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		sessions := relaySrv.Sessions()
+		if len(sessions) == 1 && sessions[0].RTTMillis >= 5 {
+			if sessions[0].ClientID != "client-1" {
+				t.Fatalf("unexpected client id %q", sessions[0].ClientID)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected rtt recorded, got %+v", relaySrv.Sessions())
+}
+
+func TestReconnectResumesSameTunnel(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if err := store.InsertToken("alice"); err != nil {
+		t.Fatalf("insert token failed: %v", err)
+	}
+	registry := tunnels.NewRegistry()
+	srv := httptest.NewServer(New(Config{}, registry, store).Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg := relay.ControlMessage{TunnelID: "t-app", Name: "web", Protocol: "http", Subdomain: "app"}
+	oldSession, oldControl := dialRelay(t, ctx, srv.URL, "alice")
+	if resp := registerTunnel(t, oldControl, msg); resp.Type != "register_ok" {
+		t.Fatalf("expected register_ok, got %+v", resp)
+	}
+
+	_, newControl := dialRelay(t, ctx, srv.URL, "alice")
+	if resp := registerTunnel(t, newControl, msg); resp.Type != "register_ok" {
+		t.Fatalf("expected resumed register_ok, got %+v", resp)
+	}
+
+	_ = oldSession.Close()
+	time.Sleep(100 * time.Millisecond)
+	entry, ok := registry.LookupHTTP("app")
+	if !ok || entry.Session == nil || entry.Session.IsClosed() {
+		t.Fatalf("expected tunnel to stay on the new session")
+	}
+
+	rows, err := store.ListTunnels(10)
+	if err != nil {
+		t.Fatalf("list tunnels failed: %v", err)
+	}
+	if len(rows) != 1 || rows[0].ID != "t-app" || rows[0].Name != "web" || rows[0].ClientID != "client-1" {
+		t.Fatalf("expected one named tunnel row, got %+v", rows)
+	}
+}
+
+func TestHandlerRejectsSubdomainReservedByOtherToken(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if err := store.InsertToken("alice"); err != nil {
+		t.Fatalf("insert token failed: %v", err)
+	}
+	if err := store.InsertToken("bob"); err != nil {
+		t.Fatalf("insert token failed: %v", err)
+	}
+
+	registry := tunnels.NewRegistry()
+	srv := httptest.NewServer(New(Config{}, registry, store).Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	aliceSession, aliceControl := dialRelay(t, ctx, srv.URL, "alice")
+	resp := registerTunnel(t, aliceControl, relay.ControlMessage{TunnelID: "t-alice", Protocol: "http", Subdomain: "app"})
+	if resp.Type != "register_ok" {
+		t.Fatalf("expected register_ok, got %+v", resp)
+	}
+	_ = aliceSession.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := registry.LookupHTTP("app"); !ok {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	_, bobControl := dialRelay(t, ctx, srv.URL, "bob")
+	resp = registerTunnel(t, bobControl, relay.ControlMessage{TunnelID: "t-bob", Protocol: "http", Subdomain: "app"})
+	if resp.Type != "error" || resp.ErrorCode != "reserved_by_other" {
+		t.Fatalf("expected reserved_by_other, got %+v", resp)
+	}
+}
+
+func TestHandlerRejectsSubdomainHeldByAnotherTunnel(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if err := store.InsertToken("alice"); err != nil {
+		t.Fatalf("insert token failed: %v", err)
+	}
+
+	srv := httptest.NewServer(New(Config{}, tunnels.NewRegistry(), store).Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, control := dialRelay(t, ctx, srv.URL, "alice")
+
+	resp := registerTunnel(t, control, relay.ControlMessage{TunnelID: "t1", Protocol: "http", Subdomain: "app"})
+	if resp.Type != "register_ok" {
+		t.Fatalf("expected register_ok, got %+v", resp)
+	}
+	resp = registerTunnel(t, control, relay.ControlMessage{TunnelID: "t2", Protocol: "http", Subdomain: "app"})
+	if resp.Type != "error" || resp.ErrorCode != "tunnel_exists" {
+		t.Fatalf("expected tunnel_exists, got %+v", resp)
+	}
+}
+
+func TestHandlerEnforcesTokenScopes(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if _, err := store.CreateToken(storage.Token{Name: "ci", Protocols: []string{"http"}, SubdomainPatterns: []string{"ci-*"}}, "ci"); err != nil {
+		t.Fatalf("create token failed: %v", err)
+	}
+
+	srv := httptest.NewServer(New(Config{}, tunnels.NewRegistry(), store).Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, control := dialRelay(t, ctx, srv.URL, "ci")
+
+	resp := registerTunnel(t, control, relay.ControlMessage{TunnelID: "t1", Protocol: "http", Subdomain: "prod"})
+	if resp.Type != "error" || resp.ErrorCode != "forbidden_scope" {
+		t.Fatalf("expected forbidden_scope, got %+v", resp)
+	}
+	resp = registerTunnel(t, control, relay.ControlMessage{TunnelID: "t2", Protocol: "http", Subdomain: "ci-build"})
+	if resp.Type != "register_ok" {
+		t.Fatalf("expected register_ok, got %+v", resp)
+	}
+}
+
+func TestHandlerAuditsRejectedTokens(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if err := store.InsertToken("good"); err != nil {
+		t.Fatalf("insert token failed: %v", err)
+	}
+	srv := httptest.NewServer(New(Config{}, tunnels.NewRegistry(), store).Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if resp := sendHello(t, ctx, srv.URL, relay.ControlMessage{Type: "hello", Token: "guess", ClientID: "intruder"}); resp.ErrorCode != "unauthorized" {
+		t.Fatalf("expected unauthorized, got %+v", resp)
+	}
+
+	entries, err := store.ListAudit(storage.AuditQuery{Action: storage.AuditRelayAuthFailed})
+	if err != nil {
+		t.Fatalf("list audit failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Target != "intruder" || entries[0].RemoteAddr == "" {
+		t.Fatalf("unexpected audit entries %+v", entries)
+	}
+	if strings.Contains(string(entries[0].After), "guess") {
+		t.Fatalf("audit entry leaked the presented token: %s", entries[0].After)
+	}
+}
+
+func TestHandlerRejectsRevokedSeedToken(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	if err := store.EnsureToken("seed"); err != nil {
+		t.Fatalf("ensure token failed: %v", err)
+	}
+	id, _, err := store.LookupTokenID("seed")
+	if err != nil {
+		t.Fatalf("lookup token failed: %v", err)
+	}
+	if err := store.RevokeToken(id); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+	srv := httptest.NewServer(New(Config{Token: "seed"}, tunnels.NewRegistry(), store).Handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if resp := sendHello(t, ctx, srv.URL, relay.ControlMessage{Type: "hello", Token: "seed", ClientID: "client-1"}); resp.ErrorCode != "unauthorized" {
+		t.Fatalf("expected revoked seed token rejected, got %+v", resp)
+	}
+}
+
+// sendHello opens a relay session, sends hello and returns the reply.
+func sendHello(t *testing.T, ctx context.Context, url string, hello relay.ControlMessage) relay.ControlMessage {
+	t.Helper()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(url, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	session, err := yamux.Client(websocket.NetConn(ctx, conn, websocket.MessageBinary), nil)
+	if err != nil {
+		t.Fatalf("yamux client failed: %v", err)
+	}
+	t.Cleanup(func() { _ = session.Close() })
+	control, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("open control failed: %v", err)
+	}
+	if err := relay.WriteJSON(control, hello); err != nil {
+		t.Fatalf("write hello failed: %v", err)
+	}
+	var resp relay.ControlMessage
+	if err := relay.ReadJSON(control, &resp); err != nil {
+		t.Fatalf("read hello response failed: %v", err)
+	}
+	return resp
+}
@@ -1,19 +1,26 @@
 package relayserver
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/AidyyJ/PortOpener/internal/relay"
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/guard"
+	"github.com/AidyyJ/PortOpener/server/internal/metrics"
 	"github.com/AidyyJ/PortOpener/server/internal/storage"
 	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
 )
 
 type TCPProxy struct {
 	Registry  *tunnels.Registry
-	Store     *storage.Store
+	Recorder  storage.Recorder
+	Metrics   *metrics.Collector
+	Events    *events.Bus
+	Guard     *guard.Guard
 	listeners map[int]net.Listener
 	mu        sync.Mutex
 }
@@ -66,43 +73,91 @@ func (p *TCPProxy) handleConn(port int, conn net.Conn) {
 		return
 	}
 	entry, ok := p.Registry.LookupTCP(port)
+	if ok && entry.Reconnecting() {
+		entry, ok = p.Registry.AwaitTCP(context.Background(), entry)
+	}
 	if !ok || entry.Session == nil {
 		return
 	}
+	if reason := p.Guard.Check(entry.TunnelID, conn.RemoteAddr().String()); reason != "" {
+		if p.Metrics != nil {
+			p.Metrics.AddRejected(entry.TunnelID, "tcp", reason)
+		}
+		return
+	}
+	p.Guard.Record(conn.RemoteAddr().String(), guard.Request)
+	if !entry.Allows(conn.RemoteAddr().String()) {
+		if p.Metrics != nil {
+			p.Metrics.AddRejected(entry.TunnelID, "tcp", "allowlist")
+		}
+		return
+	}
+	if ok, _ := entry.AllowRate(conn.RemoteAddr().String()); !ok {
+		if p.Metrics != nil {
+			p.Metrics.AddRejected(entry.TunnelID, "tcp", "rate_limit")
+		}
+		return
+	}
 	stream, err := entry.Session.OpenStream()
 	if err != nil {
 		return
 	}
 	defer stream.Close()
 
-	_ = relay.WriteJSON(stream, relay.ControlMessage{Type: "tcp_open", TunnelID: entry.TunnelID, ExternalPort: port})
+	if p.Metrics != nil {
+		p.Metrics.TrackTCP(entry.TunnelID, 1)
+		defer p.Metrics.TrackTCP(entry.TunnelID, -1)
+	}
+	started := time.Now()
+	remote := conn.RemoteAddr().String()
+	p.Events.Publish(events.Event{Type: events.TCPOpen, TunnelID: entry.TunnelID, Protocol: "tcp", RemoteAddr: remote, Port: port})
+
+	if err := relay.WriteJSON(stream, relay.ControlMessage{Type: "stream_open", TunnelID: entry.TunnelID, Protocol: "tcp", ExternalPort: port}); err != nil {
+		return
+	}
 
 	var bytesIn int64
 	var bytesOut int64
-	copyErr := make(chan error, 2)
+	copied := make(chan struct{}, 2)
 	go func() {
-		count, err := io.Copy(stream, conn)
-		bytesIn = count
-		copyErr <- err
+		bytesIn, _ = io.Copy(stream, conn)
+		copied <- struct{}{}
 	}()
 	go func() {
-		count, err := io.Copy(conn, stream)
-		bytesOut = count
-		copyErr <- err
+		bytesOut, _ = io.Copy(conn, stream)
+		copied <- struct{}{}
 	}()
-	<-copyErr
+	// Once either side finishes, close both so the other copy returns too and
+	// its byte count is final.
+	<-copied
+	_ = conn.Close()
+	_ = stream.Close()
+	<-copied
 
-	if p.Store != nil {
-		_ = p.Store.InsertLog(storage.LogEntry{
+	p.Events.Publish(events.Event{
+		Type:           events.TCPClose,
+		TunnelID:       entry.TunnelID,
+		Protocol:       "tcp",
+		RemoteAddr:     remote,
+		Port:           port,
+		BytesIn:        bytesIn,
+		BytesOut:       bytesOut,
+		DurationMillis: float64(time.Since(started)) / float64(time.Millisecond),
+	})
+	if p.Metrics != nil {
+		p.Metrics.Add(entry.TunnelID, 0, bytesIn, bytesOut)
+	}
+	if p.Recorder != nil {
+		_ = p.Recorder.InsertLog(storage.LogEntry{
 			TunnelID:   entry.TunnelID,
 			Timestamp:  time.Now().UTC(),
 			Kind:       "tcp",
-			RemoteAddr: conn.RemoteAddr().String(),
+			RemoteAddr: remote,
 			Summary:    "tcp port " + itoa(port),
 			BytesIn:    bytesIn,
 			BytesOut:   bytesOut,
 		})
-		_ = p.Store.AddMetric(entry.TunnelID, time.Now().UTC(), 0, 1, bytesIn, bytesOut)
+		_ = p.Recorder.AddMetric(entry.TunnelID, time.Now().UTC(), 0, 1, bytesIn, bytesOut)
 	}
 }
 
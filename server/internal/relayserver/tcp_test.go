@@ -0,0 +1,64 @@
+package relayserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/server/internal/metrics"
+	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
+)
+
+// remoteConn reports a chosen remote address for a pipe.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestTCPProxyRejectsDisallowedPeers(t *testing.T) {
+	serverSession, clientSession := newSessionPair(t)
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterTCP("t1", serverSession, tunnels.PortRegistration{ExternalPort: 25000, Allowlist: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	collector := metrics.New()
+	proxy := &TCPProxy{Registry: registry, Metrics: collector}
+
+	outside, outsidePeer := net.Pipe()
+	defer outsidePeer.Close()
+	done := make(chan struct{})
+	go func() {
+		proxy.handleConn(25000, remoteConn{Conn: outside, remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected disallowed connection closed at accept")
+	}
+	if got := collector.Snapshot()["t1"].Rejected[metrics.Rejection{Protocol: "tcp", Reason: "allowlist"}]; got != 1 {
+		t.Fatalf("expected 1 rejected connection, got %d", got)
+	}
+
+	inside, insidePeer := net.Pipe()
+	defer insidePeer.Close()
+	go proxy.handleConn(25000, remoteConn{Conn: inside, remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4000}})
+	accepted := make(chan error, 1)
+	go func() {
+		stream, err := clientSession.AcceptStream()
+		if err == nil {
+			_ = stream.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Fatalf("accept stream failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected allowed connection relayed to the client")
+	}
+}
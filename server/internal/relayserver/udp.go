@@ -7,13 +7,19 @@ import (
 	"time"
 
 	"github.com/AidyyJ/PortOpener/internal/relay"
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/guard"
+	"github.com/AidyyJ/PortOpener/server/internal/metrics"
 	"github.com/AidyyJ/PortOpener/server/internal/storage"
 	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
 )
 
 type UDPProxy struct {
 	Registry *tunnels.Registry
-	Store    *storage.Store
+	Recorder storage.Recorder
+	Metrics  *metrics.Collector
+	Events   *events.Bus
+	Guard    *guard.Guard
 
 	mu        sync.Mutex
 	conns     map[int]*net.UDPConn
@@ -22,6 +28,7 @@ type UDPProxy struct {
 }
 
 type udpSession struct {
+	tunnelID string
 	stream   net.Conn
 	remote   *net.UDPAddr
 	lastSeen time.Time
@@ -67,8 +74,9 @@ func (p *UDPProxy) RemoveListener(port int) {
 		return
 	}
 	if sessions, ok := p.sessions[port]; ok {
-		for _, session := range sessions {
+		for remote, session := range sessions {
 			_ = session.stream.Close()
+			p.publishClose(port, remote, session)
 		}
 	}
 	_ = conn.Close()
@@ -98,6 +106,27 @@ func (p *UDPProxy) handleDatagram(port int, conn *net.UDPConn, addr *net.UDPAddr
 		return
 	}
 	remote := addr.String()
+	if reason := p.Guard.Check(entry.TunnelID, remote); reason != "" {
+		if p.Metrics != nil {
+			p.Metrics.AddRejected(entry.TunnelID, "udp", reason)
+		}
+		return
+	}
+	if !p.hasSession(port, remote) {
+		p.Guard.Record(remote, guard.Request)
+	}
+	if !entry.Allows(remote) {
+		if p.Metrics != nil {
+			p.Metrics.AddRejected(entry.TunnelID, "udp", "allowlist")
+		}
+		return
+	}
+	if ok, _ := entry.AllowRate(remote); !ok {
+		if p.Metrics != nil {
+			p.Metrics.AddRejected(entry.TunnelID, "udp", "rate_limit")
+		}
+		return
+	}
 	session := p.getOrCreateSession(port, remote, entry, addr)
 	if session == nil {
 		return
@@ -110,8 +139,11 @@ func (p *UDPProxy) handleDatagram(port int, conn *net.UDPConn, addr *net.UDPAddr
 		p.dropSession(port, remote)
 		return
 	}
-	if p.Store != nil {
-		_ = p.Store.InsertLog(storage.LogEntry{
+	if p.Metrics != nil {
+		p.Metrics.Add(entry.TunnelID, 0, int64(len(payload)), 0)
+	}
+	if p.Recorder != nil {
+		_ = p.Recorder.InsertLog(storage.LogEntry{
 			TunnelID:   entry.TunnelID,
 			Timestamp:  time.Now().UTC(),
 			Kind:       "udp",
@@ -119,11 +151,18 @@ func (p *UDPProxy) handleDatagram(port int, conn *net.UDPConn, addr *net.UDPAddr
 			Summary:    "udp port " + itoa(port),
 			BytesIn:    int64(len(payload)),
 		})
-		_ = p.Store.AddMetric(entry.TunnelID, time.Now().UTC(), 0, 1, int64(len(payload)), 0)
+		_ = p.Recorder.AddMetric(entry.TunnelID, time.Now().UTC(), 0, 1, int64(len(payload)), 0)
 	}
 	p.cleanupSessions(port)
 }
 
+func (p *UDPProxy) hasSession(port int, remote string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.sessions[port][remote]
+	return ok
+}
+
 func (p *UDPProxy) getOrCreateSession(port int, remote string, entry tunnels.UDPEntry, addr *net.UDPAddr) *udpSession {
 	p.mu.Lock()
 	sessions := p.sessions[port]
@@ -138,7 +177,11 @@ func (p *UDPProxy) getOrCreateSession(port int, remote string, entry tunnels.UDP
 	if err != nil {
 		return nil
 	}
-	session := &udpSession{stream: stream, remote: addr, lastSeen: time.Now().UTC()}
+	if err := relay.WriteJSON(stream, relay.ControlMessage{Type: "stream_open", TunnelID: entry.TunnelID, Protocol: "udp", ExternalPort: port}); err != nil {
+		_ = stream.Close()
+		return nil
+	}
+	session := &udpSession{tunnelID: entry.TunnelID, stream: stream, remote: addr, lastSeen: time.Now().UTC()}
 	p.mu.Lock()
 	if existing, ok := p.sessions[port][remote]; ok {
 		p.mu.Unlock()
@@ -147,6 +190,7 @@ func (p *UDPProxy) getOrCreateSession(port int, remote string, entry tunnels.UDP
 	}
 	p.sessions[port][remote] = session
 	p.mu.Unlock()
+	p.Events.Publish(events.Event{Type: events.UDPSessionOpen, TunnelID: entry.TunnelID, Protocol: "udp", RemoteAddr: remote, Port: port})
 	go p.readResponses(port, remote, session)
 	return session
 }
@@ -179,8 +223,11 @@ func (p *UDPProxy) readResponses(port int, remote string, session *udpSession) {
 		}
 		_, _ = conn.WriteToUDP(data, session.remote)
 		session.lastSeen = time.Now().UTC()
-		if p.Store != nil {
-			_ = p.Store.AddMetric(tunnelID, time.Now().UTC(), 0, 1, 0, int64(len(data)))
+		if p.Metrics != nil {
+			p.Metrics.Add(tunnelID, 0, 0, int64(len(data)))
+		}
+		if p.Recorder != nil {
+			_ = p.Recorder.AddMetric(tunnelID, time.Now().UTC(), 0, 1, 0, int64(len(data)))
 		}
 	}
 }
@@ -189,8 +236,26 @@ func (p *UDPProxy) dropSession(port int, remote string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if sessions, ok := p.sessions[port]; ok {
-		delete(sessions, remote)
+		if session, ok := sessions[remote]; ok {
+			delete(sessions, remote)
+			p.publishClose(port, remote, session)
+		}
+	}
+}
+
+func (p *UDPProxy) publishClose(port int, remote string, session *udpSession) {
+	p.Events.Publish(events.Event{Type: events.UDPSessionClose, TunnelID: session.tunnelID, Protocol: "udp", RemoteAddr: remote, Port: port})
+}
+
+// sessionCounts reports the number of active sessions on each listening port.
+func (p *UDPProxy) sessionCounts() map[int]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := make(map[int]int, len(p.sessions))
+	for port, sessions := range p.sessions {
+		counts[port] = len(sessions)
 	}
+	return counts
 }
 
 func (p *UDPProxy) cleanupSessions(port int) {
@@ -204,6 +269,7 @@ func (p *UDPProxy) cleanupSessions(port int) {
 		if time.Since(session.lastSeen) > udpIdleTimeout {
 			_ = session.stream.Close()
 			delete(sessions, remote)
+			p.publishClose(port, remote, session)
 		}
 	}
 	p.mu.Unlock()
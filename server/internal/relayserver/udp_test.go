@@ -4,6 +4,10 @@ import (
 	"net"
 	"testing"
 	"time"
+
+	"github.com/AidyyJ/PortOpener/server/internal/guard"
+	"github.com/AidyyJ/PortOpener/server/internal/metrics"
+	"github.com/AidyyJ/PortOpener/server/internal/tunnels"
 )
 
 func TestUDPCleanupSessionsRemovesExpired(t *testing.T) {
@@ -54,3 +58,57 @@ func TestUDPCleanupSessionsSkipsWhenRecent(t *testing.T) {
 		t.Fatalf("expected session retained when cleanup interval not reached")
 	}
 }
+
+func TestUDPProxyDropsDisallowedDatagrams(t *testing.T) {
+	serverSession, _ := newSessionPair(t)
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterUDP("t1", serverSession, tunnels.PortRegistration{ExternalPort: 27000, Allowlist: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	collector := metrics.New()
+	port := 27000
+	proxy := &UDPProxy{Registry: registry, Metrics: collector, sessions: map[int]map[string]*udpSession{port: {}}}
+
+	proxy.handleDatagram(port, nil, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}, []byte("ping"))
+	if len(proxy.sessions[port]) != 0 {
+		t.Fatalf("expected no session for a disallowed source")
+	}
+	snap := collector.Snapshot()["t1"]
+	if got := snap.Rejected[metrics.Rejection{Protocol: "udp", Reason: "allowlist"}]; got != 1 || snap.BytesIn != 0 {
+		t.Fatalf("expected 1 dropped datagram and no bytes counted, got %+v", snap)
+	}
+}
+
+func TestUDPProxyCountsNewSessionsTowardsBans(t *testing.T) {
+	serverSession, _ := newSessionPair(t)
+	registry := tunnels.NewRegistry()
+	if err := registry.RegisterUDP("t1", serverSession, tunnels.PortRegistration{ExternalPort: 27001}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	gate, err := guard.New(nil, guard.Policy{RequestLimit: 2, Window: time.Minute, BanFor: time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("new guard failed: %v", err)
+	}
+	collector := metrics.New()
+	port := 27001
+	proxy := &UDPProxy{Registry: registry, Metrics: collector, Guard: gate, sessions: map[int]map[string]*udpSession{port: {}}}
+
+	steady := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}
+	for i := 0; i < 3; i++ {
+		proxy.handleDatagram(port, nil, steady, []byte("ping"))
+	}
+	if reason := gate.Check("t1", steady.String()); reason != "" {
+		t.Fatalf("expected datagrams on one session not to ban, got %q", reason)
+	}
+
+	for sourcePort := 6000; sourcePort < 6003; sourcePort++ {
+		proxy.handleDatagram(port, nil, &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: sourcePort}, []byte("ping"))
+	}
+	if reason := gate.Check("t1", "192.0.2.2:6000"); reason != guard.ReasonBanned {
+		t.Fatalf("expected new sessions to earn a ban, got %q", reason)
+	}
+	snap := collector.Snapshot()["t1"]
+	if got := snap.Rejected[metrics.Rejection{Protocol: "udp", Reason: guard.ReasonBanned}]; got != 1 {
+		t.Fatalf("expected 1 datagram rejected as banned, got %+v", snap.Rejected)
+	}
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AdminRole grants access to the admin API. Roles are ordered: each role
+// includes everything the roles below it may do.
+type AdminRole string
+
+const (
+	// RoleViewer may read tunnels, reservations, logs and metrics.
+	RoleViewer AdminRole = "viewer"
+	// RoleOperator may additionally terminate tunnels and edit domains.
+	RoleOperator AdminRole = "operator"
+	// RoleOwner may additionally manage relay and admin tokens.
+	RoleOwner AdminRole = "owner"
+)
+
+func (r AdminRole) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleOwner:
+		return 3
+	}
+	return 0
+}
+
+// Allows reports whether the role grants at least required.
+func (r AdminRole) Allows(required AdminRole) bool {
+	return r.rank() > 0 && r.rank() >= required.rank()
+}
+
+// AdminToken is a credential for the admin API. It is kept apart from relay
+// tokens so opening tunnels never implies admin access.
+type AdminToken struct {
+	ID         int64
+	Name       string
+	Role       AdminRole
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+var (
+	ErrAdminTokenNotFound = errors.New("admin token not found")
+	ErrLastOwnerToken     = errors.New("cannot revoke the last owner token")
+)
+
+// EnsureAdminToken seeds raw as an owner token when no admin token is active,
+// so a fresh install can reach the admin API.
+func (s *Store) EnsureAdminToken(raw string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("store not configured")
+	}
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(1) FROM admin_tokens WHERE revoked_at IS NULL").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 || strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	_, err := s.CreateAdminToken(AdminToken{Name: "bootstrap", Role: RoleOwner}, raw)
+	return err
+}
+
+// CreateAdminToken stores a new admin token for raw and returns it with its id.
+func (s *Store) CreateAdminToken(token AdminToken, raw string) (AdminToken, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return AdminToken{}, fmt.Errorf("token required")
+	}
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		return AdminToken{}, fmt.Errorf("token name required")
+	}
+	token.Role = AdminRole(strings.ToLower(strings.TrimSpace(string(token.Role))))
+	if token.Role.rank() == 0 {
+		return AdminToken{}, fmt.Errorf("invalid role %q", token.Role)
+	}
+	token.CreatedAt = time.Now().UTC()
+	result, err := s.db.Exec("INSERT INTO admin_tokens (name, token_hash, role, created_at) VALUES (?, ?, ?, ?)",
+		token.Name, hashToken(trimmed), string(token.Role), token.CreatedAt.Format(time.RFC3339))
+	if err != nil {
+		return AdminToken{}, err
+	}
+	token.ID, err = result.LastInsertId()
+	return token, err
+}
+
+// AuthenticateAdminToken resolves an active admin token and records its use.
+func (s *Store) AuthenticateAdminToken(raw string) (AdminToken, bool, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return AdminToken{}, false, nil
+	}
+	token, err := scanAdminToken(s.db.QueryRow(adminTokenSelect+" WHERE token_hash = ? AND revoked_at IS NULL", hashToken(trimmed)))
+	if err == sql.ErrNoRows {
+		return AdminToken{}, false, nil
+	}
+	if err != nil {
+		return AdminToken{}, false, err
+	}
+	now := time.Now().UTC()
+	if _, err := s.db.Exec("UPDATE admin_tokens SET last_used_at = ? WHERE id = ?", now.Format(time.RFC3339), token.ID); err != nil {
+		return AdminToken{}, false, err
+	}
+	token.LastUsedAt = now
+	return token, true, nil
+}
+
+func (s *Store) GetAdminToken(id int64) (AdminToken, bool, error) {
+	token, err := scanAdminToken(s.db.QueryRow(adminTokenSelect+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return AdminToken{}, false, nil
+	}
+	if err != nil {
+		return AdminToken{}, false, err
+	}
+	return token, true, nil
+}
+
+func (s *Store) ListAdminTokens() ([]AdminToken, error) {
+	rows, err := s.db.Query(adminTokenSelect + " ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []AdminToken
+	for rows.Next() {
+		token, err := scanAdminToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, token)
+	}
+	return results, rows.Err()
+}
+
+// RevokeAdminToken revokes one admin token. The last active owner cannot be
+// revoked, which would lock everyone out of token management.
+func (s *Store) RevokeAdminToken(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var role string
+	err = tx.QueryRow("SELECT role FROM admin_tokens WHERE id = ? AND revoked_at IS NULL", id).Scan(&role)
+	if err == sql.ErrNoRows {
+		return ErrAdminTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if AdminRole(role) == RoleOwner {
+		var owners int
+		if err := tx.QueryRow("SELECT COUNT(1) FROM admin_tokens WHERE role = ? AND revoked_at IS NULL", string(RoleOwner)).Scan(&owners); err != nil {
+			return err
+		}
+		if owners <= 1 {
+			return ErrLastOwnerToken
+		}
+	}
+	if _, err := tx.Exec("UPDATE admin_tokens SET revoked_at = ? WHERE id = ?", nowUTC(), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const adminTokenSelect = `SELECT id, name, role, created_at, IFNULL(last_used_at, ''), IFNULL(revoked_at, '') FROM admin_tokens`
+
+func scanAdminToken(row rowScanner) (AdminToken, error) {
+	var token AdminToken
+	var role, createdAt, lastUsedAt, revokedAt string
+	if err := row.Scan(&token.ID, &token.Name, &role, &createdAt, &lastUsedAt, &revokedAt); err != nil {
+		return AdminToken{}, err
+	}
+	token.Role = AdminRole(role)
+	token.CreatedAt = parseTime(createdAt)
+	token.LastUsedAt = parseTime(lastUsedAt)
+	token.RevokedAt = parseTime(revokedAt)
+	return token, nil
+}
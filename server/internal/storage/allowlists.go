@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var ErrTunnelNotFound = errors.New("tunnel not found")
+
+// TunnelAllowlist holds the CIDRs a tunnel's client registered with and
+// those set by an operator. Mode says how they combine, "intersect" or
+// "override", and is empty while Server is.
+type TunnelAllowlist struct {
+	TunnelID string
+	Client   []string
+	Server   []string
+	Mode     string
+}
+
+func (s *Store) GetTunnelAllowlist(tunnelID string) (TunnelAllowlist, error) {
+	allowlist := TunnelAllowlist{TunnelID: tunnelID}
+	err := s.db.QueryRow("SELECT allowlist_mode FROM tunnels WHERE id = ?", tunnelID).Scan(&allowlist.Mode)
+	if err == sql.ErrNoRows {
+		return allowlist, ErrTunnelNotFound
+	}
+	if err != nil {
+		return allowlist, err
+	}
+	rows, err := s.db.Query("SELECT source, cidr FROM ip_allowlists WHERE tunnel_id = ? ORDER BY id ASC", tunnelID)
+	if err != nil {
+		return allowlist, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var source, cidr string
+		if err := rows.Scan(&source, &cidr); err != nil {
+			return allowlist, err
+		}
+		if source == "server" {
+			allowlist.Server = append(allowlist.Server, cidr)
+		} else {
+			allowlist.Client = append(allowlist.Client, cidr)
+		}
+	}
+	return allowlist, rows.Err()
+}
+
+// SetServerAllowlist replaces a tunnel's operator-set CIDRs. An empty list
+// clears them and the mode, leaving the client's allowlist in charge.
+func (s *Store) SetServerAllowlist(tunnelID string, cidrs []string, mode string) (TunnelAllowlist, error) {
+	normalized, err := normalizeCIDRs(cidrs)
+	if err != nil {
+		return TunnelAllowlist{}, err
+	}
+	switch {
+	case len(normalized) == 0:
+		mode = ""
+	case mode == "":
+		mode = "intersect"
+	case mode != "intersect" && mode != "override":
+		return TunnelAllowlist{}, fmt.Errorf("invalid allowlist mode %q", mode)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return TunnelAllowlist{}, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("UPDATE tunnels SET allowlist_mode = ? WHERE id = ?", mode, tunnelID)
+	if err != nil {
+		return TunnelAllowlist{}, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return TunnelAllowlist{}, ErrTunnelNotFound
+	}
+	if err := replaceAllowlist(tx, tunnelID, "server", normalized); err != nil {
+		return TunnelAllowlist{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return TunnelAllowlist{}, err
+	}
+	return s.GetTunnelAllowlist(tunnelID)
+}
+
+// SetClientAllowlist records the CIDRs a TCP or UDP tunnel's client
+// registered with; HTTP tunnels store theirs with the reservation.
+func (s *Store) SetClientAllowlist(tunnelID string, cidrs []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := replaceAllowlist(tx, tunnelID, "client", cidrs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceAllowlist(db execer, tunnelID, source string, cidrs []string) error {
+	if _, err := db.Exec("DELETE FROM ip_allowlists WHERE tunnel_id = ? AND source = ?", tunnelID, source); err != nil {
+		return err
+	}
+	for _, cidr := range cidrs {
+		if _, err := db.Exec("INSERT OR IGNORE INTO ip_allowlists (tunnel_id, source, cidr, created_at) VALUES (?, ?, ?, ?)", tunnelID, source, cidr, nowUTC()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeCIDRs validates CIDRs and returns them in canonical form, without
+// blanks or duplicates.
+func normalizeCIDRs(cidrs []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, value := range cidrs {
+		trimmed := strings.TrimSpace(value)
+		if trimmed == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", trimmed)
+		}
+		if !seen[network.String()] {
+			seen[network.String()] = true
+			normalized = append(normalized, network.String())
+		}
+	}
+	return normalized, nil
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestServerAllowlistSurvivesReregistration(t *testing.T) {
+	store := openMigratedStore(t)
+	if _, err := store.SetServerAllowlist("missing", []string{"10.0.0.0/8"}, ""); !errors.Is(err, ErrTunnelNotFound) {
+		t.Fatalf("expected ErrTunnelNotFound, got %v", err)
+	}
+	if err := store.UpsertTunnel(Tunnel{ID: "t1", Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 3000}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+	if err := store.UpsertHTTPReservation(HTTPReservation{TunnelID: "t1", Subdomain: "app", Allowlist: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatalf("upsert reservation failed: %v", err)
+	}
+	if _, err := store.SetServerAllowlist("t1", []string{"10.1.2.3/16", "10.1.0.0/16"}, "bogus"); err == nil {
+		t.Fatalf("expected invalid mode rejected")
+	}
+	set, err := store.SetServerAllowlist("t1", []string{"10.1.2.3/16", "10.1.0.0/16"}, "")
+	if err != nil {
+		t.Fatalf("set allowlist failed: %v", err)
+	}
+	if !reflect.DeepEqual(set.Server, []string{"10.1.0.0/16"}) || set.Mode != "intersect" {
+		t.Fatalf("expected normalised server allowlist, got %+v", set)
+	}
+
+	// A reconnecting client replaces only its own entries.
+	if err := store.UpsertHTTPReservation(HTTPReservation{TunnelID: "t1", Subdomain: "app", Allowlist: []string{"10.1.0.0/16"}}); err != nil {
+		t.Fatalf("upsert reservation failed: %v", err)
+	}
+	got, err := store.GetTunnelAllowlist("t1")
+	if err != nil {
+		t.Fatalf("get allowlist failed: %v", err)
+	}
+	if !reflect.DeepEqual(got.Client, []string{"10.1.0.0/16"}) || !reflect.DeepEqual(got.Server, []string{"10.1.0.0/16"}) {
+		t.Fatalf("unexpected allowlist %+v", got)
+	}
+
+	cleared, err := store.SetServerAllowlist("t1", nil, "override")
+	if err != nil {
+		t.Fatalf("clear allowlist failed: %v", err)
+	}
+	if len(cleared.Server) != 0 || cleared.Mode != "" {
+		t.Fatalf("expected cleared allowlist, got %+v", cleared)
+	}
+}
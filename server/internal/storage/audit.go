@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Audit actions. Admin actions are named after the resource they change;
+// relay.auth_failed records rejected CLI handshakes.
+const (
+	AuditTunnelTerminate   = "tunnel.terminate"
+	AuditTunnelAllowlist   = "tunnel.allowlist"
+	AuditTunnelRateLimit   = "tunnel.rate_limit"
+	AuditDenylistUpdate    = "denylist.update"
+	AuditBanClear          = "ban.clear"
+	AuditDomainUpsert      = "domain.upsert"
+	AuditReservationCreate = "reservation.create"
+	AuditReservationUpdate = "reservation.update"
+	AuditReservationDelete = "reservation.delete"
+	AuditRelayTokenRotate  = "relay_token.rotate"
+	AuditTokenCreate       = "token.create"
+	AuditTokenRevoke       = "token.revoke"
+	AuditTokenRotate       = "token.rotate"
+	AuditAdminTokenCreate  = "admin_token.create"
+	AuditAdminTokenRevoke  = "admin_token.revoke"
+	AuditWebhookCreate     = "webhook.create"
+	AuditWebhookDelete     = "webhook.delete"
+	AuditRelayAuthFailed   = "relay.auth_failed"
+)
+
+// AuditEntry records who changed what. Before and After hold JSON snapshots
+// of the target and are empty when there is nothing to show; secrets are
+// never included.
+type AuditEntry struct {
+	ID         int64
+	Timestamp  time.Time
+	ActorID    int64
+	Actor      string
+	ActorRole  AdminRole
+	RemoteAddr string
+	Action     string
+	Target     string
+	Before     json.RawMessage
+	After      json.RawMessage
+}
+
+// AuditQuery filters the audit log. Zero fields match everything.
+type AuditQuery struct {
+	Actor      string
+	Action     string
+	Target     string
+	RemoteAddr string
+	Since      time.Time
+	Until      time.Time
+	// BeforeID continues a listing below the smallest ID already seen.
+	BeforeID int64
+	Limit    int
+}
+
+func (s *Store) InsertAudit(entry AuditEntry) error {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now().UTC()
+	}
+	_, err := s.db.Exec(`INSERT INTO audit_log (ts, actor_id, actor, actor_role, remote_addr, action, target, before_value, after_value)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Timestamp.UTC().Format(time.RFC3339), entry.ActorID, entry.Actor, string(entry.ActorRole), entry.RemoteAddr,
+		entry.Action, entry.Target, string(entry.Before), string(entry.After))
+	return err
+}
+
+// ListAudit returns matching audit entries newest first.
+func (s *Store) ListAudit(q AuditQuery) ([]AuditEntry, error) {
+	if q.Limit <= 0 {
+		q.Limit = 200
+	}
+	var where []string
+	var args []any
+	if q.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, q.Actor)
+	}
+	if q.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, strings.ToLower(q.Action))
+	}
+	if q.Target != "" {
+		where = append(where, "target = ?")
+		args = append(args, q.Target)
+	}
+	if remote := strings.TrimSpace(q.RemoteAddr); remote != "" {
+		where = append(where, "(remote_addr = ? OR (remote_addr >= ? AND remote_addr < ?) OR (remote_addr >= ? AND remote_addr < ?))")
+		args = append(args, remote, remote+":", remote+";", "["+remote+"]:", "["+remote+"];")
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "ts >= ?")
+		args = append(args, q.Since.UTC().Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "ts < ?")
+		args = append(args, q.Until.UTC().Format(time.RFC3339))
+	}
+	if q.BeforeID > 0 {
+		where = append(where, "id < ?")
+		args = append(args, q.BeforeID)
+	}
+
+	query := `SELECT id, ts, actor_id, actor, actor_role, remote_addr, action, target, before_value, after_value FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var ts, role, before, after string
+		if err := rows.Scan(&entry.ID, &ts, &entry.ActorID, &entry.Actor, &role, &entry.RemoteAddr, &entry.Action, &entry.Target, &before, &after); err != nil {
+			return nil, err
+		}
+		entry.Timestamp = parseTime(ts)
+		entry.ActorRole = AdminRole(role)
+		if before != "" {
+			entry.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			entry.After = json.RawMessage(after)
+		}
+		results = append(results, entry)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrBanNotFound = errors.New("ban not found")
+
+// Ban blocks a single remote IP until ExpiresAt.
+type Ban struct {
+	IP        string
+	Reason    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Denylist holds the CIDRs denied for one tunnel, or for every tunnel and
+// the relay endpoint when TunnelID is empty.
+type Denylist struct {
+	TunnelID string
+	CIDRs    []string
+}
+
+func (s *Store) GetDenylist(tunnelID string) (Denylist, error) {
+	denylist := Denylist{TunnelID: tunnelID, CIDRs: []string{}}
+	if err := s.checkDenylistTunnel(tunnelID); err != nil {
+		return denylist, err
+	}
+	rows, err := s.db.Query("SELECT cidr FROM ip_denylists WHERE tunnel_id = ? ORDER BY id ASC", tunnelID)
+	if err != nil {
+		return denylist, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cidr string
+		if err := rows.Scan(&cidr); err != nil {
+			return denylist, err
+		}
+		denylist.CIDRs = append(denylist.CIDRs, cidr)
+	}
+	return denylist, rows.Err()
+}
+
+// SetDenylist replaces the CIDRs denied for a tunnel, or globally when
+// tunnelID is empty. An empty list clears it.
+func (s *Store) SetDenylist(tunnelID string, cidrs []string) (Denylist, error) {
+	normalized, err := normalizeCIDRs(cidrs)
+	if err != nil {
+		return Denylist{}, err
+	}
+	if err := s.checkDenylistTunnel(tunnelID); err != nil {
+		return Denylist{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Denylist{}, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM ip_denylists WHERE tunnel_id = ?", tunnelID); err != nil {
+		return Denylist{}, err
+	}
+	for _, cidr := range normalized {
+		if _, err := tx.Exec("INSERT INTO ip_denylists (tunnel_id, cidr, created_at) VALUES (?, ?, ?)", tunnelID, cidr, nowUTC()); err != nil {
+			return Denylist{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Denylist{}, err
+	}
+	return s.GetDenylist(tunnelID)
+}
+
+// ListDenylists returns every deny rule keyed by tunnel ID; global rules are
+// under "".
+func (s *Store) ListDenylists() (map[string][]string, error) {
+	rows, err := s.db.Query("SELECT tunnel_id, cidr FROM ip_denylists ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lists := make(map[string][]string)
+	for rows.Next() {
+		var tunnelID, cidr string
+		if err := rows.Scan(&tunnelID, &cidr); err != nil {
+			return nil, err
+		}
+		lists[tunnelID] = append(lists[tunnelID], cidr)
+	}
+	return lists, rows.Err()
+}
+
+func (s *Store) checkDenylistTunnel(tunnelID string) error {
+	if tunnelID == "" {
+		return nil
+	}
+	var id string
+	err := s.db.QueryRow("SELECT id FROM tunnels WHERE id = ?", tunnelID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrTunnelNotFound
+	}
+	return err
+}
+
+// PutBan records a ban, replacing any existing ban on the same IP.
+func (s *Store) PutBan(ban Ban) error {
+	created := ban.CreatedAt
+	if created.IsZero() {
+		created = time.Now()
+	}
+	_, err := s.db.Exec("INSERT OR REPLACE INTO ip_bans (ip, reason, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		ban.IP, ban.Reason, created.UTC().Format(time.RFC3339), ban.ExpiresAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+// ListBans returns the bans that have not yet expired, soonest expiry first.
+func (s *Store) ListBans() ([]Ban, error) {
+	rows, err := s.db.Query("SELECT ip, reason, created_at, expires_at FROM ip_bans WHERE expires_at > ? ORDER BY expires_at ASC", nowUTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bans := []Ban{}
+	for rows.Next() {
+		var ban Ban
+		var createdAt, expiresAt string
+		if err := rows.Scan(&ban.IP, &ban.Reason, &createdAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		ban.CreatedAt = parseTime(createdAt)
+		ban.ExpiresAt = parseTime(expiresAt)
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// DeleteBan lifts the ban on ip, expired or not.
+func (s *Store) DeleteBan(ip string) error {
+	result, err := s.db.Exec("DELETE FROM ip_bans WHERE ip = ?", ip)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrBanNotFound
+	}
+	return nil
+}
+
+// DeleteExpiredBans prunes bans whose cooldown has passed.
+func (s *Store) DeleteExpiredBans() (int64, error) {
+	result, err := s.db.Exec("DELETE FROM ip_bans WHERE expires_at <= ?", nowUTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recorder accepts traffic logs and metrics. *Store writes each call in its
+// own statement; *BatchWriter buffers them and writes in batches.
+type Recorder interface {
+	InsertLog(entry LogEntry) error
+	AddMetric(tunnelID string, ts time.Time, reqCount, connCount, bytesIn, bytesOut int64) error
+	AddHTTPMetric(tunnelID string, ts time.Time, sample HTTPSample) error
+}
+
+// ErrWriterFull is returned when a record is dropped because the batch
+// writer's queue is full or the writer is closed.
+var ErrWriterFull = errors.New("batch writer queue full")
+
+// maxBatchLogs flushes early once this many log rows are pending.
+const maxBatchLogs = 1000
+
+// BatchStats counts what a BatchWriter has done with the records it received.
+type BatchStats struct {
+	Queued  int64
+	Dropped int64
+	Written int64
+	Failed  int64
+}
+
+type record struct {
+	log    *LogEntry
+	key    rollupKey
+	metric rollupDelta
+	http   *HTTPSample
+}
+
+// BatchWriter queues logs and metric deltas off the request path. Log rows
+// are appended and metric deltas are summed per tunnel and minute in memory,
+// then everything pending is written in one transaction every interval. When
+// the queue is full new records are dropped and counted rather than blocking
+// the caller.
+type BatchWriter struct {
+	store    *Store
+	interval time.Duration
+	queue    chan record
+	done     chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	queued  atomic.Int64
+	dropped atomic.Int64
+	written atomic.Int64
+	failed  atomic.Int64
+}
+
+// NewBatchWriter starts a writer that flushes every interval and holds up to
+// capacity records between flushes.
+func NewBatchWriter(store *Store, interval time.Duration, capacity int) *BatchWriter {
+	if interval <= 0 {
+		interval = 250 * time.Millisecond
+	}
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	w := &BatchWriter{
+		store:    store,
+		interval: interval,
+		queue:    make(chan record, capacity),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *BatchWriter) InsertLog(entry LogEntry) error {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now().UTC()
+	}
+	return w.enqueue(record{log: &entry})
+}
+
+func (w *BatchWriter) AddMetric(tunnelID string, ts time.Time, reqCount, connCount, bytesIn, bytesOut int64) error {
+	if tunnelID == "" {
+		return nil
+	}
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
+	return w.enqueue(record{
+		key:    rollupKey{tunnelID, ts.Unix() / 60},
+		metric: rollupDelta{reqs: reqCount, conns: connCount, bytesIn: bytesIn, bytesOut: bytesOut},
+	})
+}
+
+func (w *BatchWriter) AddHTTPMetric(tunnelID string, ts time.Time, sample HTTPSample) error {
+	if tunnelID == "" {
+		return nil
+	}
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
+	return w.enqueue(record{key: rollupKey{tunnelID, ts.Unix() / 60}, http: &sample})
+}
+
+func (w *BatchWriter) enqueue(rec record) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.dropped.Add(1)
+		return ErrWriterFull
+	}
+	select {
+	case w.queue <- rec:
+		w.queued.Add(1)
+		return nil
+	default:
+		w.dropped.Add(1)
+		return ErrWriterFull
+	}
+}
+
+// Stats reports the writer's counters.
+func (w *BatchWriter) Stats() BatchStats {
+	return BatchStats{
+		Queued:  w.queued.Load(),
+		Dropped: w.dropped.Load(),
+		Written: w.written.Load(),
+		Failed:  w.failed.Load(),
+	}
+}
+
+// Close stops accepting records and waits for everything queued to be
+// written.
+func (w *BatchWriter) Close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		<-w.done
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+	<-w.done
+}
+
+// batch is the set of records waiting for the next flush. merged counts the
+// records summed into each metric delta.
+type batch struct {
+	logs    []LogEntry
+	metrics map[rollupKey]*rollupDelta
+	merged  map[rollupKey]int64
+	count   int64
+}
+
+func (b *batch) add(rec record) {
+	b.count++
+	if rec.log != nil {
+		b.logs = append(b.logs, *rec.log)
+		return
+	}
+	if b.metrics == nil {
+		b.metrics = make(map[rollupKey]*rollupDelta)
+		b.merged = make(map[rollupKey]int64)
+	}
+	b.merged[rec.key]++
+	delta := b.metrics[rec.key]
+	if delta == nil {
+		delta = &rollupDelta{}
+		b.metrics[rec.key] = delta
+	}
+	if rec.http != nil {
+		delta.addHTTP(*rec.http)
+		return
+	}
+	delta.reqs += rec.metric.reqs
+	delta.conns += rec.metric.conns
+	delta.bytesIn += rec.metric.bytesIn
+	delta.bytesOut += rec.metric.bytesOut
+}
+
+func (w *BatchWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	var pending batch
+	for {
+		select {
+		case rec, ok := <-w.queue:
+			if !ok {
+				w.flush(&pending)
+				return
+			}
+			pending.add(rec)
+			if len(pending.logs) >= maxBatchLogs {
+				w.flush(&pending)
+			}
+		case <-ticker.C:
+			w.flush(&pending)
+		}
+	}
+}
+
+func (w *BatchWriter) flush(pending *batch) {
+	if pending.count == 0 {
+		return
+	}
+	count := pending.count
+	err := w.write(pending)
+	if err == nil {
+		*pending = batch{}
+		w.written.Add(count)
+		return
+	}
+	// One bad row, such as a log for a tunnel that has no row, rolls back the
+	// whole transaction. Retry each record alone so only bad ones are lost.
+	failed, err := w.writeEach(pending)
+	*pending = batch{}
+	w.written.Add(count - failed)
+	if failed > 0 {
+		w.failed.Add(failed)
+		log.Printf("batch write failed for %d of %d records: %v", failed, count, err)
+	}
+}
+
+func (w *BatchWriter) write(pending *batch) error {
+	tx, err := w.store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, entry := range pending.logs {
+		if err := insertLog(tx, entry); err != nil {
+			return err
+		}
+	}
+	for key, delta := range pending.metrics {
+		if err := delta.write(tx, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// writeEach writes every log row and metric delta in its own transaction. It
+// returns how many records failed and the last error.
+func (w *BatchWriter) writeEach(pending *batch) (int64, error) {
+	var failed int64
+	var lastErr error
+	for _, entry := range pending.logs {
+		if err := insertLog(w.store.db, entry); err != nil {
+			failed++
+			lastErr = err
+		}
+	}
+	for key, delta := range pending.metrics {
+		if err := w.writeDelta(key, delta); err != nil {
+			failed += pending.merged[key]
+			lastErr = err
+		}
+	}
+	return failed, lastErr
+}
+
+func (w *BatchWriter) writeDelta(key rollupKey, delta *rollupDelta) error {
+	tx, err := w.store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := delta.write(tx, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
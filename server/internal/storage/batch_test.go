@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatchWriterAggregatesAndFlushesOnClose(t *testing.T) {
+	store := openMigratedStore(t)
+	if err := store.UpsertTunnel(Tunnel{ID: "tunnel-1", Protocol: "udp", LocalHost: "127.0.0.1", LocalPort: 5353}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+
+	writer := NewBatchWriter(store, time.Hour, 100)
+	ts := time.Unix(1_700_000_000, 0).UTC()
+	for i := 0; i < 10; i++ {
+		if err := writer.InsertLog(LogEntry{TunnelID: "tunnel-1", Timestamp: ts, Kind: "udp", Summary: "udp port 5353", BytesIn: 8}); err != nil {
+			t.Fatalf("insert log failed: %v", err)
+		}
+		if err := writer.AddMetric("tunnel-1", ts, 0, 1, 8, 0); err != nil {
+			t.Fatalf("add metric failed: %v", err)
+		}
+	}
+	if err := writer.AddHTTPMetric("tunnel-1", ts, HTTPSample{Status: 503, RelayError: true}); err != nil {
+		t.Fatalf("add http metric failed: %v", err)
+	}
+	writer.Close()
+
+	if err := writer.InsertLog(LogEntry{TunnelID: "tunnel-1"}); err != ErrWriterFull {
+		t.Fatalf("expected closed writer to drop records, got %v", err)
+	}
+	stats := writer.Stats()
+	if stats.Queued != 21 || stats.Written != 21 || stats.Dropped != 1 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	logs, err := store.ListLogs(100)
+	if err != nil {
+		t.Fatalf("list logs failed: %v", err)
+	}
+	if len(logs) != 10 {
+		t.Fatalf("expected 10 logs, got %d", len(logs))
+	}
+	rollups, err := store.ListMetrics(10)
+	if err != nil {
+		t.Fatalf("list metrics failed: %v", err)
+	}
+	if len(rollups) != 1 || rollups[0].ConnCount != 10 || rollups[0].BytesIn != 80 || rollups[0].ReqCount != 1 || rollups[0].RelayErrors != 1 {
+		t.Fatalf("unexpected rollups: %+v", rollups)
+	}
+}
+
+func TestBatchWriterDropsWhenQueueFull(t *testing.T) {
+	store := openMigratedStore(t)
+	writer := &BatchWriter{store: store, queue: make(chan record, 1), done: make(chan struct{})}
+	if err := writer.InsertLog(LogEntry{}); err != nil {
+		t.Fatalf("first insert failed: %v", err)
+	}
+	if err := writer.InsertLog(LogEntry{}); err != ErrWriterFull {
+		t.Fatalf("expected ErrWriterFull, got %v", err)
+	}
+	if stats := writer.Stats(); stats.Queued != 1 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBatchWriterKeepsGoodRecordsWhenOneFails(t *testing.T) {
+	store := openMigratedStore(t)
+	if err := store.UpsertTunnel(Tunnel{ID: "tunnel-1", Protocol: "tcp", LocalHost: "127.0.0.1", LocalPort: 22}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+
+	writer := NewBatchWriter(store, time.Hour, 100)
+	ts := time.Unix(1_700_000_000, 0).UTC()
+	for _, tunnelID := range []string{"tunnel-1", "missing", "tunnel-1"} {
+		if err := writer.InsertLog(LogEntry{TunnelID: tunnelID, Timestamp: ts, Kind: "tcp"}); err != nil {
+			t.Fatalf("insert log failed: %v", err)
+		}
+		if err := writer.AddMetric(tunnelID, ts, 0, 1, 0, 0); err != nil {
+			t.Fatalf("add metric failed: %v", err)
+		}
+	}
+	writer.Close()
+
+	if stats := writer.Stats(); stats.Written != 4 || stats.Failed != 2 {
+		t.Fatalf("expected 4 written and 2 failed, got %+v", stats)
+	}
+	logs, err := store.ListLogs(100)
+	if err != nil {
+		t.Fatalf("list logs failed: %v", err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 logs kept, got %d", len(logs))
+	}
+	rollups, err := store.ListMetrics(10)
+	if err != nil {
+		t.Fatalf("list metrics failed: %v", err)
+	}
+	if len(rollups) != 1 || rollups[0].TunnelID != "tunnel-1" || rollups[0].ConnCount != 2 {
+		t.Fatalf("unexpected rollups: %+v", rollups)
+	}
+}
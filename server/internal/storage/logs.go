@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned for a pagination cursor QueryLogs did not issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// LogQuery filters access logs. Zero fields match everything.
+type LogQuery struct {
+	TunnelID string
+	Kind     string
+	// RemoteAddr matches either the exact stored address or any port of the
+	// given IP.
+	RemoteAddr string
+	StatusMin  int
+	StatusMax  int
+	Since      time.Time
+	Until      time.Time
+	// Cursor continues from the page that returned it.
+	Cursor string
+	Limit  int
+}
+
+// QueryLogs returns matching logs newest first and a cursor for the next
+// page, which is empty once there are no more rows.
+func (s *Store) QueryLogs(q LogQuery) ([]LogEntry, string, error) {
+	if q.Limit <= 0 {
+		q.Limit = 200
+	}
+	var where []string
+	var args []any
+	if q.TunnelID != "" {
+		where = append(where, "tunnel_id = ?")
+		args = append(args, q.TunnelID)
+	}
+	if q.Kind != "" {
+		where = append(where, "kind = ?")
+		args = append(args, strings.ToLower(q.Kind))
+	}
+	if remote := strings.TrimSpace(q.RemoteAddr); remote != "" {
+		// Range scans keep the remote_addr index usable: "ip:" up to "ip;"
+		// covers every port.
+		where = append(where, "(remote_addr = ? OR (remote_addr >= ? AND remote_addr < ?) OR (remote_addr >= ? AND remote_addr < ?))")
+		args = append(args, remote, remote+":", remote+";", "["+remote+"]:", "["+remote+"];")
+	}
+	if q.StatusMin > 0 {
+		where = append(where, "status_code >= ?")
+		args = append(args, q.StatusMin)
+	}
+	if q.StatusMax > 0 {
+		where = append(where, "status_code <= ?")
+		args = append(args, q.StatusMax)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "ts >= ?")
+		args = append(args, q.Since.UTC().Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "ts < ?")
+		args = append(args, q.Until.UTC().Format(time.RFC3339))
+	}
+	if q.Cursor != "" {
+		ts, id, err := decodeLogCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, "(ts < ? OR (ts = ? AND id < ?))")
+		args = append(args, ts, ts, id)
+	}
+
+	query := `SELECT id, IFNULL(tunnel_id,''), ts, kind, IFNULL(remote_addr,''), IFNULL(summary,''), IFNULL(status_code,0), IFNULL(bytes_in,0), IFNULL(bytes_out,0) FROM logs`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY ts DESC, id DESC LIMIT ?"
+	// One extra row tells us whether another page exists.
+	args = append(args, q.Limit+1)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var results []LogEntry
+	var lastTS string
+	for rows.Next() {
+		var entry LogEntry
+		var ts string
+		if err := rows.Scan(&entry.ID, &entry.TunnelID, &ts, &entry.Kind, &entry.RemoteAddr, &entry.Summary, &entry.Status, &entry.BytesIn, &entry.BytesOut); err != nil {
+			return nil, "", err
+		}
+		if len(results) == q.Limit {
+			return results, encodeLogCursor(lastTS, results[len(results)-1].ID), nil
+		}
+		if parsed, err := time.Parse(time.RFC3339, ts); err == nil {
+			entry.Timestamp = parsed
+		}
+		lastTS = ts
+		results = append(results, entry)
+	}
+	return results, "", rows.Err()
+}
+
+func encodeLogCursor(ts string, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(ts + "|" + strconv.FormatInt(id, 10)))
+}
+
+func decodeLogCursor(cursor string) (string, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, ErrInvalidCursor
+	}
+	ts, idText, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return "", 0, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		return "", 0, ErrInvalidCursor
+	}
+	return ts, id, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryLogsFiltersAndPaginates(t *testing.T) {
+	store := openMigratedStore(t)
+	for _, id := range []string{"tunnel-1", "tunnel-2"} {
+		if err := store.UpsertTunnel(Tunnel{ID: id, Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 8080}); err != nil {
+			t.Fatalf("upsert tunnel failed: %v", err)
+		}
+	}
+
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	entries := []LogEntry{
+		{TunnelID: "tunnel-1", Timestamp: base, Kind: "http", RemoteAddr: "203.0.113.5:4000", Summary: "GET /a", Status: 200},
+		{TunnelID: "tunnel-1", Timestamp: base.Add(time.Minute), Kind: "http", RemoteAddr: "203.0.113.50:4000", Summary: "GET /b", Status: 404},
+		{TunnelID: "tunnel-1", Timestamp: base.Add(2 * time.Minute), Kind: "http", RemoteAddr: "203.0.113.5:4001", Summary: "GET /c", Status: 500},
+		{TunnelID: "tunnel-2", Timestamp: base.Add(3 * time.Minute), Kind: "tcp", RemoteAddr: "[2001:db8::1]:5000", Summary: "tcp port 7000"},
+		{TunnelID: "tunnel-1", Timestamp: base.Add(4 * time.Minute), Kind: "http", RemoteAddr: "203.0.113.5:4002", Summary: "GET /d", Status: 502},
+	}
+	for _, entry := range entries {
+		if err := store.InsertLog(entry); err != nil {
+			t.Fatalf("insert log failed: %v", err)
+		}
+	}
+
+	summaries := func(logs []LogEntry) []string {
+		var out []string
+		for _, entry := range logs {
+			out = append(out, entry.Summary)
+		}
+		return out
+	}
+
+	cases := []struct {
+		name  string
+		query LogQuery
+		want  []string
+	}{
+		{name: "tunnel and 5xx", query: LogQuery{TunnelID: "tunnel-1", StatusMin: 500, StatusMax: 599}, want: []string{"GET /d", "GET /c"}},
+		{name: "kind", query: LogQuery{Kind: "tcp"}, want: []string{"tcp port 7000"}},
+		{name: "remote ip", query: LogQuery{RemoteAddr: "203.0.113.5"}, want: []string{"GET /d", "GET /c", "GET /a"}},
+		{name: "remote ipv6", query: LogQuery{RemoteAddr: "2001:db8::1"}, want: []string{"tcp port 7000"}},
+		{name: "time window", query: LogQuery{Since: base.Add(time.Minute), Until: base.Add(3 * time.Minute)}, want: []string{"GET /c", "GET /b"}},
+	}
+	for _, tc := range cases {
+		logs, _, err := store.QueryLogs(tc.query)
+		if err != nil {
+			t.Fatalf("%s: query failed: %v", tc.name, err)
+		}
+		got := summaries(logs)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, got)
+			}
+		}
+	}
+
+	var pages [][]string
+	query := LogQuery{Limit: 2}
+	for {
+		logs, next, err := store.QueryLogs(query)
+		if err != nil {
+			t.Fatalf("page query failed: %v", err)
+		}
+		pages = append(pages, summaries(logs))
+		if next == "" {
+			break
+		}
+		query.Cursor = next
+	}
+	if len(pages) != 3 || pages[0][0] != "GET /d" || pages[1][0] != "GET /c" || len(pages[2]) != 1 || pages[2][0] != "GET /a" {
+		t.Fatalf("unexpected pages: %v", pages)
+	}
+
+	if _, _, err := store.QueryLogs(LogQuery{Cursor: "not-a-cursor"}); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+}
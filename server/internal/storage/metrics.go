@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// LatencyBucketsMillis are the upper bounds of the latency histogram buckets.
+// Histograms carry one extra overflow bucket after the last bound.
+var LatencyBucketsMillis = []int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+const (
+	latencyEdge     = "edge"
+	latencyUpstream = "upstream"
+	overflowBucket  = -1
+)
+
+// LatencyHistogram counts samples per bucket of LatencyBucketsMillis, followed
+// by the overflow bucket.
+type LatencyHistogram []int64
+
+func newLatencyHistogram() LatencyHistogram {
+	return make(LatencyHistogram, len(LatencyBucketsMillis)+1)
+}
+
+// Count is the number of samples in the histogram.
+func (h LatencyHistogram) Count() int64 {
+	var total int64
+	for _, n := range h {
+		total += n
+	}
+	return total
+}
+
+// Merge adds other's counts to h.
+func (h LatencyHistogram) Merge(other LatencyHistogram) {
+	for i := range h {
+		if i < len(other) {
+			h[i] += other[i]
+		}
+	}
+}
+
+// Quantile estimates the q-th quantile in milliseconds by interpolating within
+// the bucket that holds it. Samples in the overflow bucket report the last
+// bound. An empty histogram reports zero.
+func (h LatencyHistogram) Quantile(q float64) float64 {
+	total := h.Count()
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen int64
+	for i, n := range h {
+		if n == 0 {
+			continue
+		}
+		if float64(seen+n) >= rank {
+			if i >= len(LatencyBucketsMillis) {
+				return float64(LatencyBucketsMillis[len(LatencyBucketsMillis)-1])
+			}
+			var lower float64
+			if i > 0 {
+				lower = float64(LatencyBucketsMillis[i-1])
+			}
+			upper := float64(LatencyBucketsMillis[i])
+			return lower + (upper-lower)*(rank-float64(seen))/float64(n)
+		}
+		seen += n
+	}
+	return float64(LatencyBucketsMillis[len(LatencyBucketsMillis)-1])
+}
+
+func latencyBucket(d time.Duration) int64 {
+	ms := d.Milliseconds()
+	for _, bound := range LatencyBucketsMillis {
+		if ms <= bound {
+			return bound
+		}
+	}
+	return overflowBucket
+}
+
+func latencyIndex(leMillis int64) int {
+	for i, bound := range LatencyBucketsMillis {
+		if leMillis != overflowBucket && leMillis <= bound {
+			return i
+		}
+	}
+	return len(LatencyBucketsMillis)
+}
+
+// HTTPSample is the outcome of one proxied HTTP request.
+type HTTPSample struct {
+	Status   int
+	BytesIn  int64
+	BytesOut int64
+	// RelayError marks requests the relay answered itself because the tunnel
+	// could not be reached; Status is then the relay's own error status.
+	RelayError bool
+	// Edge is the time from opening the relay stream to the response headers.
+	Edge time.Duration
+	// Upstream is the local service time reported by the client, if any.
+	Upstream time.Duration
+}
+
+// AddHTTPMetric folds one HTTP request into the tunnel's minute rollup and
+// latency histograms.
+func (s *Store) AddHTTPMetric(tunnelID string, ts time.Time, sample HTTPSample) error {
+	if tunnelID == "" {
+		return nil
+	}
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
+	var delta rollupDelta
+	delta.addHTTP(sample)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := delta.write(tx, rollupKey{tunnelID, ts.Unix() / 60}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+type rollupKey struct {
+	tunnelID     string
+	minuteBucket int64
+}
+
+// rollupDelta accumulates counter increments for one minute rollup.
+type rollupDelta struct {
+	reqs     int64
+	conns    int64
+	bytesIn  int64
+	bytesOut int64
+	// classes counts 2xx, 3xx, 4xx, 5xx and relay errors.
+	classes [5]int64
+	// edge and upstream count latency samples by bucket upper bound.
+	edge     map[int64]int64
+	upstream map[int64]int64
+}
+
+func (d *rollupDelta) addHTTP(sample HTTPSample) {
+	d.reqs++
+	d.bytesIn += sample.BytesIn
+	d.bytesOut += sample.BytesOut
+	if sample.RelayError {
+		d.classes[4]++
+	} else if sample.Status >= 200 && sample.Status < 600 {
+		d.classes[sample.Status/100-2]++
+	}
+	if sample.Edge > 0 {
+		if d.edge == nil {
+			d.edge = make(map[int64]int64)
+		}
+		d.edge[latencyBucket(sample.Edge)]++
+	}
+	if sample.Upstream > 0 {
+		if d.upstream == nil {
+			d.upstream = make(map[int64]int64)
+		}
+		d.upstream[latencyBucket(sample.Upstream)]++
+	}
+}
+
+func (d *rollupDelta) write(db execer, key rollupKey) error {
+	if err := addRollup(db, key, *d); err != nil {
+		return err
+	}
+	for leMillis, count := range d.edge {
+		if err := addLatency(db, key, latencyEdge, leMillis, count); err != nil {
+			return err
+		}
+	}
+	for leMillis, count := range d.upstream {
+		if err := addLatency(db, key, latencyUpstream, leMillis, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addRollup(db execer, key rollupKey, d rollupDelta) error {
+	_, err := db.Exec(`INSERT INTO metrics_rollup (tunnel_id, minute_bucket, req_count, conn_count, bytes_in, bytes_out,
+			status_2xx, status_3xx, status_4xx, status_5xx, relay_errors)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(tunnel_id, minute_bucket) DO UPDATE SET
+			req_count = req_count + excluded.req_count,
+			conn_count = conn_count + excluded.conn_count,
+			bytes_in = bytes_in + excluded.bytes_in,
+			bytes_out = bytes_out + excluded.bytes_out,
+			status_2xx = status_2xx + excluded.status_2xx,
+			status_3xx = status_3xx + excluded.status_3xx,
+			status_4xx = status_4xx + excluded.status_4xx,
+			status_5xx = status_5xx + excluded.status_5xx,
+			relay_errors = relay_errors + excluded.relay_errors`,
+		key.tunnelID, key.minuteBucket, d.reqs, d.conns, d.bytesIn, d.bytesOut,
+		d.classes[0], d.classes[1], d.classes[2], d.classes[3], d.classes[4])
+	return err
+}
+
+func addLatency(db execer, key rollupKey, source string, leMillis, count int64) error {
+	_, err := db.Exec(`INSERT INTO metrics_latency (tunnel_id, minute_bucket, source, le_ms, count)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(tunnel_id, minute_bucket, source, le_ms) DO UPDATE SET count = count + excluded.count`,
+		key.tunnelID, key.minuteBucket, source, leMillis, count)
+	return err
+}
+
+// attachLatency loads the latency histograms for the given rollups.
+func (s *Store) attachLatency(rollups []MetricRollup) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+	oldest := rollups[0].MinuteBucket
+	index := make(map[rollupKey]int, len(rollups))
+	for i, rollup := range rollups {
+		if rollup.MinuteBucket < oldest {
+			oldest = rollup.MinuteBucket
+		}
+		index[rollupKey{rollup.TunnelID, rollup.MinuteBucket}] = i
+	}
+	rows, err := s.db.Query(`SELECT tunnel_id, minute_bucket, source, le_ms, count
+		FROM metrics_latency WHERE minute_bucket >= ?`, oldest)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tunnelID, source string
+		var minuteBucket, leMillis, count int64
+		if err := rows.Scan(&tunnelID, &minuteBucket, &source, &leMillis, &count); err != nil {
+			return err
+		}
+		i, ok := index[rollupKey{tunnelID, minuteBucket}]
+		if !ok {
+			continue
+		}
+		target := &rollups[i].EdgeLatency
+		if source == latencyUpstream {
+			target = &rollups[i].UpstreamLatency
+		}
+		if *target == nil {
+			*target = newLatencyHistogram()
+		}
+		(*target)[latencyIndex(leMillis)] += count
+	}
+	return rows.Err()
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddHTTPMetricRollsUpStatusesAndLatency(t *testing.T) {
+	store := openMigratedStore(t)
+	if err := store.UpsertTunnel(Tunnel{ID: "tunnel-1", Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 8080}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+
+	ts := time.Unix(1_700_000_000, 0).UTC()
+	samples := []HTTPSample{
+		{Status: 200, BytesIn: 10, BytesOut: 100, Edge: 20 * time.Millisecond, Upstream: 4 * time.Millisecond},
+		{Status: 204, Edge: 30 * time.Millisecond, Upstream: 8 * time.Millisecond},
+		{Status: 302, Edge: 40 * time.Millisecond},
+		{Status: 404, Edge: 45 * time.Millisecond},
+		{Status: 500, Edge: 3 * time.Second},
+		{Status: 502, RelayError: true},
+	}
+	for _, sample := range samples {
+		if err := store.AddHTTPMetric("tunnel-1", ts, sample); err != nil {
+			t.Fatalf("add metric failed: %v", err)
+		}
+	}
+
+	rollups, err := store.ListMetrics(10)
+	if err != nil {
+		t.Fatalf("list metrics failed: %v", err)
+	}
+	if len(rollups) != 1 {
+		t.Fatalf("expected one rollup, got %d", len(rollups))
+	}
+	got := rollups[0]
+	if got.ReqCount != 6 || got.BytesIn != 10 || got.BytesOut != 100 {
+		t.Fatalf("unexpected counts: %+v", got)
+	}
+	if got.Status2xx != 2 || got.Status3xx != 1 || got.Status4xx != 1 || got.Status5xx != 1 || got.RelayErrors != 1 {
+		t.Fatalf("unexpected status classes: %+v", got)
+	}
+	if got.EdgeLatency.Count() != 5 || got.UpstreamLatency.Count() != 2 {
+		t.Fatalf("unexpected histogram counts: edge %d upstream %d", got.EdgeLatency.Count(), got.UpstreamLatency.Count())
+	}
+	if p50 := got.EdgeLatency.Quantile(0.5); p50 <= 25 || p50 > 50 {
+		t.Fatalf("expected edge p50 in (25, 50], got %v", p50)
+	}
+	if p99 := got.EdgeLatency.Quantile(0.99); p99 <= 2500 || p99 > 5000 {
+		t.Fatalf("expected edge p99 in (2500, 5000], got %v", p99)
+	}
+	if p50 := got.UpstreamLatency.Quantile(0.5); p50 > 5 {
+		t.Fatalf("expected upstream p50 at most 5, got %v", p50)
+	}
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	h := newLatencyHistogram()
+	if got := h.Quantile(0.5); got != 0 {
+		t.Fatalf("expected empty histogram to report 0, got %v", got)
+	}
+	h[latencyIndex(latencyBucket(time.Minute))] = 1
+	if got := h.Quantile(0.99); got != 10000 {
+		t.Fatalf("expected overflow to report the last bound, got %v", got)
+	}
+}
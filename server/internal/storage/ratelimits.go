@@ -0,0 +1,80 @@
+package storage
+
+import "database/sql"
+
+// RateLimit is a tunnel's per-second limits: Rate for the whole tunnel and
+// PerIP for each remote IP. Zero is unlimited.
+type RateLimit struct {
+	Rate       float64
+	Burst      int
+	PerIP      float64
+	PerIPBurst int
+}
+
+// TunnelRateLimit holds the limits a tunnel's client registered with and
+// those set by an operator. The stricter of the two applies.
+type TunnelRateLimit struct {
+	TunnelID string
+	Client   RateLimit
+	Server   RateLimit
+}
+
+func (s *Store) GetTunnelRateLimit(tunnelID string) (TunnelRateLimit, error) {
+	limits := TunnelRateLimit{TunnelID: tunnelID}
+	var id string
+	err := s.db.QueryRow("SELECT id FROM tunnels WHERE id = ?", tunnelID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return limits, ErrTunnelNotFound
+	}
+	if err != nil {
+		return limits, err
+	}
+	rows, err := s.db.Query("SELECT source, rate, burst, per_ip, per_ip_burst FROM tunnel_rate_limits WHERE tunnel_id = ?", tunnelID)
+	if err != nil {
+		return limits, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var source string
+		var limit RateLimit
+		if err := rows.Scan(&source, &limit.Rate, &limit.Burst, &limit.PerIP, &limit.PerIPBurst); err != nil {
+			return limits, err
+		}
+		if source == "server" {
+			limits.Server = limit
+		} else {
+			limits.Client = limit
+		}
+	}
+	return limits, rows.Err()
+}
+
+// SetServerRateLimit replaces a tunnel's operator-set limits; a zero limit
+// clears them.
+func (s *Store) SetServerRateLimit(tunnelID string, limit RateLimit) (TunnelRateLimit, error) {
+	if _, err := s.GetTunnelRateLimit(tunnelID); err != nil {
+		return TunnelRateLimit{}, err
+	}
+	if err := s.putRateLimit(tunnelID, "server", limit); err != nil {
+		return TunnelRateLimit{}, err
+	}
+	return s.GetTunnelRateLimit(tunnelID)
+}
+
+// SetClientRateLimit records the limits a tunnel's client registered with.
+func (s *Store) SetClientRateLimit(tunnelID string, limit RateLimit) error {
+	return s.putRateLimit(tunnelID, "client", limit)
+}
+
+func (s *Store) putRateLimit(tunnelID, source string, limit RateLimit) error {
+	if limit == (RateLimit{}) {
+		_, err := s.db.Exec("DELETE FROM tunnel_rate_limits WHERE tunnel_id = ? AND source = ?", tunnelID, source)
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO tunnel_rate_limits (tunnel_id, source, rate, burst, per_ip, per_ip_burst, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(tunnel_id, source) DO UPDATE SET rate = excluded.rate, burst = excluded.burst,
+	per_ip = excluded.per_ip, per_ip_burst = excluded.per_ip_burst, updated_at = excluded.updated_at`,
+		tunnelID, source, limit.Rate, limit.Burst, limit.PerIP, limit.PerIPBurst, nowUTC())
+	return err
+}
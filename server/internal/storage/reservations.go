@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrReservationExists   = errors.New("subdomain already reserved")
+	ErrInvalidSubdomain    = errors.New("invalid subdomain")
+	ErrUnknownOwner        = errors.New("owner token not found, revoked or expired")
+)
+
+// CreateHTTPReservation reserves a subdomain ahead of any client connecting.
+// A reservation with an owner can only be registered by that token; an
+// unowned one is claimed by the first token to register it.
+func (s *Store) CreateHTTPReservation(res HTTPReservation) (HTTPReservation, error) {
+	subdomain, err := cleanSubdomain(res.Subdomain)
+	if err != nil {
+		return HTTPReservation{}, err
+	}
+	if err := s.checkOwner(res.OwnerTokenID); err != nil {
+		return HTTPReservation{}, err
+	}
+	result, err := s.db.Exec(`INSERT INTO subdomains (subdomain, reserved, owner_token_id, created_at)
+		VALUES (?, 1, ?, ?) ON CONFLICT(subdomain) DO NOTHING`, subdomain, nullableID(res.OwnerTokenID), nowUTC())
+	if err != nil {
+		return HTTPReservation{}, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return HTTPReservation{}, ErrReservationExists
+	}
+	return HTTPReservation{Subdomain: subdomain, OwnerTokenID: res.OwnerTokenID}, nil
+}
+
+// UpdateHTTPReservation renames the reservation for subdomain to
+// res.Subdomain and sets its owner to res.OwnerTokenID; zero leaves it
+// unowned. The tunnel binding is kept.
+func (s *Store) UpdateHTTPReservation(subdomain string, res HTTPReservation) (HTTPReservation, error) {
+	current := strings.ToLower(strings.TrimSpace(subdomain))
+	renamed, err := cleanSubdomain(res.Subdomain)
+	if err != nil {
+		return HTTPReservation{}, err
+	}
+	if err := s.checkOwner(res.OwnerTokenID); err != nil {
+		return HTTPReservation{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return HTTPReservation{}, err
+	}
+	defer tx.Rollback()
+
+	var tunnelID sql.NullString
+	err = tx.QueryRow("SELECT tunnel_id FROM subdomains WHERE subdomain = ?", current).Scan(&tunnelID)
+	if err == sql.ErrNoRows {
+		return HTTPReservation{}, ErrReservationNotFound
+	}
+	if err != nil {
+		return HTTPReservation{}, err
+	}
+	if renamed != current {
+		var taken int
+		if err := tx.QueryRow("SELECT COUNT(1) FROM subdomains WHERE subdomain = ?", renamed).Scan(&taken); err != nil {
+			return HTTPReservation{}, err
+		}
+		if taken > 0 {
+			return HTTPReservation{}, ErrReservationExists
+		}
+	}
+	if _, err := tx.Exec("UPDATE subdomains SET subdomain = ?, owner_token_id = ? WHERE subdomain = ?",
+		renamed, nullableID(res.OwnerTokenID), current); err != nil {
+		return HTTPReservation{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return HTTPReservation{}, err
+	}
+	return HTTPReservation{Subdomain: renamed, TunnelID: tunnelID.String, OwnerTokenID: res.OwnerTokenID}, nil
+}
+
+// DeleteHTTPReservation frees a subdomain for any token to register.
+func (s *Store) DeleteHTTPReservation(subdomain string) error {
+	result, err := s.db.Exec("DELETE FROM subdomains WHERE subdomain = ?", strings.ToLower(strings.TrimSpace(subdomain)))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrReservationNotFound
+	}
+	return nil
+}
+
+func (s *Store) checkOwner(tokenID int64) error {
+	if tokenID == 0 {
+		return nil
+	}
+	token, ok, err := s.GetToken(tokenID)
+	if err != nil {
+		return err
+	}
+	if !ok || !token.RevokedAt.IsZero() || token.Expired(time.Now()) {
+		return ErrUnknownOwner
+	}
+	return nil
+}
+
+// cleanSubdomain lowercases a subdomain and checks it is a single DNS label.
+func cleanSubdomain(value string) (string, error) {
+	subdomain := strings.ToLower(strings.TrimSpace(value))
+	if subdomain == "" || len(subdomain) > 63 {
+		return "", fmt.Errorf("%w: must be 1 to 63 characters", ErrInvalidSubdomain)
+	}
+	if subdomain[0] == '-' || subdomain[len(subdomain)-1] == '-' {
+		return "", fmt.Errorf("%w: %q cannot start or end with a hyphen", ErrInvalidSubdomain, subdomain)
+	}
+	for _, c := range subdomain {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return "", fmt.Errorf("%w: %q may only contain letters, digits and hyphens", ErrInvalidSubdomain, subdomain)
+		}
+	}
+	return subdomain, nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHTTPReservationLifecycle(t *testing.T) {
+	store := openMigratedStore(t)
+	owner, err := store.CreateToken(Token{Name: "alice"}, "alice")
+	if err != nil {
+		t.Fatalf("create token failed: %v", err)
+	}
+	other, err := store.CreateToken(Token{Name: "bob"}, "bob")
+	if err != nil {
+		t.Fatalf("create token failed: %v", err)
+	}
+
+	for _, bad := range []string{"", "-app", "app-", "app.example", "app_1"} {
+		if _, err := store.CreateHTTPReservation(HTTPReservation{Subdomain: bad}); !errors.Is(err, ErrInvalidSubdomain) {
+			t.Fatalf("subdomain %q: expected ErrInvalidSubdomain, got %v", bad, err)
+		}
+	}
+	if _, err := store.CreateHTTPReservation(HTTPReservation{Subdomain: "app", OwnerTokenID: 999}); !errors.Is(err, ErrUnknownOwner) {
+		t.Fatalf("expected ErrUnknownOwner, got %v", err)
+	}
+
+	created, err := store.CreateHTTPReservation(HTTPReservation{Subdomain: " App ", OwnerTokenID: owner.ID})
+	if err != nil {
+		t.Fatalf("create reservation failed: %v", err)
+	}
+	if created.Subdomain != "app" {
+		t.Fatalf("expected normalised subdomain, got %q", created.Subdomain)
+	}
+	if _, err := store.CreateHTTPReservation(HTTPReservation{Subdomain: "app"}); !errors.Is(err, ErrReservationExists) {
+		t.Fatalf("expected ErrReservationExists, got %v", err)
+	}
+	if _, err := store.CreateHTTPReservation(HTTPReservation{Subdomain: "docs"}); err != nil {
+		t.Fatalf("create reservation failed: %v", err)
+	}
+	listed, err := store.ListHTTPReservations()
+	if err != nil || len(listed) != 2 {
+		t.Fatalf("expected 2 unbound reservations, got %+v (%v)", listed, err)
+	}
+
+	if _, err := store.UpdateHTTPReservation("app", HTTPReservation{Subdomain: "docs", OwnerTokenID: owner.ID}); !errors.Is(err, ErrReservationExists) {
+		t.Fatalf("expected rename onto docs to conflict, got %v", err)
+	}
+	updated, err := store.UpdateHTTPReservation("app", HTTPReservation{Subdomain: "web", OwnerTokenID: other.ID})
+	if err != nil {
+		t.Fatalf("update reservation failed: %v", err)
+	}
+	got, ok, err := store.GetHTTPReservation("web")
+	if err != nil || !ok || got.OwnerTokenID != other.ID || updated.Subdomain != "web" {
+		t.Fatalf("unexpected renamed reservation %+v (ok=%v, err=%v)", got, ok, err)
+	}
+	if _, ok, _ := store.GetHTTPReservation("app"); ok {
+		t.Fatalf("expected old subdomain to be gone")
+	}
+
+	if err := store.DeleteHTTPReservation("web"); err != nil {
+		t.Fatalf("delete reservation failed: %v", err)
+	}
+	if err := store.DeleteHTTPReservation("web"); !errors.Is(err, ErrReservationNotFound) {
+		t.Fatalf("expected ErrReservationNotFound, got %v", err)
+	}
+	if _, err := store.UpdateHTTPReservation("web", HTTPReservation{Subdomain: "web"}); !errors.Is(err, ErrReservationNotFound) {
+		t.Fatalf("expected ErrReservationNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy sets how long each kind of record is kept. A zero window
+// keeps that kind forever.
+type RetentionPolicy struct {
+	Logs          time.Duration
+	MinuteMetrics time.Duration
+	HourlyMetrics time.Duration
+	DailyMetrics  time.Duration
+}
+
+// PruneReport describes one retention pass.
+type PruneReport struct {
+	At               time.Time
+	HoursDownsampled int64
+	DaysDownsampled  int64
+	Logs             int64
+	MinuteRollups    int64
+	LatencyRows      int64
+	HourlyRollups    int64
+	DailyRollups     int64
+	Vacuumed         bool
+}
+
+const rollupColumns = `req_count, conn_count, bytes_in, bytes_out, status_2xx, status_3xx, status_4xx, status_5xx, relay_errors`
+
+const rollupSums = `SUM(req_count), SUM(conn_count), SUM(bytes_in), SUM(bytes_out),
+	SUM(status_2xx), SUM(status_3xx), SUM(status_4xx), SUM(status_5xx), SUM(relay_errors)`
+
+const rollupReplace = `req_count = excluded.req_count,
+	conn_count = excluded.conn_count,
+	bytes_in = excluded.bytes_in,
+	bytes_out = excluded.bytes_out,
+	status_2xx = excluded.status_2xx,
+	status_3xx = excluded.status_3xx,
+	status_4xx = excluded.status_4xx,
+	status_5xx = excluded.status_5xx,
+	relay_errors = excluded.relay_errors`
+
+// Prune folds completed hours and days into metrics_hourly and metrics_daily,
+// then deletes everything older than the policy allows. Minute and hourly
+// cutoffs are aligned to whole hours and days so a coarser bucket is never
+// rebuilt from partial data.
+func (s *Store) Prune(now time.Time, policy RetentionPolicy) (PruneReport, error) {
+	now = now.UTC()
+	report := PruneReport{At: now}
+	currentHour := now.Unix() / 3600
+	currentDay := now.Unix() / 86400
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	// The newest stored bucket is rebuilt too, in case late writes landed in
+	// it after the previous pass.
+	var lastHour, lastDay sql.NullInt64
+	if err := tx.QueryRow(`SELECT MAX(hour_bucket) FROM metrics_hourly`).Scan(&lastHour); err != nil {
+		return report, err
+	}
+	result, err := tx.Exec(`INSERT INTO metrics_hourly (tunnel_id, hour_bucket, `+rollupColumns+`)
+		SELECT tunnel_id, minute_bucket / 60, `+rollupSums+`
+		FROM metrics_rollup WHERE minute_bucket >= ? AND minute_bucket < ?
+		GROUP BY tunnel_id, minute_bucket / 60
+		ON CONFLICT(tunnel_id, hour_bucket) DO UPDATE SET `+rollupReplace,
+		lastHour.Int64*60, currentHour*60)
+	if err != nil {
+		return report, err
+	}
+	report.HoursDownsampled, _ = result.RowsAffected()
+
+	if err := tx.QueryRow(`SELECT MAX(day_bucket) FROM metrics_daily`).Scan(&lastDay); err != nil {
+		return report, err
+	}
+	result, err = tx.Exec(`INSERT INTO metrics_daily (tunnel_id, day_bucket, `+rollupColumns+`)
+		SELECT tunnel_id, hour_bucket / 24, `+rollupSums+`
+		FROM metrics_hourly WHERE hour_bucket >= ? AND hour_bucket < ?
+		GROUP BY tunnel_id, hour_bucket / 24
+		ON CONFLICT(tunnel_id, day_bucket) DO UPDATE SET `+rollupReplace,
+		lastDay.Int64*24, currentDay*24)
+	if err != nil {
+		return report, err
+	}
+	report.DaysDownsampled, _ = result.RowsAffected()
+
+	if policy.Logs > 0 {
+		cutoff := now.Add(-policy.Logs).Format(time.RFC3339)
+		if report.Logs, err = deleteRows(tx, `DELETE FROM logs WHERE ts < ?`, cutoff); err != nil {
+			return report, err
+		}
+	}
+	if policy.MinuteMetrics > 0 {
+		cutoff := now.Add(-policy.MinuteMetrics).Unix() / 3600 * 60
+		if report.MinuteRollups, err = deleteRows(tx, `DELETE FROM metrics_rollup WHERE minute_bucket < ?`, cutoff); err != nil {
+			return report, err
+		}
+		if report.LatencyRows, err = deleteRows(tx, `DELETE FROM metrics_latency WHERE minute_bucket < ?`, cutoff); err != nil {
+			return report, err
+		}
+	}
+	if policy.HourlyMetrics > 0 {
+		cutoff := now.Add(-policy.HourlyMetrics).Unix() / 86400 * 24
+		if report.HourlyRollups, err = deleteRows(tx, `DELETE FROM metrics_hourly WHERE hour_bucket < ?`, cutoff); err != nil {
+			return report, err
+		}
+	}
+	if policy.DailyMetrics > 0 {
+		cutoff := now.Add(-policy.DailyMetrics).Unix() / 86400
+		if report.DailyRollups, err = deleteRows(tx, `DELETE FROM metrics_daily WHERE day_bucket < ?`, cutoff); err != nil {
+			return report, err
+		}
+	}
+	return report, tx.Commit()
+}
+
+func deleteRows(tx *sql.Tx, query string, args ...any) (int64, error) {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Compact checkpoints the write-ahead log and, when vacuum is set, rebuilds
+// the database file to return pruned pages to the filesystem.
+func (s *Store) Compact(vacuum bool) error {
+	if _, err := s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return err
+	}
+	if vacuum {
+		if _, err := s.db.Exec(`VACUUM`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetentionWorker runs Prune and Compact in the background.
+type RetentionWorker struct {
+	Store  *Store
+	Policy RetentionPolicy
+	// Interval is the time between passes.
+	Interval time.Duration
+	// VacuumEvery limits how often a pass also runs VACUUM.
+	VacuumEvery time.Duration
+
+	mu         sync.Mutex
+	last       PruneReport
+	lastVacuum time.Time
+}
+
+// Run makes a pass immediately and then every Interval until ctx is done.
+func (w *RetentionWorker) Run(ctx context.Context) {
+	if w.Store == nil || w.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := w.RunOnce(time.Now()); err != nil {
+			log.Printf("retention pass failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce makes a single pass and logs what it pruned.
+func (w *RetentionWorker) RunOnce(now time.Time) (PruneReport, error) {
+	report, err := w.Store.Prune(now, w.Policy)
+	if err != nil {
+		return report, err
+	}
+	w.mu.Lock()
+	vacuum := w.VacuumEvery > 0 && now.Sub(w.lastVacuum) >= w.VacuumEvery
+	w.mu.Unlock()
+	if err := w.Store.Compact(vacuum); err != nil {
+		return report, err
+	}
+	report.Vacuumed = vacuum
+	log.Printf("retention: pruned %d logs, %d minute rollups, %d latency rows, %d hourly and %d daily rollups; downsampled %d hourly and %d daily rows; vacuum=%t",
+		report.Logs, report.MinuteRollups, report.LatencyRows, report.HourlyRollups, report.DailyRollups,
+		report.HoursDownsampled, report.DaysDownsampled, report.Vacuumed)
+
+	w.mu.Lock()
+	w.last = report
+	if vacuum {
+		w.lastVacuum = now
+	}
+	w.mu.Unlock()
+	return report, nil
+}
+
+// LastReport returns the most recent successful pass.
+func (w *RetentionWorker) LastReport() PruneReport {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
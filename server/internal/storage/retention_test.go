@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneDownsamplesBeforeDeleting(t *testing.T) {
+	store := openMigratedStore(t)
+	if err := store.UpsertTunnel(Tunnel{ID: "tunnel-1", Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 8080}); err != nil {
+		t.Fatalf("upsert tunnel failed: %v", err)
+	}
+
+	now := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC)
+	old := now.Add(-3 * 24 * time.Hour)
+	for _, ts := range []time.Time{old, old.Add(time.Minute), now.Add(-time.Hour), now} {
+		if err := store.AddHTTPMetric("tunnel-1", ts, HTTPSample{Status: 200, BytesIn: 10, Edge: 20 * time.Millisecond}); err != nil {
+			t.Fatalf("add metric failed: %v", err)
+		}
+	}
+	if err := store.InsertLog(LogEntry{TunnelID: "tunnel-1", Timestamp: old, Summary: "GET /old"}); err != nil {
+		t.Fatalf("insert log failed: %v", err)
+	}
+	if err := store.InsertLog(LogEntry{TunnelID: "tunnel-1", Timestamp: now, Summary: "GET /new"}); err != nil {
+		t.Fatalf("insert log failed: %v", err)
+	}
+
+	policy := RetentionPolicy{Logs: 24 * time.Hour, MinuteMetrics: 24 * time.Hour, HourlyMetrics: 30 * 24 * time.Hour}
+	report, err := store.Prune(now, policy)
+	if err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+	if report.Logs != 1 || report.MinuteRollups != 2 || report.LatencyRows != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	logs, err := store.ListLogs(10)
+	if err != nil {
+		t.Fatalf("list logs failed: %v", err)
+	}
+	if len(logs) != 1 || logs[0].Summary != "GET /new" {
+		t.Fatalf("unexpected logs after prune: %+v", logs)
+	}
+
+	var hourlyReqs, hourlyRows int64
+	if err := store.db.QueryRow(`SELECT COUNT(1), SUM(req_count) FROM metrics_hourly`).Scan(&hourlyRows, &hourlyReqs); err != nil {
+		t.Fatalf("query hourly failed: %v", err)
+	}
+	if hourlyRows != 2 || hourlyReqs != 3 {
+		t.Fatalf("expected the old hour and the last complete hour, got %d rows with %d requests", hourlyRows, hourlyReqs)
+	}
+	var dailyReqs int64
+	if err := store.db.QueryRow(`SELECT SUM(req_count) FROM metrics_daily`).Scan(&dailyReqs); err != nil {
+		t.Fatalf("query daily failed: %v", err)
+	}
+	if dailyReqs != 2 {
+		t.Fatalf("expected the old day's 2 requests, got %d", dailyReqs)
+	}
+
+	// A second pass must not double count buckets it already folded.
+	if _, err := store.Prune(now.Add(time.Minute), policy); err != nil {
+		t.Fatalf("second prune failed: %v", err)
+	}
+	if err := store.db.QueryRow(`SELECT SUM(req_count) FROM metrics_hourly`).Scan(&hourlyReqs); err != nil {
+		t.Fatalf("query hourly failed: %v", err)
+	}
+	if hourlyReqs != 3 {
+		t.Fatalf("expected hourly totals to stay at 3, got %d", hourlyReqs)
+	}
+}
@@ -0,0 +1,48 @@
+// Package storagetest opens migrated stores for tests in other packages.
+package storagetest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+)
+
+// OpenTestStore opens a store in a temporary directory with every migration
+// applied. It is closed when the test ends.
+func OpenTestStore(t testing.TB) *storage.Store {
+	t.Helper()
+	store, err := storage.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open store failed: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	if err := store.ApplyMigrations(MigrationsDir(t)); err != nil {
+		t.Fatalf("migrations failed: %v", err)
+	}
+	return store
+}
+
+// MigrationsDir finds the repository's migrations directory by walking up
+// from the working directory.
+func MigrationsDir(t testing.TB) string {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd failed: %v", err)
+	}
+	for {
+		candidate := filepath.Join(dir, "migrations")
+		if _, err := os.Stat(filepath.Join(candidate, "0001_initial.sql")); err == nil {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	t.Fatalf("migrations directory not found")
+	return ""
+}
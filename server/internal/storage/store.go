@@ -60,15 +60,17 @@ func GenerateToken() (string, error) {
 	return hex.EncodeToString(buf), nil
 }
 
+// EnsureToken seeds raw as the first relay token. Once any token has been
+// stored it does nothing, so a revoked seed token is not revived on restart.
 func (s *Store) EnsureToken(raw string) error {
 	if s == nil || s.db == nil {
 		return fmt.Errorf("store not configured")
 	}
-	active, err := s.HasActiveToken()
+	seeded, err := s.HasTokens()
 	if err != nil {
 		return err
 	}
-	if active {
+	if seeded {
 		return nil
 	}
 	if strings.TrimSpace(raw) == "" {
@@ -77,61 +79,62 @@ func (s *Store) EnsureToken(raw string) error {
 	return s.InsertToken(raw)
 }
 
-func (s *Store) HasActiveToken() (bool, error) {
+// HasTokens reports whether any relay token, active or revoked, was ever
+// stored.
+func (s *Store) HasTokens() (bool, error) {
 	if s == nil || s.db == nil {
 		return false, nil
 	}
 	var count int
-	if err := s.db.QueryRow("SELECT COUNT(1) FROM tokens WHERE revoked_at IS NULL").Scan(&count); err != nil {
+	if err := s.db.QueryRow("SELECT COUNT(1) FROM tokens").Scan(&count); err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-func (s *Store) ValidateToken(raw string) (bool, error) {
-	trimmed := strings.TrimSpace(raw)
-	if trimmed == "" {
+func (s *Store) HasActiveToken() (bool, error) {
+	if s == nil || s.db == nil {
 		return false, nil
 	}
-	hash := hashToken(trimmed)
 	var count int
-	if err := s.db.QueryRow("SELECT COUNT(1) FROM tokens WHERE token_hash = ? AND revoked_at IS NULL", hash).Scan(&count); err != nil {
+	if err := s.db.QueryRow("SELECT COUNT(1) FROM tokens WHERE revoked_at IS NULL").Scan(&count); err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-func (s *Store) InsertToken(raw string) error {
+func (s *Store) ValidateToken(raw string) (bool, error) {
+	_, ok, err := s.LookupTokenID(raw)
+	return ok, err
+}
+
+// LookupTokenID returns the row id of an active token. The id identifies the
+// token's owner for reservations.
+func (s *Store) LookupTokenID(raw string) (int64, bool, error) {
 	trimmed := strings.TrimSpace(raw)
 	if trimmed == "" {
-		return fmt.Errorf("token required")
+		return 0, false, nil
 	}
 	hash := hashToken(trimmed)
-	_, err := s.db.Exec("INSERT INTO tokens (token_hash, created_at) VALUES (?, ?)", hash, nowUTC())
-	return err
+	var id int64
+	err := s.db.QueryRow("SELECT id FROM tokens WHERE token_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", hash, nowUTC()).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
 }
 
-func (s *Store) RotateToken(raw string) error {
+func (s *Store) InsertToken(raw string) error {
 	trimmed := strings.TrimSpace(raw)
 	if trimmed == "" {
 		return fmt.Errorf("token required")
 	}
 	hash := hashToken(trimmed)
-	if s == nil || s.db == nil {
-		return fmt.Errorf("store not configured")
-	}
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	if _, err := tx.Exec("UPDATE tokens SET revoked_at = ? WHERE revoked_at IS NULL", nowUTC()); err != nil {
-		return err
-	}
-	if _, err := tx.Exec("INSERT INTO tokens (token_hash, created_at) VALUES (?, ?)", hash, nowUTC()); err != nil {
-		return err
-	}
-	return tx.Commit()
+	_, err := s.db.Exec("INSERT INTO tokens (token_hash, created_at) VALUES (?, ?)", hash, nowUTC())
+	return err
 }
 
 func hashToken(raw string) string {
@@ -140,14 +143,16 @@ func hashToken(raw string) string {
 }
 
 type HTTPReservation struct {
-	TunnelID  string
-	Subdomain string
-	Allowlist []string
+	TunnelID     string
+	Subdomain    string
+	Allowlist    []string
+	OwnerTokenID int64
 }
 
 type Tunnel struct {
 	ID        string
 	Name      string
+	ClientID  string
 	Protocol  string
 	LocalHost string
 	LocalPort int
@@ -161,6 +166,7 @@ type PortReservation struct {
 	ExternalPort int
 	TunnelID     string
 	Reserved     bool
+	OwnerTokenID int64
 	CreatedAt    time.Time
 }
 
@@ -175,6 +181,7 @@ type CustomDomain struct {
 }
 
 type LogEntry struct {
+	ID         int64
 	TunnelID   string
 	Timestamp  time.Time
 	Kind       string
@@ -192,9 +199,21 @@ type MetricRollup struct {
 	ConnCount    int64
 	BytesIn      int64
 	BytesOut     int64
+	// Status2xx through Status5xx count HTTP responses by status class;
+	// RelayErrors counts requests that never reached the client.
+	Status2xx   int64
+	Status3xx   int64
+	Status4xx   int64
+	Status5xx   int64
+	RelayErrors int64
+	// EdgeLatency and UpstreamLatency are nil when no HTTP request in the
+	// minute recorded that timing.
+	EdgeLatency     LatencyHistogram
+	UpstreamLatency LatencyHistogram
 }
 
 func (s *Store) UpsertHTTPReservation(res HTTPReservation) error {
+	res.Subdomain = strings.ToLower(strings.TrimSpace(res.Subdomain))
 	if res.Subdomain == "" {
 		return fmt.Errorf("subdomain required")
 	}
@@ -205,21 +224,18 @@ func (s *Store) UpsertHTTPReservation(res HTTPReservation) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.Exec(`INSERT INTO subdomains (subdomain, tunnel_id, reserved, created_at)
-		VALUES (?, ?, 1, ?)
-		ON CONFLICT(subdomain) DO UPDATE SET tunnel_id = excluded.tunnel_id`, res.Subdomain, res.TunnelID, nowUTC()); err != nil {
+	if _, err := tx.Exec(`INSERT INTO subdomains (subdomain, tunnel_id, reserved, owner_token_id, created_at)
+		VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT(subdomain) DO UPDATE SET
+			tunnel_id = excluded.tunnel_id,
+			owner_token_id = COALESCE(subdomains.owner_token_id, excluded.owner_token_id)`, res.Subdomain, res.TunnelID, nullableID(res.OwnerTokenID), nowUTC()); err != nil {
 		return err
 	}
 
 	if res.TunnelID != "" {
-		if _, err := tx.Exec("DELETE FROM ip_allowlists WHERE tunnel_id = ?", res.TunnelID); err != nil {
+		if err := replaceAllowlist(tx, res.TunnelID, "client", res.Allowlist); err != nil {
 			return err
 		}
-		for _, cidr := range res.Allowlist {
-			if _, err := tx.Exec("INSERT INTO ip_allowlists (tunnel_id, cidr, created_at) VALUES (?, ?, ?)", res.TunnelID, cidr, nowUTC()); err != nil {
-				return err
-			}
-		}
 	}
 
 	return tx.Commit()
@@ -243,10 +259,11 @@ func (s *Store) UpsertTunnel(tunnel Tunnel) error {
 	if lastSeen.IsZero() {
 		lastSeen = time.Now().UTC()
 	}
-	_, err := s.db.Exec(`INSERT INTO tunnels (id, name, protocol, local_host, local_port, status, created_at, last_seen)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	_, err := s.db.Exec(`INSERT INTO tunnels (id, name, client_id, protocol, local_host, local_port, status, created_at, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(id) DO UPDATE SET
 			name = excluded.name,
+			client_id = excluded.client_id,
 			protocol = excluded.protocol,
 			local_host = excluded.local_host,
 			local_port = excluded.local_port,
@@ -254,6 +271,7 @@ func (s *Store) UpsertTunnel(tunnel Tunnel) error {
 			last_seen = excluded.last_seen`,
 		tunnel.ID,
 		tunnel.Name,
+		tunnel.ClientID,
 		tunnel.Protocol,
 		tunnel.LocalHost,
 		tunnel.LocalPort,
@@ -275,11 +293,35 @@ func (s *Store) MarkTunnelStatus(tunnelID, status string) error {
 	return err
 }
 
+func (s *Store) GetTunnel(tunnelID string) (Tunnel, bool, error) {
+	var entry Tunnel
+	if tunnelID == "" {
+		return entry, false, nil
+	}
+	var createdAt, lastSeen string
+	err := s.db.QueryRow(`SELECT id, IFNULL(name, ''), IFNULL(client_id, ''), protocol, local_host, local_port, status, created_at, last_seen
+		FROM tunnels WHERE id = ?`, tunnelID).
+		Scan(&entry.ID, &entry.Name, &entry.ClientID, &entry.Protocol, &entry.LocalHost, &entry.LocalPort, &entry.Status, &createdAt, &lastSeen)
+	if err == sql.ErrNoRows {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, err
+	}
+	if parsed, err := time.Parse(time.RFC3339, createdAt); err == nil {
+		entry.CreatedAt = parsed
+	}
+	if parsed, err := time.Parse(time.RFC3339, lastSeen); err == nil {
+		entry.LastSeen = parsed
+	}
+	return entry, true, nil
+}
+
 func (s *Store) ListTunnels(limit int) ([]Tunnel, error) {
 	if limit <= 0 {
 		limit = 200
 	}
-	rows, err := s.db.Query(`SELECT id, name, protocol, local_host, local_port, status, created_at, last_seen
+	rows, err := s.db.Query(`SELECT id, IFNULL(name, ''), IFNULL(client_id, ''), protocol, local_host, local_port, status, created_at, last_seen
 		FROM tunnels ORDER BY created_at DESC LIMIT ?`, limit)
 	if err != nil {
 		return nil, err
@@ -290,7 +332,7 @@ func (s *Store) ListTunnels(limit int) ([]Tunnel, error) {
 	for rows.Next() {
 		var entry Tunnel
 		var createdAt, lastSeen string
-		if err := rows.Scan(&entry.ID, &entry.Name, &entry.Protocol, &entry.LocalHost, &entry.LocalPort, &entry.Status, &createdAt, &lastSeen); err != nil {
+		if err := rows.Scan(&entry.ID, &entry.Name, &entry.ClientID, &entry.Protocol, &entry.LocalHost, &entry.LocalPort, &entry.Status, &createdAt, &lastSeen); err != nil {
 			return nil, err
 		}
 		if parsed, err := time.Parse(time.RFC3339, createdAt); err == nil {
@@ -319,11 +361,12 @@ func (s *Store) UpsertPortReservation(res PortReservation) error {
 	if !res.Reserved {
 		reserved = 0
 	}
-	_, err := s.db.Exec(`INSERT INTO port_reservations (protocol, external_port, tunnel_id, reserved, created_at)
-		VALUES (?, ?, ?, ?, ?)
+	_, err := s.db.Exec(`INSERT INTO port_reservations (protocol, external_port, tunnel_id, reserved, owner_token_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
 		ON CONFLICT(protocol, external_port) DO UPDATE SET
 			tunnel_id = excluded.tunnel_id,
-			reserved = excluded.reserved`, res.Protocol, res.ExternalPort, res.TunnelID, reserved, createdAt.UTC().Format(time.RFC3339))
+			reserved = excluded.reserved,
+			owner_token_id = COALESCE(port_reservations.owner_token_id, excluded.owner_token_id)`, res.Protocol, res.ExternalPort, res.TunnelID, reserved, nullableID(res.OwnerTokenID), createdAt.UTC().Format(time.RFC3339))
 	return err
 }
 
@@ -331,7 +374,7 @@ func (s *Store) ListPortReservations(protocol string, limit int) ([]PortReservat
 	if limit <= 0 {
 		limit = 200
 	}
-	query := `SELECT protocol, external_port, tunnel_id, reserved, created_at
+	query := `SELECT protocol, external_port, tunnel_id, reserved, owner_token_id, created_at
 		FROM port_reservations`
 	args := []any{}
 	if protocol != "" {
@@ -352,10 +395,12 @@ func (s *Store) ListPortReservations(protocol string, limit int) ([]PortReservat
 		var entry PortReservation
 		var createdAt string
 		var reservedInt int
-		if err := rows.Scan(&entry.Protocol, &entry.ExternalPort, &entry.TunnelID, &reservedInt, &createdAt); err != nil {
+		var owner sql.NullInt64
+		if err := rows.Scan(&entry.Protocol, &entry.ExternalPort, &entry.TunnelID, &reservedInt, &owner, &createdAt); err != nil {
 			return nil, err
 		}
 		entry.Reserved = reservedInt != 0
+		entry.OwnerTokenID = owner.Int64
 		if parsed, err := time.Parse(time.RFC3339, createdAt); err == nil {
 			entry.CreatedAt = parsed
 		}
@@ -371,9 +416,10 @@ func (s *Store) GetPortReservation(protocol string, externalPort int) (PortReser
 	}
 	var createdAt string
 	var reservedInt int
-	err := s.db.QueryRow(`SELECT protocol, external_port, tunnel_id, reserved, created_at
+	var owner sql.NullInt64
+	err := s.db.QueryRow(`SELECT protocol, external_port, tunnel_id, reserved, owner_token_id, created_at
 		FROM port_reservations WHERE protocol = ? AND external_port = ?`, protocol, externalPort).
-		Scan(&entry.Protocol, &entry.ExternalPort, &entry.TunnelID, &reservedInt, &createdAt)
+		Scan(&entry.Protocol, &entry.ExternalPort, &entry.TunnelID, &reservedInt, &owner, &createdAt)
 	if err == sql.ErrNoRows {
 		return entry, false, nil
 	}
@@ -381,6 +427,7 @@ func (s *Store) GetPortReservation(protocol string, externalPort int) (PortReser
 		return entry, false, err
 	}
 	entry.Reserved = reservedInt != 0
+	entry.OwnerTokenID = owner.Int64
 	if parsed, err := time.Parse(time.RFC3339, createdAt); err == nil {
 		entry.CreatedAt = parsed
 	}
@@ -478,10 +525,10 @@ func (s *Store) ListCustomDomains(limit int) ([]CustomDomain, error) {
 }
 
 func (s *Store) ListHTTPReservations() ([]HTTPReservation, error) {
-	rows, err := s.db.Query(`SELECT s.subdomain, s.tunnel_id, IFNULL(GROUP_CONCAT(a.cidr), '')
+	rows, err := s.db.Query(`SELECT s.subdomain, IFNULL(s.tunnel_id, ''), s.owner_token_id, IFNULL(GROUP_CONCAT(a.cidr), '')
 		FROM subdomains s
-		LEFT JOIN ip_allowlists a ON a.tunnel_id = s.tunnel_id
-		GROUP BY s.subdomain, s.tunnel_id
+		LEFT JOIN ip_allowlists a ON a.tunnel_id = s.tunnel_id AND a.source = 'client'
+		GROUP BY s.subdomain, s.tunnel_id, s.owner_token_id
 		ORDER BY s.subdomain ASC`)
 	if err != nil {
 		return nil, err
@@ -491,26 +538,52 @@ func (s *Store) ListHTTPReservations() ([]HTTPReservation, error) {
 	var results []HTTPReservation
 	for rows.Next() {
 		var subdomain, tunnelID, allowlist string
-		if err := rows.Scan(&subdomain, &tunnelID, &allowlist); err != nil {
+		var owner sql.NullInt64
+		if err := rows.Scan(&subdomain, &tunnelID, &owner, &allowlist); err != nil {
 			return nil, err
 		}
 		var allowlistValues []string
 		if allowlist != "" {
 			allowlistValues = strings.Split(allowlist, ",")
 		}
-		results = append(results, HTTPReservation{Subdomain: subdomain, TunnelID: tunnelID, Allowlist: allowlistValues})
+		results = append(results, HTTPReservation{Subdomain: subdomain, TunnelID: tunnelID, Allowlist: allowlistValues, OwnerTokenID: owner.Int64})
 	}
 	return results, rows.Err()
 }
 
+func (s *Store) GetHTTPReservation(subdomain string) (HTTPReservation, bool, error) {
+	var entry HTTPReservation
+	clean := strings.ToLower(strings.TrimSpace(subdomain))
+	if clean == "" {
+		return entry, false, nil
+	}
+	var tunnelID sql.NullString
+	var owner sql.NullInt64
+	err := s.db.QueryRow(`SELECT subdomain, tunnel_id, owner_token_id FROM subdomains WHERE subdomain = ?`, clean).
+		Scan(&entry.Subdomain, &tunnelID, &owner)
+	if err == sql.ErrNoRows {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, err
+	}
+	entry.TunnelID = tunnelID.String
+	entry.OwnerTokenID = owner.Int64
+	return entry, true, nil
+}
+
 func (s *Store) InsertLog(entry LogEntry) error {
+	return insertLog(s.db, entry)
+}
+
+func insertLog(db execer, entry LogEntry) error {
 	if entry.Timestamp.IsZero() {
 		entry.Timestamp = time.Now().UTC()
 	}
 	if entry.Kind == "" {
 		entry.Kind = "http"
 	}
-	_, err := s.db.Exec(`INSERT INTO logs (tunnel_id, ts, kind, remote_addr, summary, status_code, bytes_in, bytes_out)
+	_, err := db.Exec(`INSERT INTO logs (tunnel_id, ts, kind, remote_addr, summary, status_code, bytes_in, bytes_out)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, entry.TunnelID, entry.Timestamp.UTC().Format(time.RFC3339), entry.Kind, entry.RemoteAddr, entry.Summary, entry.Status, entry.BytesIn, entry.BytesOut)
 	return err
 }
@@ -522,48 +595,20 @@ func (s *Store) AddMetric(tunnelID string, ts time.Time, reqCount, connCount, by
 	if ts.IsZero() {
 		ts = time.Now().UTC()
 	}
-	minuteBucket := ts.Unix() / 60
-	_, err := s.db.Exec(`INSERT INTO metrics_rollup (tunnel_id, minute_bucket, req_count, conn_count, bytes_in, bytes_out)
-		VALUES (?, ?, ?, ?, ?, ?)
-		ON CONFLICT(tunnel_id, minute_bucket) DO UPDATE SET
-			req_count = req_count + excluded.req_count,
-			conn_count = conn_count + excluded.conn_count,
-			bytes_in = bytes_in + excluded.bytes_in,
-			bytes_out = bytes_out + excluded.bytes_out`, tunnelID, minuteBucket, reqCount, connCount, bytesIn, bytesOut)
-	return err
+	return addRollup(s.db, rollupKey{tunnelID, ts.Unix() / 60}, rollupDelta{reqs: reqCount, conns: connCount, bytesIn: bytesIn, bytesOut: bytesOut})
 }
 
 func (s *Store) ListLogs(limit int) ([]LogEntry, error) {
-	if limit <= 0 {
-		limit = 200
-	}
-	rows, err := s.db.Query(`SELECT tunnel_id, ts, kind, remote_addr, summary, status_code, bytes_in, bytes_out
-		FROM logs ORDER BY ts DESC LIMIT ?`, limit)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var results []LogEntry
-	for rows.Next() {
-		var entry LogEntry
-		var ts string
-		if err := rows.Scan(&entry.TunnelID, &ts, &entry.Kind, &entry.RemoteAddr, &entry.Summary, &entry.Status, &entry.BytesIn, &entry.BytesOut); err != nil {
-			return nil, err
-		}
-		if parsed, err := time.Parse(time.RFC3339, ts); err == nil {
-			entry.Timestamp = parsed
-		}
-		results = append(results, entry)
-	}
-	return results, rows.Err()
+	entries, _, err := s.QueryLogs(LogQuery{Limit: limit})
+	return entries, err
 }
 
 func (s *Store) ListMetrics(limit int) ([]MetricRollup, error) {
 	if limit <= 0 {
 		limit = 200
 	}
-	rows, err := s.db.Query(`SELECT tunnel_id, minute_bucket, req_count, conn_count, bytes_in, bytes_out
+	rows, err := s.db.Query(`SELECT tunnel_id, minute_bucket, req_count, conn_count, bytes_in, bytes_out,
+			status_2xx, status_3xx, status_4xx, status_5xx, relay_errors
 		FROM metrics_rollup ORDER BY minute_bucket DESC LIMIT ?`, limit)
 	if err != nil {
 		return nil, err
@@ -573,12 +618,20 @@ func (s *Store) ListMetrics(limit int) ([]MetricRollup, error) {
 	var results []MetricRollup
 	for rows.Next() {
 		var entry MetricRollup
-		if err := rows.Scan(&entry.TunnelID, &entry.MinuteBucket, &entry.ReqCount, &entry.ConnCount, &entry.BytesIn, &entry.BytesOut); err != nil {
+		if err := rows.Scan(&entry.TunnelID, &entry.MinuteBucket, &entry.ReqCount, &entry.ConnCount, &entry.BytesIn, &entry.BytesOut,
+			&entry.Status2xx, &entry.Status3xx, &entry.Status4xx, &entry.Status5xx, &entry.RelayErrors); err != nil {
 			return nil, err
 		}
 		results = append(results, entry)
 	}
-	return results, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := s.attachLatency(results); err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
 func (s *Store) ApplyMigrations(dir string) error {
@@ -642,6 +695,13 @@ func (s *Store) isMigrationApplied(version string) (bool, error) {
 	return count > 0, nil
 }
 
+func nullableID(id int64) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
 func nowUTC() string {
 	return time.Now().UTC().Format(time.RFC3339)
 }
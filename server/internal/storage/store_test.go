@@ -2,6 +2,7 @@ package storage
 
 import (
 	"database/sql"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -38,7 +39,11 @@ func TestTokenLifecycle(t *testing.T) {
 		t.Fatalf("expected token valid")
 	}
 
-	if err := store.RotateToken("new-token"); err != nil {
+	seedID, ok, err := store.LookupTokenID("seed-token")
+	if err != nil || !ok {
+		t.Fatalf("lookup token failed: ok=%v err=%v", ok, err)
+	}
+	if err := store.RotateTokenByID(seedID, "new-token"); err != nil {
 		t.Fatalf("rotate failed: %v", err)
 	}
 	ok, err = store.ValidateToken("seed-token")
@@ -55,6 +60,9 @@ func TestTokenLifecycle(t *testing.T) {
 	if !ok {
 		t.Fatalf("expected new token valid")
 	}
+	if id, _, _ := store.LookupTokenID("new-token"); id != seedID {
+		t.Fatalf("expected rotated token to keep id %d, got %d", seedID, id)
+	}
 }
 
 func TestUpsertHTTPReservationReplacesAllowlist(t *testing.T) {
@@ -175,6 +183,154 @@ func TestEnsureTokenIgnoresWhenActive(t *testing.T) {
 	}
 }
 
+func TestEnsureTokenDoesNotReviveRevokedSeed(t *testing.T) {
+	store := openMigratedStore(t)
+	if err := store.EnsureToken("seeded"); err != nil {
+		t.Fatalf("ensure token failed: %v", err)
+	}
+	id, _, err := store.LookupTokenID("seeded")
+	if err != nil {
+		t.Fatalf("lookup token failed: %v", err)
+	}
+	if err := store.RevokeToken(id); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+	if err := store.EnsureToken("seeded"); err != nil {
+		t.Fatalf("ensure token failed: %v", err)
+	}
+	if ok, err := store.ValidateToken("seeded"); err != nil || ok {
+		t.Fatalf("expected revoked seed to stay revoked: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestReservationOwnershipSurvivesRotation(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "test.db")
+	store, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer store.Close()
+	if err := store.ApplyMigrations(migrationsDir(t)); err != nil {
+		t.Fatalf("migrations failed: %v", err)
+	}
+
+	if err := store.InsertToken("owner"); err != nil {
+		t.Fatalf("insert token failed: %v", err)
+	}
+	ownerID, ok, err := store.LookupTokenID("owner")
+	if err != nil || !ok {
+		t.Fatalf("lookup token failed: ok=%v err=%v", ok, err)
+	}
+	if err := store.UpsertTunnel(Tunnel{ID: "tunnel-1", Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 8080}); err != nil {
+		t.Fatalf("insert tunnel failed: %v", err)
+	}
+	if err := store.UpsertHTTPReservation(HTTPReservation{TunnelID: "tunnel-1", Subdomain: "App", OwnerTokenID: ownerID}); err != nil {
+		t.Fatalf("upsert reservation failed: %v", err)
+	}
+	if err := store.UpsertHTTPReservation(HTTPReservation{TunnelID: "tunnel-1", Subdomain: "app", OwnerTokenID: ownerID + 100}); err != nil {
+		t.Fatalf("upsert reservation again failed: %v", err)
+	}
+	res, ok, err := store.GetHTTPReservation("app")
+	if err != nil || !ok {
+		t.Fatalf("get reservation failed: ok=%v err=%v", ok, err)
+	}
+	if res.OwnerTokenID != ownerID {
+		t.Fatalf("expected owner %d kept, got %d", ownerID, res.OwnerTokenID)
+	}
+
+	if err := store.RotateTokenByID(ownerID, "rotated"); err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	rotatedID, ok, err := store.LookupTokenID("rotated")
+	if err != nil || !ok {
+		t.Fatalf("lookup rotated token failed: ok=%v err=%v", ok, err)
+	}
+	res, _, err = store.GetHTTPReservation("app")
+	if err != nil {
+		t.Fatalf("get reservation failed: %v", err)
+	}
+	if rotatedID != ownerID || res.OwnerTokenID != rotatedID {
+		t.Fatalf("expected reservation still owned by rotated token %d, got %d", rotatedID, res.OwnerTokenID)
+	}
+}
+
+func TestRotateTokenByIDLeavesOtherTokensReservations(t *testing.T) {
+	store := openMigratedStore(t)
+	if err := store.InsertToken("first"); err != nil {
+		t.Fatalf("insert token failed: %v", err)
+	}
+	if err := store.InsertToken("second"); err != nil {
+		t.Fatalf("insert token failed: %v", err)
+	}
+	firstID, _, err := store.LookupTokenID("first")
+	if err != nil {
+		t.Fatalf("lookup token failed: %v", err)
+	}
+	secondID, _, err := store.LookupTokenID("second")
+	if err != nil {
+		t.Fatalf("lookup token failed: %v", err)
+	}
+	if err := store.UpsertTunnel(Tunnel{ID: "tunnel-1", Protocol: "http", LocalHost: "127.0.0.1", LocalPort: 8080}); err != nil {
+		t.Fatalf("insert tunnel failed: %v", err)
+	}
+	if err := store.UpsertHTTPReservation(HTTPReservation{TunnelID: "tunnel-1", Subdomain: "first", OwnerTokenID: firstID}); err != nil {
+		t.Fatalf("upsert reservation failed: %v", err)
+	}
+	if err := store.UpsertHTTPReservation(HTTPReservation{TunnelID: "tunnel-1", Subdomain: "second", OwnerTokenID: secondID}); err != nil {
+		t.Fatalf("upsert reservation failed: %v", err)
+	}
+	if err := store.UpsertPortReservation(PortReservation{Protocol: "tcp", ExternalPort: 20001, TunnelID: "tunnel-1", Reserved: true, OwnerTokenID: firstID}); err != nil {
+		t.Fatalf("upsert port reservation failed: %v", err)
+	}
+	if err := store.UpsertPortReservation(PortReservation{Protocol: "tcp", ExternalPort: 20002, TunnelID: "tunnel-1", Reserved: true, OwnerTokenID: secondID}); err != nil {
+		t.Fatalf("upsert port reservation failed: %v", err)
+	}
+
+	if err := store.RotateTokenByID(firstID, "first-rotated"); err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	rotatedID, ok, err := store.LookupTokenID("first-rotated")
+	if err != nil || !ok {
+		t.Fatalf("lookup rotated token failed: ok=%v err=%v", ok, err)
+	}
+	if rotatedID != firstID {
+		t.Fatalf("expected rotated token to keep id %d, got %d", firstID, rotatedID)
+	}
+	if ok, err := store.ValidateToken("first"); err != nil || ok {
+		t.Fatalf("expected old secret rejected: ok=%v err=%v", ok, err)
+	}
+	if ok, err := store.ValidateToken("second"); err != nil || !ok {
+		t.Fatalf("expected second token still valid: ok=%v err=%v", ok, err)
+	}
+
+	for subdomain, want := range map[string]int64{"first": rotatedID, "second": secondID} {
+		res, _, err := store.GetHTTPReservation(subdomain)
+		if err != nil {
+			t.Fatalf("get reservation failed: %v", err)
+		}
+		if res.OwnerTokenID != want {
+			t.Fatalf("expected %s owned by %d, got %d", subdomain, want, res.OwnerTokenID)
+		}
+	}
+	for port, want := range map[int]int64{20001: rotatedID, 20002: secondID} {
+		res, _, err := store.GetPortReservation("tcp", port)
+		if err != nil {
+			t.Fatalf("get port reservation failed: %v", err)
+		}
+		if res.OwnerTokenID != want {
+			t.Fatalf("expected port %d owned by %d, got %d", port, want, res.OwnerTokenID)
+		}
+	}
+
+	if err := store.RevokeToken(firstID); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+	if err := store.RotateTokenByID(firstID, "again"); !errors.Is(err, ErrTokenNotFound) {
+		t.Fatalf("expected ErrTokenNotFound rotating a revoked token, got %v", err)
+	}
+}
+
 func countActiveTokens(store *Store) (int, error) {
 	if store == nil || store.db == nil {
 		return 0, os.ErrInvalid
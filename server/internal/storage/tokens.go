@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token is a named relay credential. Empty scope lists leave that dimension
+// unrestricted.
+type Token struct {
+	ID                int64
+	Name              string
+	Protocols         []string
+	SubdomainPatterns []string
+	PortRanges        []string
+	CreatedAt         time.Time
+	ExpiresAt         time.Time
+	LastUsedAt        time.Time
+	RevokedAt         time.Time
+}
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// Permits reports whether the token's scopes allow registering a tunnel.
+func (t Token) Permits(protocol, subdomain string, port int) bool {
+	if len(t.Protocols) > 0 && !containsFold(t.Protocols, protocol) {
+		return false
+	}
+	switch protocol {
+	case "http":
+		if len(t.SubdomainPatterns) == 0 {
+			return true
+		}
+		for _, pattern := range t.SubdomainPatterns {
+			if ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(subdomain)); err == nil && ok {
+				return true
+			}
+		}
+		return false
+	case "tcp", "udp":
+		if len(t.PortRanges) == 0 {
+			return true
+		}
+		for _, value := range t.PortRanges {
+			low, high, err := parsePortRange(value)
+			if err == nil && port >= low && port <= high {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Expired reports whether the token has passed its expiry at now.
+func (t Token) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+func validateTokenScopes(token Token) error {
+	for _, protocol := range token.Protocols {
+		switch strings.ToLower(strings.TrimSpace(protocol)) {
+		case "http", "tcp", "udp":
+		default:
+			return fmt.Errorf("invalid protocol %q", protocol)
+		}
+	}
+	for _, pattern := range token.SubdomainPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid subdomain pattern %q", pattern)
+		}
+	}
+	for _, value := range token.PortRanges {
+		if _, _, err := parsePortRange(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parsePortRange(value string) (int, int, error) {
+	trimmed := strings.TrimSpace(value)
+	lowText, highText, isRange := strings.Cut(trimmed, "-")
+	low, err := strconv.Atoi(strings.TrimSpace(lowText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q", value)
+	}
+	high := low
+	if isRange {
+		high, err = strconv.Atoi(strings.TrimSpace(highText))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port range %q", value)
+		}
+	}
+	if low <= 0 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", value)
+	}
+	return low, high, nil
+}
+
+// CreateToken stores a new named token for raw and returns it with its id.
+func (s *Store) CreateToken(token Token, raw string) (Token, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return Token{}, fmt.Errorf("token required")
+	}
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		return Token{}, fmt.Errorf("token name required")
+	}
+	token.Protocols = normalizeList(token.Protocols, true)
+	token.SubdomainPatterns = normalizeList(token.SubdomainPatterns, true)
+	token.PortRanges = normalizeList(token.PortRanges, false)
+	if err := validateTokenScopes(token); err != nil {
+		return Token{}, err
+	}
+	token.CreatedAt = time.Now().UTC()
+	result, err := s.db.Exec(`INSERT INTO tokens (token_hash, name, created_at, expires_at, protocols, subdomain_patterns, port_ranges)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(trimmed),
+		token.Name,
+		token.CreatedAt.Format(time.RFC3339),
+		nullableTime(token.ExpiresAt),
+		strings.Join(token.Protocols, ","),
+		strings.Join(token.SubdomainPatterns, ","),
+		strings.Join(token.PortRanges, ","),
+	)
+	if err != nil {
+		return Token{}, err
+	}
+	token.ID, err = result.LastInsertId()
+	return token, err
+}
+
+// AuthenticateToken resolves an active, unexpired token and records its use.
+func (s *Store) AuthenticateToken(raw string) (Token, bool, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return Token{}, false, nil
+	}
+	row := s.db.QueryRow(tokenSelect+" WHERE token_hash = ? AND revoked_at IS NULL", hashToken(trimmed))
+	token, err := scanToken(row)
+	if err == sql.ErrNoRows {
+		return Token{}, false, nil
+	}
+	if err != nil {
+		return Token{}, false, err
+	}
+	now := time.Now().UTC()
+	if token.Expired(now) {
+		return Token{}, false, nil
+	}
+	if _, err := s.db.Exec("UPDATE tokens SET last_used_at = ? WHERE id = ?", now.Format(time.RFC3339), token.ID); err != nil {
+		return Token{}, false, err
+	}
+	token.LastUsedAt = now
+	return token, true, nil
+}
+
+func (s *Store) GetToken(id int64) (Token, bool, error) {
+	token, err := scanToken(s.db.QueryRow(tokenSelect+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return Token{}, false, nil
+	}
+	if err != nil {
+		return Token{}, false, err
+	}
+	return token, true, nil
+}
+
+func (s *Store) ListTokens() ([]Token, error) {
+	rows, err := s.db.Query(tokenSelect + " ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []Token
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, token)
+	}
+	return results, rows.Err()
+}
+
+// RevokeToken revokes a single token, leaving the others active.
+func (s *Store) RevokeToken(id int64) error {
+	result, err := s.db.Exec("UPDATE tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", nowUTC(), id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// SeedTokenID returns the id of the first relay token ever stored, the one
+// seeded from PORTOPENER_RELAY_TOKEN, if it is still active.
+func (s *Store) SeedTokenID() (int64, error) {
+	var id int64
+	err := s.db.QueryRow("SELECT id FROM tokens WHERE id = (SELECT MIN(id) FROM tokens) AND revoked_at IS NULL").Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrTokenNotFound
+	}
+	return id, err
+}
+
+// RotateTokenByID replaces the secret of one active token. The token keeps
+// its id, so its name, scopes and reservations are unchanged.
+func (s *Store) RotateTokenByID(id int64, raw string) error {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return fmt.Errorf("token required")
+	}
+	result, err := s.db.Exec("UPDATE tokens SET token_hash = ?, last_used_at = NULL WHERE id = ? AND revoked_at IS NULL", hashToken(trimmed), id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+const tokenSelect = `SELECT id, IFNULL(name, ''), IFNULL(protocols, ''), IFNULL(subdomain_patterns, ''), IFNULL(port_ranges, ''),
+	created_at, IFNULL(expires_at, ''), IFNULL(last_used_at, ''), IFNULL(revoked_at, '') FROM tokens`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row rowScanner) (Token, error) {
+	var token Token
+	var protocols, patterns, ports, createdAt, expiresAt, lastUsedAt, revokedAt string
+	if err := row.Scan(&token.ID, &token.Name, &protocols, &patterns, &ports, &createdAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+		return Token{}, err
+	}
+	token.Protocols = splitList(protocols)
+	token.SubdomainPatterns = splitList(patterns)
+	token.PortRanges = splitList(ports)
+	token.CreatedAt = parseTime(createdAt)
+	token.ExpiresAt = parseTime(expiresAt)
+	token.LastUsedAt = parseTime(lastUsedAt)
+	token.RevokedAt = parseTime(revokedAt)
+	return token, nil
+}
+
+func normalizeList(values []string, lower bool) []string {
+	var out []string
+	for _, value := range values {
+		trimmed := strings.TrimSpace(value)
+		if trimmed == "" {
+			continue
+		}
+		if lower {
+			trimmed = strings.ToLower(trimmed)
+		}
+		out = append(out, trimmed)
+	}
+	return out
+}
+
+func containsFold(values []string, target string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func parseTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+func nullableTime(value time.Time) any {
+	if value.IsZero() {
+		return nil
+	}
+	return value.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openMigratedStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	if err := store.ApplyMigrations(migrationsDir(t)); err != nil {
+		t.Fatalf("migrations failed: %v", err)
+	}
+	return store
+}
+
+func TestNamedTokensRevokeIndependently(t *testing.T) {
+	store := openMigratedStore(t)
+
+	alice, err := store.CreateToken(Token{Name: "alice"}, "alice-secret")
+	if err != nil {
+		t.Fatalf("create alice failed: %v", err)
+	}
+	if _, err := store.CreateToken(Token{Name: "ci"}, "ci-secret"); err != nil {
+		t.Fatalf("create ci failed: %v", err)
+	}
+
+	authed, ok, err := store.AuthenticateToken("alice-secret")
+	if err != nil || !ok {
+		t.Fatalf("authenticate failed: ok=%v err=%v", ok, err)
+	}
+	if authed.Name != "alice" || authed.LastUsedAt.IsZero() {
+		t.Fatalf("unexpected token %+v", authed)
+	}
+
+	if err := store.RevokeToken(alice.ID); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+	if _, ok, _ := store.AuthenticateToken("alice-secret"); ok {
+		t.Fatalf("expected alice revoked")
+	}
+	if _, ok, _ := store.AuthenticateToken("ci-secret"); !ok {
+		t.Fatalf("expected ci still active")
+	}
+	if err := store.RevokeToken(alice.ID); err != ErrTokenNotFound {
+		t.Fatalf("expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestExpiredTokenRejected(t *testing.T) {
+	store := openMigratedStore(t)
+	if _, err := store.CreateToken(Token{Name: "old", ExpiresAt: time.Now().Add(-time.Minute)}, "old-secret"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, ok, _ := store.AuthenticateToken("old-secret"); ok {
+		t.Fatalf("expected expired token rejected")
+	}
+	if ok, _ := store.ValidateToken("old-secret"); ok {
+		t.Fatalf("expected expired token invalid")
+	}
+}
+
+func TestCreateTokenValidatesScopes(t *testing.T) {
+	store := openMigratedStore(t)
+	if _, err := store.CreateToken(Token{Name: "bad", Protocols: []string{"ftp"}}, "x"); err == nil {
+		t.Fatalf("expected invalid protocol rejected")
+	}
+	if _, err := store.CreateToken(Token{Name: "bad", PortRanges: []string{"30000-20000"}}, "x"); err == nil {
+		t.Fatalf("expected invalid port range rejected")
+	}
+}
+
+func TestTokenPermits(t *testing.T) {
+	token := Token{
+		Protocols:         []string{"http", "tcp"},
+		SubdomainPatterns: []string{"alice-*"},
+		PortRanges:        []string{"25000-25010", "26000"},
+	}
+	cases := []struct {
+		protocol  string
+		subdomain string
+		port      int
+		want      bool
+	}{
+		{"http", "alice-app", 0, true},
+		{"http", "bob-app", 0, false},
+		{"tcp", "", 25005, true},
+		{"tcp", "", 26000, true},
+		{"tcp", "", 25011, false},
+		{"udp", "", 25005, false},
+	}
+	for _, tc := range cases {
+		if got := token.Permits(tc.protocol, tc.subdomain, tc.port); got != tc.want {
+			t.Fatalf("Permits(%s, %s, %d) = %v, want %v", tc.protocol, tc.subdomain, tc.port, got, tc.want)
+		}
+	}
+	if !(Token{}).Permits("udp", "", 1) {
+		t.Fatalf("expected unscoped token to permit everything")
+	}
+}
+
+func TestAdminTokensKeepLastOwner(t *testing.T) {
+	store := openMigratedStore(t)
+	if err := store.EnsureAdminToken("bootstrap-secret"); err != nil {
+		t.Fatalf("ensure admin token failed: %v", err)
+	}
+	owner, ok, err := store.AuthenticateAdminToken("bootstrap-secret")
+	if err != nil || !ok || owner.Role != RoleOwner {
+		t.Fatalf("expected bootstrap owner, got %+v ok=%v err=%v", owner, ok, err)
+	}
+	if _, ok, _ := store.AuthenticateToken("bootstrap-secret"); ok {
+		t.Fatalf("expected admin token rejected as relay token")
+	}
+	if err := store.RevokeAdminToken(owner.ID); err != ErrLastOwnerToken {
+		t.Fatalf("expected ErrLastOwnerToken, got %v", err)
+	}
+	if _, err := store.CreateAdminToken(AdminToken{Name: "x", Role: "admin"}, "x"); err == nil {
+		t.Fatalf("expected unknown role rejected")
+	}
+}
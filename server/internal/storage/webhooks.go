@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Webhook is an outgoing subscription. Events lists the event types it
+// receives; an empty list receives every webhook event.
+type Webhook struct {
+	ID        int64
+	URL       string
+	Secret    string
+	Events    []string
+	CreatedAt time.Time
+}
+
+// Wants reports whether the webhook subscribes to event.
+func (w Webhook) Wants(event string) bool {
+	return len(w.Events) == 0 || containsFold(w.Events, event)
+}
+
+// WebhookDelivery records one delivery attempt.
+type WebhookDelivery struct {
+	ID         int64
+	WebhookID  int64
+	Event      string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Succeeded  bool
+	CreatedAt  time.Time
+}
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// CreateWebhook stores a subscription. The caller supplies the signing secret.
+func (s *Store) CreateWebhook(hook Webhook) (Webhook, error) {
+	hook.URL = strings.TrimSpace(hook.URL)
+	parsed, err := url.Parse(hook.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return Webhook{}, fmt.Errorf("webhook url must be an absolute http or https url")
+	}
+	if strings.TrimSpace(hook.Secret) == "" {
+		return Webhook{}, fmt.Errorf("webhook secret required")
+	}
+	hook.Events = normalizeList(hook.Events, true)
+	hook.CreatedAt = time.Now().UTC()
+	result, err := s.db.Exec(`INSERT INTO webhooks (url, secret, events, created_at) VALUES (?, ?, ?, ?)`,
+		hook.URL, hook.Secret, strings.Join(hook.Events, ","), hook.CreatedAt.Format(time.RFC3339))
+	if err != nil {
+		return Webhook{}, err
+	}
+	hook.ID, err = result.LastInsertId()
+	return hook, err
+}
+
+func (s *Store) ListWebhooks() ([]Webhook, error) {
+	rows, err := s.db.Query(`SELECT id, url, secret, events, created_at FROM webhooks ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hooks []Webhook
+	for rows.Next() {
+		var hook Webhook
+		var events, createdAt string
+		if err := rows.Scan(&hook.ID, &hook.URL, &hook.Secret, &events, &createdAt); err != nil {
+			return nil, err
+		}
+		hook.Events = splitList(events)
+		hook.CreatedAt = parseTime(createdAt)
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *Store) GetWebhook(id int64) (Webhook, bool, error) {
+	var hook Webhook
+	var events, createdAt string
+	err := s.db.QueryRow(`SELECT id, url, secret, events, created_at FROM webhooks WHERE id = ?`, id).
+		Scan(&hook.ID, &hook.URL, &hook.Secret, &events, &createdAt)
+	if err == sql.ErrNoRows {
+		return Webhook{}, false, nil
+	}
+	if err != nil {
+		return Webhook{}, false, err
+	}
+	hook.Events = splitList(events)
+	hook.CreatedAt = parseTime(createdAt)
+	return hook, true, nil
+}
+
+// DeleteWebhook removes a subscription and its delivery log.
+func (s *Store) DeleteWebhook(id int64) error {
+	result, err := s.db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *Store) InsertWebhookDelivery(delivery WebhookDelivery) error {
+	if delivery.CreatedAt.IsZero() {
+		delivery.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.db.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, attempt, status_code, error, succeeded, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		delivery.WebhookID, delivery.Event, delivery.Attempt, delivery.StatusCode, delivery.Error, delivery.Succeeded,
+		delivery.CreatedAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+// ListWebhookDeliveries returns a webhook's most recent delivery attempts.
+func (s *Store) ListWebhookDeliveries(webhookID int64, limit int) ([]WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = 200
+	}
+	rows, err := s.db.Query(`SELECT id, webhook_id, event, attempt, status_code, error, succeeded, created_at
+		FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var createdAt string
+		if err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &delivery.Attempt, &delivery.StatusCode,
+			&delivery.Error, &delivery.Succeeded, &createdAt); err != nil {
+			return nil, err
+		}
+		delivery.CreatedAt = parseTime(createdAt)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
@@ -1,6 +1,7 @@
 package tunnels
 
 import (
+	"fmt"
 	"net"
 	"strings"
 )
@@ -64,3 +65,67 @@ func (a *Allowlist) Allows(remoteAddr string) bool {
 	}
 	return false
 }
+
+// AllowlistMode says how a server-side allowlist combines with the one the
+// client sent.
+type AllowlistMode string
+
+const (
+	// AllowlistIntersect admits a peer only if both allowlists allow it.
+	AllowlistIntersect AllowlistMode = "intersect"
+	// AllowlistOverride ignores the client's allowlist.
+	AllowlistOverride AllowlistMode = "override"
+)
+
+// ParseAllowlistMode validates a mode; the empty string means intersect.
+func ParseAllowlistMode(value string) (AllowlistMode, error) {
+	switch mode := AllowlistMode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case "", AllowlistIntersect:
+		return AllowlistIntersect, nil
+	case AllowlistOverride:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("allowlist mode must be %s or %s", AllowlistIntersect, AllowlistOverride)
+	}
+}
+
+// AccessPolicy is the parsed allowlist a tunnel enforces. It is built once
+// when the tunnel registers or its allowlist changes, not per connection.
+type AccessPolicy struct {
+	client *Allowlist
+	server *Allowlist
+	mode   AllowlistMode
+}
+
+// NewAccessPolicy parses the client- and server-side allowlists. Without a
+// server-side list the client's applies on its own.
+func NewAccessPolicy(client, server []string, mode AllowlistMode) (*AccessPolicy, error) {
+	clientList, err := ParseAllowlist(client)
+	if err != nil {
+		return nil, err
+	}
+	serverList, err := ParseAllowlist(server)
+	if err != nil {
+		return nil, err
+	}
+	policy := &AccessPolicy{client: clientList, mode: mode}
+	if len(serverList.nets) > 0 {
+		policy.server = serverList
+	}
+	return policy, nil
+}
+
+// Allows reports whether remoteAddr may reach the tunnel. A nil policy
+// allows everyone.
+func (p *AccessPolicy) Allows(remoteAddr string) bool {
+	if p == nil {
+		return true
+	}
+	if p.server == nil {
+		return p.client.Allows(remoteAddr)
+	}
+	if p.mode == AllowlistOverride {
+		return p.server.Allows(remoteAddr)
+	}
+	return p.client.Allows(remoteAddr) && p.server.Allows(remoteAddr)
+}
@@ -0,0 +1,154 @@
+package tunnels
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// A suspended tunnel is one whose session dropped less than a grace period
+// ago. Its entry stays in the registry as a placeholder with no session, so
+// the subdomain or port stays held and proxies can wait for the same tunnel
+// to register again instead of failing at once. The placeholder's resumed
+// channel is closed when the tunnel re-registers, is removed, or the grace
+// period ends.
+
+// Reconnecting reports whether the entry is a placeholder for a tunnel whose
+// client is reconnecting.
+func (e HTTPEntry) Reconnecting() bool { return e.resumed != nil }
+
+// Reconnecting reports whether the entry is a placeholder for a tunnel whose
+// client is reconnecting.
+func (e TCPEntry) Reconnecting() bool { return e.resumed != nil }
+
+// Reconnecting reports whether the entry is a placeholder for a tunnel whose
+// client is reconnecting.
+func (e UDPEntry) Reconnecting() bool { return e.resumed != nil }
+
+// SuspendHTTP replaces the entry for subdomain with a placeholder if it is
+// still served by session. The placeholder is removed after grace unless the
+// tunnel registers again first. It reports whether the entry was suspended.
+func (r *Registry) SuspendHTTP(subdomain string, session *yamux.Session, grace time.Duration) bool {
+	key := strings.ToLower(strings.TrimSpace(subdomain))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.httpMap[key]
+	if !ok || entry.Session != session || session == nil {
+		return false
+	}
+	resumed := make(chan struct{})
+	entry.Session = nil
+	entry.resumed = resumed
+	r.httpMap[key] = entry
+	time.AfterFunc(grace, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if current, ok := r.httpMap[key]; ok && current.resumed == resumed {
+			delete(r.httpMap, key)
+			close(resumed)
+		}
+	})
+	return true
+}
+
+// SuspendTCP is SuspendHTTP for a TCP port. onExpire runs if the grace period
+// ends without the tunnel registering again.
+func (r *Registry) SuspendTCP(externalPort int, session *yamux.Session, grace time.Duration, onExpire func()) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.tcpMap[externalPort]
+	if !ok || entry.Session != session || session == nil {
+		return false
+	}
+	resumed := make(chan struct{})
+	entry.Session = nil
+	entry.resumed = resumed
+	r.tcpMap[externalPort] = entry
+	time.AfterFunc(grace, func() {
+		r.mu.Lock()
+		current, ok := r.tcpMap[externalPort]
+		expired := ok && current.resumed == resumed
+		if expired {
+			delete(r.tcpMap, externalPort)
+			close(resumed)
+		}
+		r.mu.Unlock()
+		if expired && onExpire != nil {
+			onExpire()
+		}
+	})
+	return true
+}
+
+// SuspendUDP is SuspendHTTP for a UDP port. onExpire runs if the grace period
+// ends without the tunnel registering again.
+func (r *Registry) SuspendUDP(externalPort int, session *yamux.Session, grace time.Duration, onExpire func()) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.udpMap[externalPort]
+	if !ok || entry.Session != session || session == nil {
+		return false
+	}
+	resumed := make(chan struct{})
+	entry.Session = nil
+	entry.resumed = resumed
+	r.udpMap[externalPort] = entry
+	time.AfterFunc(grace, func() {
+		r.mu.Lock()
+		current, ok := r.udpMap[externalPort]
+		expired := ok && current.resumed == resumed
+		if expired {
+			delete(r.udpMap, externalPort)
+			close(resumed)
+		}
+		r.mu.Unlock()
+		if expired && onExpire != nil {
+			onExpire()
+		}
+	})
+	return true
+}
+
+// AwaitHTTP waits until the placeholder resolves or ctx is done, returning
+// the re-registered entry. It reports false if the tunnel did not come back.
+func (r *Registry) AwaitHTTP(ctx context.Context, placeholder HTTPEntry) (HTTPEntry, bool) {
+	if !placeholder.Reconnecting() {
+		return placeholder, placeholder.Session != nil
+	}
+	select {
+	case <-placeholder.resumed:
+	case <-ctx.Done():
+		return HTTPEntry{}, false
+	}
+	entry, ok := r.LookupHTTP(placeholder.Subdomain)
+	if !ok || entry.Reconnecting() || entry.TunnelID != placeholder.TunnelID {
+		return HTTPEntry{}, false
+	}
+	return entry, true
+}
+
+// AwaitTCP waits until the placeholder resolves or ctx is done, returning the
+// re-registered entry. It reports false if the tunnel did not come back.
+func (r *Registry) AwaitTCP(ctx context.Context, placeholder TCPEntry) (TCPEntry, bool) {
+	if !placeholder.Reconnecting() {
+		return placeholder, placeholder.Session != nil
+	}
+	select {
+	case <-placeholder.resumed:
+	case <-ctx.Done():
+		return TCPEntry{}, false
+	}
+	entry, ok := r.LookupTCP(placeholder.ExternalPort)
+	if !ok || entry.Reconnecting() || entry.TunnelID != placeholder.TunnelID {
+		return TCPEntry{}, false
+	}
+	return entry, true
+}
+
+func release(resumed chan struct{}) {
+	if resumed != nil {
+		close(resumed)
+	}
+}
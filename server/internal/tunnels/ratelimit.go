@@ -0,0 +1,185 @@
+package tunnels
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimit caps how fast traffic may reach a tunnel, counted as requests for
+// HTTP, new connections for TCP and datagrams for UDP. Rate applies to the
+// whole tunnel and PerIP to each remote IP, both per second; zero means
+// unlimited. A zero burst defaults to one second's worth.
+type RateLimit struct {
+	Rate       float64
+	Burst      int
+	PerIP      float64
+	PerIPBurst int
+}
+
+// IsZero reports whether the limit allows everything.
+func (l RateLimit) IsZero() bool { return l.Rate == 0 && l.PerIP == 0 }
+
+// Validate rejects negative rates and bursts.
+func (l RateLimit) Validate() error {
+	if l.Rate < 0 || l.PerIP < 0 || l.Burst < 0 || l.PerIPBurst < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if math.IsNaN(l.Rate) || math.IsNaN(l.PerIP) || math.IsInf(l.Rate, 0) || math.IsInf(l.PerIP, 0) {
+		return errors.New("rate limits must be finite")
+	}
+	return nil
+}
+
+// Stricter combines two limits field by field, keeping the lower of any two
+// set values so that neither side can loosen the other.
+func (l RateLimit) Stricter(other RateLimit) RateLimit {
+	rate, burst := stricter(l.Rate, l.Burst, other.Rate, other.Burst)
+	perIP, perIPBurst := stricter(l.PerIP, l.PerIPBurst, other.PerIP, other.PerIPBurst)
+	return RateLimit{Rate: rate, Burst: burst, PerIP: perIP, PerIPBurst: perIPBurst}
+}
+
+func stricter(rate float64, burst int, otherRate float64, otherBurst int) (float64, int) {
+	switch {
+	case otherRate == 0:
+		return rate, burst
+	case rate == 0:
+		return otherRate, otherBurst
+	}
+	return math.Min(rate, otherRate), min(burstSize(rate, burst), burstSize(otherRate, otherBurst))
+}
+
+// burstSize applies the default of one second's worth to an unset burst.
+func burstSize(rate float64, burst int) int {
+	if burst > 0 {
+		return burst
+	}
+	return int(math.Max(1, math.Ceil(rate)))
+}
+
+// ipSweepEvery is how often full per-IP buckets are forgotten. Once a
+// limiter tracks maxIPBuckets addresses, as a flood of spoofed UDP sources
+// would make it, it sweeps as often as ipSweepFullEvery and refuses addresses
+// it has no room for.
+const (
+	ipSweepEvery     = time.Minute
+	ipSweepFullEvery = time.Second
+	maxIPBuckets     = 10000
+)
+
+// Limiter enforces a RateLimit with token buckets: one for the tunnel and one
+// per remote IP. A nil *Limiter allows everything.
+type Limiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	tunnel    *bucket
+	perIP     map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns nil for a zero limit.
+func NewLimiter(limit RateLimit) *Limiter {
+	if limit.IsZero() {
+		return nil
+	}
+	l := &Limiter{limit: limit, perIP: make(map[string]*bucket)}
+	if limit.Rate > 0 {
+		l.tunnel = newBucket(limit.Rate, limit.Burst, time.Now())
+	}
+	return l
+}
+
+// Allow takes a token for the tunnel and for remoteAddr's IP. When either is
+// empty nothing is taken and it returns how long until one is available.
+func (l *Limiter) Allow(remoteAddr string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ip *bucket
+	if l.limit.PerIP > 0 {
+		key := remoteIP(remoteAddr)
+		l.sweep(now, ipSweepEvery)
+		ip = l.perIP[key]
+		if ip == nil && len(l.perIP) >= maxIPBuckets {
+			l.sweep(now, ipSweepFullEvery)
+			if len(l.perIP) >= maxIPBuckets {
+				return false, ipSweepFullEvery
+			}
+		}
+		if ip == nil {
+			ip = newBucket(l.limit.PerIP, l.limit.PerIPBurst, now)
+			l.perIP[key] = ip
+		}
+	}
+	var wait time.Duration
+	for _, b := range []*bucket{ip, l.tunnel} {
+		if b == nil {
+			continue
+		}
+		if w := b.refill(now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range []*bucket{ip, l.tunnel} {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return true, 0
+}
+
+// sweep forgets per-IP buckets that have refilled completely, as a fresh
+// bucket would behave the same, unless the last sweep was within every.
+// Callers hold l.mu.
+func (l *Limiter) sweep(now time.Time, every time.Duration) {
+	if now.Sub(l.lastSweep) < every {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.perIP {
+		if b.refill(now) == 0 && b.tokens >= b.burst {
+			delete(l.perIP, key)
+		}
+	}
+}
+
+func newBucket(rate float64, burst int, now time.Time) *bucket {
+	size := float64(burstSize(rate, burst))
+	return &bucket{rate: rate, burst: size, tokens: size, last: now}
+}
+
+// refill tops the bucket up for the time elapsed and returns how long until
+// it holds a whole token, or 0 if it already does.
+func (b *bucket) refill(now time.Time) time.Duration {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/yamux"
 )
@@ -12,26 +13,102 @@ var ErrTunnelExists = errors.New("tunnel already registered")
 
 type HTTPRegistration struct {
 	Subdomain string
-	Allowlist []string
+	// Allowlist is the client's; ServerAllowlist is set by an operator and
+	// combined with it according to AllowlistMode.
+	Allowlist       []string
+	ServerAllowlist []string
+	AllowlistMode   AllowlistMode
+	// RateLimit is the client's and ServerRateLimit an operator's; the
+	// stricter of the two applies.
+	RateLimit       RateLimit
+	ServerRateLimit RateLimit
+	// OwnerTokenID is the relay token registering the tunnel; only the same
+	// token may take the tunnel over from another session.
+	OwnerTokenID int64
 }
 
 type HTTPEntry struct {
-	TunnelID  string
-	Subdomain string
-	Allowlist []string
-	Session   *yamux.Session
+	TunnelID        string
+	Subdomain       string
+	Allowlist       []string
+	ServerAllowlist []string
+	AllowlistMode   AllowlistMode
+	RateLimit       RateLimit
+	ServerRateLimit RateLimit
+	OwnerTokenID    int64
+	Session         *yamux.Session
+	policy          *AccessPolicy
+	limiter         *Limiter
+	resumed         chan struct{}
+}
+
+// Allows reports whether remoteAddr may reach the tunnel.
+func (e HTTPEntry) Allows(remoteAddr string) bool { return e.policy.Allows(remoteAddr) }
+
+// AllowRate counts a request from remoteAddr against the tunnel's rate
+// limits. When refused it reports how long until the next would be allowed.
+func (e HTTPEntry) AllowRate(remoteAddr string) (bool, time.Duration) {
+	return e.limiter.Allow(remoteAddr)
+}
+
+// PortRegistration describes a TCP or UDP tunnel; its allowlists, rate
+// limits and owner work as in HTTPRegistration.
+type PortRegistration struct {
+	ExternalPort    int
+	Allowlist       []string
+	ServerAllowlist []string
+	AllowlistMode   AllowlistMode
+	RateLimit       RateLimit
+	ServerRateLimit RateLimit
+	OwnerTokenID    int64
 }
 
 type TCPEntry struct {
-	TunnelID     string
-	ExternalPort int
-	Session      *yamux.Session
+	TunnelID        string
+	ExternalPort    int
+	Allowlist       []string
+	ServerAllowlist []string
+	AllowlistMode   AllowlistMode
+	RateLimit       RateLimit
+	ServerRateLimit RateLimit
+	OwnerTokenID    int64
+	Session         *yamux.Session
+	policy          *AccessPolicy
+	limiter         *Limiter
+	resumed         chan struct{}
+}
+
+// Allows reports whether remoteAddr may connect to the tunnel.
+func (e TCPEntry) Allows(remoteAddr string) bool { return e.policy.Allows(remoteAddr) }
+
+// AllowRate counts a new connection from remoteAddr against the tunnel's
+// rate limits.
+func (e TCPEntry) AllowRate(remoteAddr string) (bool, time.Duration) {
+	return e.limiter.Allow(remoteAddr)
 }
 
 type UDPEntry struct {
-	TunnelID     string
-	ExternalPort int
-	Session      *yamux.Session
+	TunnelID        string
+	ExternalPort    int
+	Allowlist       []string
+	ServerAllowlist []string
+	AllowlistMode   AllowlistMode
+	RateLimit       RateLimit
+	ServerRateLimit RateLimit
+	OwnerTokenID    int64
+	Session         *yamux.Session
+	policy          *AccessPolicy
+	limiter         *Limiter
+	resumed         chan struct{}
+}
+
+// Allows reports whether datagrams from remoteAddr may reach the tunnel.
+func (e UDPEntry) Allows(remoteAddr string) bool { return e.policy.Allows(remoteAddr) }
+
+// AllowRate counts a datagram from remoteAddr against the tunnel's rate
+// limits.
+func (e UDPEntry) AllowRate(remoteAddr string) (bool, time.Duration) {
+	return e.limiter.Allow(remoteAddr)
 }
 
 type Registry struct {
@@ -50,27 +127,121 @@ func (r *Registry) RegisterHTTP(tunnelID string, session *yamux.Session, reg HTT
 	if key == "" {
 		return errors.New("subdomain required")
 	}
+	policy, err := NewAccessPolicy(reg.Allowlist, reg.ServerAllowlist, reg.AllowlistMode)
+	if err != nil {
+		return err
+	}
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, exists := r.httpMap[key]; exists {
+	// The same tunnel ID, registered with the same token, may take over its
+	// subdomain: that is a client resuming after a reconnect, possibly before
+	// its old session was cleaned up. Tunnel IDs are not secret, so another
+	// token presenting one is refused.
+	existing, exists := r.httpMap[key]
+	if exists && (existing.TunnelID != tunnelID || existing.OwnerTokenID != reg.OwnerTokenID) {
 		return ErrTunnelExists
 	}
+	release(existing.resumed)
 
 	r.httpMap[key] = HTTPEntry{
-		TunnelID:  tunnelID,
-		Subdomain: key,
-		Allowlist: reg.Allowlist,
-		Session:   session,
+		TunnelID:        tunnelID,
+		Subdomain:       key,
+		Allowlist:       reg.Allowlist,
+		ServerAllowlist: reg.ServerAllowlist,
+		AllowlistMode:   reg.AllowlistMode,
+		RateLimit:       reg.RateLimit,
+		ServerRateLimit: reg.ServerRateLimit,
+		OwnerTokenID:    reg.OwnerTokenID,
+		Session:         session,
+		policy:          policy,
+		limiter:         NewLimiter(reg.RateLimit.Stricter(reg.ServerRateLimit)),
+	}
+	return nil
+}
+
+// SetServerAllowlist replaces the server-side allowlist of a registered tunnel.
+// It takes effect on the next request, connection or datagram without the
+// client reconnecting; open TCP connections are not re-checked.
+func (r *Registry) SetServerAllowlist(tunnelID string, server []string, mode AllowlistMode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, entry := range r.httpMap {
+		if entry.TunnelID != tunnelID {
+			continue
+		}
+		policy, err := NewAccessPolicy(entry.Allowlist, server, mode)
+		if err != nil {
+			return err
+		}
+		entry.ServerAllowlist = server
+		entry.AllowlistMode = mode
+		entry.policy = policy
+		r.httpMap[key] = entry
+	}
+	for port, entry := range r.tcpMap {
+		if entry.TunnelID != tunnelID {
+			continue
+		}
+		policy, err := NewAccessPolicy(entry.Allowlist, server, mode)
+		if err != nil {
+			return err
+		}
+		entry.ServerAllowlist = server
+		entry.AllowlistMode = mode
+		entry.policy = policy
+		r.tcpMap[port] = entry
+	}
+	for port, entry := range r.udpMap {
+		if entry.TunnelID != tunnelID {
+			continue
+		}
+		policy, err := NewAccessPolicy(entry.Allowlist, server, mode)
+		if err != nil {
+			return err
+		}
+		entry.ServerAllowlist = server
+		entry.AllowlistMode = mode
+		entry.policy = policy
+		r.udpMap[port] = entry
 	}
 	return nil
 }
 
+// SetServerRateLimit replaces the operator-set rate limit of a registered
+// tunnel. Its buckets start full again.
+func (r *Registry) SetServerRateLimit(tunnelID string, limit RateLimit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, entry := range r.httpMap {
+		if entry.TunnelID == tunnelID {
+			entry.ServerRateLimit = limit
+			entry.limiter = NewLimiter(entry.RateLimit.Stricter(limit))
+			r.httpMap[key] = entry
+		}
+	}
+	for port, entry := range r.tcpMap {
+		if entry.TunnelID == tunnelID {
+			entry.ServerRateLimit = limit
+			entry.limiter = NewLimiter(entry.RateLimit.Stricter(limit))
+			r.tcpMap[port] = entry
+		}
+	}
+	for port, entry := range r.udpMap {
+		if entry.TunnelID == tunnelID {
+			entry.ServerRateLimit = limit
+			entry.limiter = NewLimiter(entry.RateLimit.Stricter(limit))
+			r.udpMap[port] = entry
+		}
+	}
+}
+
 func (r *Registry) RemoveHTTP(subdomain string) {
 	key := strings.ToLower(strings.TrimSpace(subdomain))
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	release(r.httpMap[key].resumed)
 	delete(r.httpMap, key)
 }
 
@@ -84,6 +255,7 @@ func (r *Registry) RemoveHTTPByTunnelID(tunnelID string) []HTTPEntry {
 	for key, entry := range r.httpMap {
 		if entry.TunnelID == tunnelID {
 			removed = append(removed, entry)
+			release(entry.resumed)
 			delete(r.httpMap, key)
 		}
 	}
@@ -122,19 +294,38 @@ func (r *Registry) ListHTTP() []HTTPEntry {
 	return entries
 }
 
-func (r *Registry) RegisterTCP(tunnelID string, session *yamux.Session, externalPort int) error {
+func (r *Registry) RegisterTCP(tunnelID string, session *yamux.Session, reg PortRegistration) error {
 	if tunnelID == "" {
 		return errors.New("tunnel id required")
 	}
+	externalPort := reg.ExternalPort
 	if externalPort == 0 {
 		return errors.New("external port required")
 	}
+	policy, err := NewAccessPolicy(reg.Allowlist, reg.ServerAllowlist, reg.AllowlistMode)
+	if err != nil {
+		return err
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if existing, exists := r.tcpMap[externalPort]; exists && existing.TunnelID != tunnelID {
+	existing, exists := r.tcpMap[externalPort]
+	if exists && (existing.TunnelID != tunnelID || existing.OwnerTokenID != reg.OwnerTokenID) {
 		return ErrTunnelExists
 	}
-	r.tcpMap[externalPort] = TCPEntry{TunnelID: tunnelID, ExternalPort: externalPort, Session: session}
+	release(existing.resumed)
+	r.tcpMap[externalPort] = TCPEntry{
+		TunnelID:        tunnelID,
+		ExternalPort:    externalPort,
+		Allowlist:       reg.Allowlist,
+		ServerAllowlist: reg.ServerAllowlist,
+		AllowlistMode:   reg.AllowlistMode,
+		RateLimit:       reg.RateLimit,
+		ServerRateLimit: reg.ServerRateLimit,
+		OwnerTokenID:    reg.OwnerTokenID,
+		Session:         session,
+		policy:          policy,
+		limiter:         NewLimiter(reg.RateLimit.Stricter(reg.ServerRateLimit)),
+	}
 	return nil
 }
 
@@ -148,6 +339,7 @@ func (r *Registry) LookupTCP(externalPort int) (TCPEntry, bool) {
 func (r *Registry) RemoveTCP(externalPort int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	release(r.tcpMap[externalPort].resumed)
 	delete(r.tcpMap, externalPort)
 }
 
@@ -161,6 +353,7 @@ func (r *Registry) RemoveTCPByTunnelID(tunnelID string) []TCPEntry {
 	for port, entry := range r.tcpMap {
 		if entry.TunnelID == tunnelID {
 			removed = append(removed, entry)
+			release(entry.resumed)
 			delete(r.tcpMap, port)
 		}
 	}
@@ -177,19 +370,38 @@ func (r *Registry) ListTCP() []TCPEntry {
 	return entries
 }
 
-func (r *Registry) RegisterUDP(tunnelID string, session *yamux.Session, externalPort int) error {
+func (r *Registry) RegisterUDP(tunnelID string, session *yamux.Session, reg PortRegistration) error {
 	if tunnelID == "" {
 		return errors.New("tunnel id required")
 	}
+	externalPort := reg.ExternalPort
 	if externalPort == 0 {
 		return errors.New("external port required")
 	}
+	policy, err := NewAccessPolicy(reg.Allowlist, reg.ServerAllowlist, reg.AllowlistMode)
+	if err != nil {
+		return err
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if existing, exists := r.udpMap[externalPort]; exists && existing.TunnelID != tunnelID {
+	existing, exists := r.udpMap[externalPort]
+	if exists && (existing.TunnelID != tunnelID || existing.OwnerTokenID != reg.OwnerTokenID) {
 		return ErrTunnelExists
 	}
-	r.udpMap[externalPort] = UDPEntry{TunnelID: tunnelID, ExternalPort: externalPort, Session: session}
+	release(existing.resumed)
+	r.udpMap[externalPort] = UDPEntry{
+		TunnelID:        tunnelID,
+		ExternalPort:    externalPort,
+		Allowlist:       reg.Allowlist,
+		ServerAllowlist: reg.ServerAllowlist,
+		AllowlistMode:   reg.AllowlistMode,
+		RateLimit:       reg.RateLimit,
+		ServerRateLimit: reg.ServerRateLimit,
+		OwnerTokenID:    reg.OwnerTokenID,
+		Session:         session,
+		policy:          policy,
+		limiter:         NewLimiter(reg.RateLimit.Stricter(reg.ServerRateLimit)),
+	}
 	return nil
 }
 
@@ -203,6 +415,7 @@ func (r *Registry) LookupUDP(externalPort int) (UDPEntry, bool) {
 func (r *Registry) RemoveUDP(externalPort int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	release(r.udpMap[externalPort].resumed)
 	delete(r.udpMap, externalPort)
 }
 
@@ -216,6 +429,7 @@ func (r *Registry) RemoveUDPByTunnelID(tunnelID string) []UDPEntry {
 	for port, entry := range r.udpMap {
 		if entry.TunnelID == tunnelID {
 			removed = append(removed, entry)
+			release(entry.resumed)
 			delete(r.udpMap, port)
 		}
 	}
@@ -1,6 +1,13 @@
 package tunnels
 
-import "testing"
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
 
 func TestRegistryRegisterHTTPDuplicate(t *testing.T) {
 	registry := NewRegistry()
@@ -14,10 +21,10 @@ func TestRegistryRegisterHTTPDuplicate(t *testing.T) {
 
 func TestRegistryRegisterTCPConflict(t *testing.T) {
 	registry := NewRegistry()
-	if err := registry.RegisterTCP("t1", nil, 25000); err != nil {
+	if err := registry.RegisterTCP("t1", nil, PortRegistration{ExternalPort: 25000}); err != nil {
 		t.Fatalf("first register failed: %v", err)
 	}
-	if err := registry.RegisterTCP("t2", nil, 25000); err != ErrTunnelExists {
+	if err := registry.RegisterTCP("t2", nil, PortRegistration{ExternalPort: 25000}); err != ErrTunnelExists {
 		t.Fatalf("expected ErrTunnelExists, got %v", err)
 	}
 }
@@ -39,3 +46,177 @@ func TestRegistryRemoveHTTPByTunnelID(t *testing.T) {
 		t.Fatalf("expected other to remain")
 	}
 }
+
+func TestRegistryRegisterHTTPResumesSameTunnel(t *testing.T) {
+	registry := NewRegistry()
+	if err := registry.RegisterHTTP("t1", nil, HTTPRegistration{Subdomain: "app"}); err != nil {
+		t.Fatalf("first register failed: %v", err)
+	}
+	if err := registry.RegisterHTTP("t1", nil, HTTPRegistration{Subdomain: "app", Allowlist: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatalf("expected same tunnel to resume, got %v", err)
+	}
+	entry, ok := registry.LookupHTTP("app")
+	if !ok || len(entry.Allowlist) != 1 {
+		t.Fatalf("expected resumed entry to replace the old one, got %+v", entry)
+	}
+}
+
+func TestRegistrySuspendedTCPExpires(t *testing.T) {
+	registry := NewRegistry()
+	session := &yamux.Session{}
+	if err := registry.RegisterTCP("t1", session, PortRegistration{ExternalPort: 25000}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	expired := make(chan struct{})
+	if !registry.SuspendTCP(25000, session, 20*time.Millisecond, func() { close(expired) }) {
+		t.Fatalf("expected tunnel suspended")
+	}
+	if err := registry.RegisterTCP("t2", nil, PortRegistration{ExternalPort: 25000}); err != ErrTunnelExists {
+		t.Fatalf("expected port held during grace, got %v", err)
+	}
+	placeholder, ok := registry.LookupTCP(25000)
+	if !ok || !placeholder.Reconnecting() {
+		t.Fatalf("expected reconnecting placeholder, got %+v", placeholder)
+	}
+	if _, ok := registry.AwaitTCP(context.Background(), placeholder); ok {
+		t.Fatalf("expected await to fail once grace expires")
+	}
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatalf("expected onExpire called")
+	}
+	if _, ok := registry.LookupTCP(25000); ok {
+		t.Fatalf("expected placeholder removed")
+	}
+}
+
+func TestRegistryServerAllowlistAppliesLive(t *testing.T) {
+	registry := NewRegistry()
+	if err := registry.RegisterHTTP("t1", nil, HTTPRegistration{Subdomain: "app", Allowlist: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := registry.RegisterHTTP("t2", nil, HTTPRegistration{Subdomain: "bad", Allowlist: []string{"10.0.0.0"}}); err == nil {
+		t.Fatalf("expected invalid client allowlist rejected")
+	}
+
+	cases := []struct {
+		server []string
+		mode   AllowlistMode
+		remote string
+		want   bool
+	}{
+		{nil, "", "10.1.2.3:80", true},
+		{nil, "", "192.0.2.1:80", false},
+		{[]string{"10.1.0.0/16"}, AllowlistIntersect, "10.1.2.3:80", true},
+		{[]string{"10.1.0.0/16"}, AllowlistIntersect, "10.2.2.3:80", false},
+		{[]string{"192.0.2.0/24"}, AllowlistIntersect, "192.0.2.1:80", false},
+		{[]string{"192.0.2.0/24"}, AllowlistOverride, "192.0.2.1:80", true},
+		{[]string{"192.0.2.0/24"}, AllowlistOverride, "10.1.2.3:80", false},
+	}
+	for _, tc := range cases {
+		if err := registry.SetServerAllowlist("t1", tc.server, tc.mode); err != nil {
+			t.Fatalf("set allowlist failed: %v", err)
+		}
+		entry, _ := registry.LookupHTTP("app")
+		if got := entry.Allows(tc.remote); got != tc.want {
+			t.Fatalf("server=%v mode=%q remote=%s: expected %v, got %v", tc.server, tc.mode, tc.remote, tc.want, got)
+		}
+	}
+}
+
+func TestRegistryRateLimitsPerIPAndTunnel(t *testing.T) {
+	registry := NewRegistry()
+	limit := RateLimit{Rate: 1, Burst: 3, PerIP: 1, PerIPBurst: 2}
+	if err := registry.RegisterUDP("t1", nil, PortRegistration{ExternalPort: 9000, RateLimit: limit}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	entry, _ := registry.LookupUDP(9000)
+	for i := 0; i < 2; i++ {
+		if ok, _ := entry.AllowRate("192.0.2.1:1000"); !ok {
+			t.Fatalf("datagram %d: expected allowed within burst", i)
+		}
+	}
+	if ok, wait := entry.AllowRate("192.0.2.1:1001"); ok || wait <= 0 {
+		t.Fatalf("expected per-IP burst exhausted with a wait, got %v %v", ok, wait)
+	}
+	if ok, _ := entry.AllowRate("192.0.2.2:1000"); !ok {
+		t.Fatalf("expected another IP allowed")
+	}
+	if ok, _ := entry.AllowRate("192.0.2.3:1000"); ok {
+		t.Fatalf("expected tunnel burst exhausted")
+	}
+
+	// An operator limit can only tighten the client's.
+	registry.SetServerRateLimit("t1", RateLimit{Rate: 100, PerIP: 0.5, PerIPBurst: 1})
+	entry, _ = registry.LookupUDP(9000)
+	if got := entry.RateLimit.Stricter(entry.ServerRateLimit); got != (RateLimit{Rate: 1, Burst: 3, PerIP: 0.5, PerIPBurst: 1}) {
+		t.Fatalf("unexpected combined limit %+v", got)
+	}
+	if ok, _ := entry.AllowRate("192.0.2.1:1000"); !ok {
+		t.Fatalf("expected fresh buckets after a limit change")
+	}
+	if ok, _ := entry.AllowRate("192.0.2.1:1000"); ok {
+		t.Fatalf("expected tightened per-IP burst")
+	}
+}
+
+func TestLimiterCapsTrackedIPs(t *testing.T) {
+	limiter := NewLimiter(RateLimit{PerIP: 1})
+	for i := 0; i < maxIPBuckets; i++ {
+		addr := net.JoinHostPort(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String(), "1000")
+		if ok, _ := limiter.Allow(addr); !ok {
+			t.Fatalf("address %d: expected allowed", i)
+		}
+	}
+	if ok, wait := limiter.Allow("192.0.2.1:1000"); ok || wait <= 0 {
+		t.Fatalf("expected a new address refused while the limiter is full, got %v %v", ok, wait)
+	}
+	if len(limiter.perIP) != maxIPBuckets {
+		t.Fatalf("expected %d tracked addresses, got %d", maxIPBuckets, len(limiter.perIP))
+	}
+
+	// Buckets that have refilled make room again.
+	limiter.mu.Lock()
+	for _, b := range limiter.perIP {
+		b.last = b.last.Add(-time.Minute)
+	}
+	limiter.lastSweep = limiter.lastSweep.Add(-2 * ipSweepFullEvery)
+	limiter.mu.Unlock()
+	if ok, _ := limiter.Allow("192.0.2.1:1000"); !ok {
+		t.Fatalf("expected a new address allowed after a sweep")
+	}
+	if len(limiter.perIP) != 1 {
+		t.Fatalf("expected refilled buckets swept, got %d", len(limiter.perIP))
+	}
+}
+
+func TestRegistryRefusesTakeoverByAnotherToken(t *testing.T) {
+	registry := NewRegistry()
+	if err := registry.RegisterHTTP("t1", nil, HTTPRegistration{Subdomain: "app", OwnerTokenID: 1}); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := registry.RegisterHTTP("t1", nil, HTTPRegistration{Subdomain: "app", OwnerTokenID: 2}); err != ErrTunnelExists {
+		t.Fatalf("expected ErrTunnelExists for another token, got %v", err)
+	}
+	if err := registry.RegisterTCP("t2", nil, PortRegistration{ExternalPort: 9001, OwnerTokenID: 1}); err != nil {
+		t.Fatalf("register tcp failed: %v", err)
+	}
+	if err := registry.RegisterTCP("t2", nil, PortRegistration{ExternalPort: 9001, OwnerTokenID: 2}); err != ErrTunnelExists {
+		t.Fatalf("expected ErrTunnelExists for another token, got %v", err)
+	}
+	if err := registry.RegisterUDP("t3", nil, PortRegistration{ExternalPort: 9002, OwnerTokenID: 1}); err != nil {
+		t.Fatalf("register udp failed: %v", err)
+	}
+	if err := registry.RegisterUDP("t3", nil, PortRegistration{ExternalPort: 9002, OwnerTokenID: 2}); err != ErrTunnelExists {
+		t.Fatalf("expected ErrTunnelExists for another token, got %v", err)
+	}
+
+	// The owning token may take its tunnel over from another session.
+	if err := registry.RegisterHTTP("t1", nil, HTTPRegistration{Subdomain: "app", OwnerTokenID: 1}); err != nil {
+		t.Fatalf("expected same token to resume, got %v", err)
+	}
+	if entry, _ := registry.LookupHTTP("app"); entry.OwnerTokenID != 1 {
+		t.Fatalf("unexpected owner %d", entry.OwnerTokenID)
+	}
+}
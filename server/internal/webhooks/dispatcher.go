@@ -0,0 +1,155 @@
+// Package webhooks delivers tunnel lifecycle events to subscribed URLs.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+)
+
+// Headers sent with every delivery.
+const (
+	HeaderEvent     = "X-PortOpener-Event"
+	HeaderTimestamp = "X-PortOpener-Timestamp"
+	HeaderSignature = "X-PortOpener-Signature"
+)
+
+// Lifecycle lists the event types delivered to webhooks.
+var Lifecycle = []string{
+	events.TunnelConnected,
+	events.TunnelDisconnected,
+	events.TunnelClosed,
+	events.DomainStatusChanged,
+	events.TokenRotated,
+}
+
+// Dispatcher posts lifecycle events from the bus to every webhook that wants
+// them, retrying failed deliveries with exponential backoff and recording each
+// attempt.
+type Dispatcher struct {
+	Store  *storage.Store
+	Client *http.Client
+	// MaxAttempts bounds deliveries per event and webhook.
+	MaxAttempts int
+	// Backoff is the delay before the first retry; it doubles after each.
+	Backoff time.Duration
+}
+
+// Run delivers events until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context, bus *events.Bus) {
+	if d.Store == nil || bus == nil {
+		return
+	}
+	sub := bus.SubscribeTypes(256, Lifecycle...)
+	defer sub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-sub.C:
+			hooks, err := d.Store.ListWebhooks()
+			if err != nil {
+				log.Printf("webhook lookup failed: %v", err)
+				continue
+			}
+			for _, hook := range hooks {
+				if hook.Wants(ev.Type) {
+					go d.Deliver(ctx, hook, ev)
+				}
+			}
+		}
+	}
+}
+
+// Deliver posts ev to hook until it succeeds, attempts run out or ctx ends.
+func (d *Dispatcher) Deliver(ctx context.Context, hook storage.Webhook, ev events.Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	attempts := d.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	backoff := d.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 1; attempt <= attempts; attempt++ {
+		status, err := d.post(ctx, hook, ev.Type, body)
+		delivery := storage.WebhookDelivery{
+			WebhookID:  hook.ID,
+			Event:      ev.Type,
+			Attempt:    attempt,
+			StatusCode: status,
+			Succeeded:  err == nil,
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err := d.Store.InsertWebhookDelivery(delivery); err != nil {
+			log.Printf("webhook delivery log failed: %v", err)
+		}
+		if delivery.Succeeded || attempt == attempts {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (d *Dispatcher) post(ctx context.Context, hook storage.Webhook, event string, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PortOpener-Webhook")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(hook.Secret, timestamp, body))
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the signature header value for body sent at timestamp:
+// "sha256=" followed by the hex HMAC-SHA256 of "timestamp.body" keyed by secret.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,84 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AidyyJ/PortOpener/server/internal/events"
+	"github.com/AidyyJ/PortOpener/server/internal/storage"
+	"github.com/AidyyJ/PortOpener/server/internal/storage/storagetest"
+)
+
+func TestDispatcherSignsAndRetries(t *testing.T) {
+	store := storagetest.OpenTestStore(t)
+	received := make(chan []byte, 1)
+	var calls atomic.Int32
+	var secret string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if got := r.Header.Get(HeaderSignature); got != Sign(secret, r.Header.Get(HeaderTimestamp), body) {
+			t.Errorf("bad signature %q", got)
+		}
+		if r.Header.Get(HeaderEvent) != events.TunnelClosed {
+			t.Errorf("unexpected event header %q", r.Header.Get(HeaderEvent))
+		}
+		received <- body
+	}))
+	defer receiver.Close()
+
+	secret = "shh"
+	hook, err := store.CreateWebhook(storage.Webhook{URL: receiver.URL, Secret: secret, Events: []string{events.TunnelClosed}})
+	if err != nil {
+		t.Fatalf("create webhook failed: %v", err)
+	}
+	if _, err := store.CreateWebhook(storage.Webhook{URL: receiver.URL, Secret: "other", Events: []string{events.TokenRotated}}); err != nil {
+		t.Fatalf("create webhook failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := events.NewBus()
+	dispatcher := &Dispatcher{Store: store, MaxAttempts: 3, Backoff: 10 * time.Millisecond}
+	go dispatcher.Run(ctx, bus)
+	// Give Run time to subscribe before publishing.
+	time.Sleep(20 * time.Millisecond)
+
+	// A burst of request events must not crowd the lifecycle event out.
+	for i := 0; i < 1000; i++ {
+		bus.Publish(events.Event{Type: events.HTTPRequest, TunnelID: "tunnel-1"})
+	}
+	bus.Publish(events.Event{Type: events.TunnelClosed, TunnelID: "tunnel-1", Message: "terminated by admin"})
+
+	select {
+	case body := <-received:
+		if !strings.Contains(string(body), `"tunnel_id":"tunnel-1"`) {
+			t.Fatalf("unexpected payload %s", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("webhook was not delivered")
+	}
+
+	var deliveries []storage.WebhookDelivery
+	for i := 0; i < 50; i++ {
+		if deliveries, err = store.ListWebhookDeliveries(hook.ID, 10); err == nil && len(deliveries) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(deliveries) != 2 || deliveries[0].Attempt != 2 || !deliveries[0].Succeeded || deliveries[1].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected deliveries %+v", deliveries)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls.Load())
+	}
+}